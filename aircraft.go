@@ -1,7 +1,12 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"fmt"
+	"log"
+	"math"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -11,41 +16,41 @@ import (
 // Property definitions: https://github.com/SDRplay/dump1090/blob/master/README-json.md
 // Property definitions: http://www.nathanpralle.com/downloads/DUMP1090-FA_ADS-B_Aircraft.JSON_Field_Descriptions.pdf
 type Aircraft struct {
-	Hex            string  `json:"hex,omitempty"`          // Hexidecimal 24-bit ICAO code for aircraft
-	Flight         string  `json:"flight,omitempty"`       // Flight Number as filed
-	AltBaro        int     `json:"alt_baro,omitempty"`     // Barometric altitude of the aircraft
-	AltGeom        int     `json:"alt_geom,omitempty"`     // Geometric altitude of the aircraft
-	Gs             float64 `json:"gs,omitempty"`           // Ground Speed in knots
-	Ias            int     `json:"ias,omitempty"`          // Indicated Air Speed in knots
-	Tas            int     `json:"tas,omitempty"`          // True Air Speed in knots
-	Mach           float64 `json:"mach,omitempty"`         // Mach number
-	Track          float64 `json:"track,omitempty"`        // True track angle in degrees
-	TrackRate      float64 `json:"track_rate,omitempty"`   // Track angle rate in degrees/second
-	Roll           float64 `json:"roll,omitempty"`         // Roll Angle in degrees
-	MagHeading     float64 `json:"mag_heading,omitempty"`  // Magnetic Heading
-	TrueHeading    float64 `json:"true_heading,omitempty"` // True Heading
-	BaroRate       int     `json:"baro_rate,omitempty"`    // Barometric rate of change of altitude in feet/minute
-	GeomRate       int     `json:"geom_rate,omitempty"`    // Geometric rate of change of altitude in feet/minute
-	Squawk         string  `json:"squawk,omitempty"`       // Aircraft's assigned squawk code
-	Emergency      string  `json:"emergency,omitempty"`    // Whether or not the captain or crew has indicated plane is in a state of emergency
-	Category       string  `json:"category,omitempty"`     // Indicates what type of transmission equipment is on board: Class A1, A1S, A2, A3, B1S, or B1 equipment
-	NavQnh         float64 `json:"nav_qnh,omitempty"`      // Related to QNH, which is a barometer corrected for ground altitude
-	NavAltitudeMcp int     `json:"nav_altitude_mcp,omitempty"`
-	NavHeading     float64 `json:"nav_heading,omitempty"`
-	Lat            float64 `json:"lat,omitempty"` // Latitude of current position
-	Lon            float64 `json:"lon,omitempty"` // Longitude of current position
-	Nic            int     `json:"nic,omitempty"`
-	Rc             int     `json:"rc,omitempty"`
-	SeenPos        float64 `json:"seen_pos,omitempty"`
-	Version        int     `json:"version,omitempty"`  // DO-260, DO-260(A), or DO-260(B), version 0, 1, 2 repectively
-	NicBaro        int     `json:"nic_baro,omitempty"` // Navigation Integrity Category (NIC) specifies an integrity containment radius around an aircraft's reported position. Similar to NAC_P but for different versions. Ranges from 0 to 11 where 0 = Unknown and 11 = <7.5m.
-	NacP           int     `json:"nac_p,omitempty"`    // Navigation Accuracy Category for Position (NACp) specifies the 95% accuracy range of a reported aircraft's reported position within a circle of particular radius around the actual horizontal position. Values 0 to 11 indicating (in order): Unknown, <10 NM, <4 NM, <2 NM, <1 NM, <0.5 NM, <0.3 NM, <0.1 NM, <0.05 NM, <30 meters, <10 m, <3 m
-	NacV           int     `json:"nac_v,omitempty"`    // Navigation Accuracy Category for Velocity (NACv) specifies the accuracy of a reported aircraft's velocity. Values 0 to 4. 0 = Unknown or greater than 10 m/s, 1 = less than 10 m/s; 2 = less than 3 m/s; 3 = less than 1 m/s; 4 = less than 0.3 m/s
-	Sil            int     `json:"sil,omitempty"`      // Source Integrity Level (SIL) indicates the probability of the reported horizontal position exceeding the containment radius defined by the NIC on a per sample or per hour basis, as defined in TSO–C166b and TSO–C154c.
-	SilType        string  `json:"sil_type,omitempty"` // SIL measurement type
-	Gva            int     `json:"gva,omitempty"`      // Geometric Vertical Accuracy (GVA); Accuracy of vertical geometric position; 0 = unknown or greater than 150 meters; 1 = less than or equal to 150 meters; 2 = less than or equal to 45 meters
-	Sda            int     `json:"sda,omitempty"`      // System Design Assurance (SDA) indicates the probability of an aircraft malfunction causing false or misleading information to be transmitted, as defined in TSO–C166b and TSO–C154c.
-	// Mlat           []interface{} `json:"mlat,omitempty"`              // An object (array) that defines what values in the message have been derived from MLAT vs. the antenna
+	Hex            string    `json:"hex,omitempty"`          // Hexidecimal 24-bit ICAO code for aircraft
+	Flight         string    `json:"flight,omitempty"`       // Flight Number as filed
+	AltBaro        int       `json:"alt_baro,omitempty"`     // Barometric altitude of the aircraft
+	AltGeom        int       `json:"alt_geom,omitempty"`     // Geometric altitude of the aircraft
+	Gs             float64   `json:"gs,omitempty"`           // Ground Speed in knots
+	Ias            int       `json:"ias,omitempty"`          // Indicated Air Speed in knots
+	Tas            int       `json:"tas,omitempty"`          // True Air Speed in knots
+	Mach           float64   `json:"mach,omitempty"`         // Mach number
+	Track          float64   `json:"track,omitempty"`        // True track angle in degrees
+	TrackRate      float64   `json:"track_rate,omitempty"`   // Track angle rate in degrees/second
+	Roll           float64   `json:"roll,omitempty"`         // Roll Angle in degrees
+	MagHeading     float64   `json:"mag_heading,omitempty"`  // Magnetic Heading
+	TrueHeading    float64   `json:"true_heading,omitempty"` // True Heading
+	BaroRate       int       `json:"baro_rate,omitempty"`    // Barometric rate of change of altitude in feet/minute
+	GeomRate       int       `json:"geom_rate,omitempty"`    // Geometric rate of change of altitude in feet/minute
+	Squawk         string    `json:"squawk,omitempty"`       // Aircraft's assigned squawk code
+	Emergency      string    `json:"emergency,omitempty"`    // Whether or not the captain or crew has indicated plane is in a state of emergency
+	Category       string    `json:"category,omitempty"`     // Indicates what type of transmission equipment is on board: Class A1, A1S, A2, A3, B1S, or B1 equipment
+	NavQnh         float64   `json:"nav_qnh,omitempty"`      // Related to QNH, which is a barometer corrected for ground altitude
+	NavAltitudeMcp int       `json:"nav_altitude_mcp,omitempty"`
+	NavHeading     float64   `json:"nav_heading,omitempty"`
+	Lat            float64   `json:"lat,omitempty"` // Latitude of current position
+	Lon            float64   `json:"lon,omitempty"` // Longitude of current position
+	Nic            int       `json:"nic,omitempty"`
+	Rc             int       `json:"rc,omitempty"`
+	SeenPos        float64   `json:"seen_pos,omitempty"`
+	Version        int       `json:"version,omitempty"`  // DO-260, DO-260(A), or DO-260(B), version 0, 1, 2 repectively
+	NicBaro        int       `json:"nic_baro,omitempty"` // Navigation Integrity Category (NIC) specifies an integrity containment radius around an aircraft's reported position. Similar to NAC_P but for different versions. Ranges from 0 to 11 where 0 = Unknown and 11 = <7.5m.
+	NacP           int       `json:"nac_p,omitempty"`    // Navigation Accuracy Category for Position (NACp) specifies the 95% accuracy range of a reported aircraft's reported position within a circle of particular radius around the actual horizontal position. Values 0 to 11 indicating (in order): Unknown, <10 NM, <4 NM, <2 NM, <1 NM, <0.5 NM, <0.3 NM, <0.1 NM, <0.05 NM, <30 meters, <10 m, <3 m
+	NacV           int       `json:"nac_v,omitempty"`    // Navigation Accuracy Category for Velocity (NACv) specifies the accuracy of a reported aircraft's velocity. Values 0 to 4. 0 = Unknown or greater than 10 m/s, 1 = less than 10 m/s; 2 = less than 3 m/s; 3 = less than 1 m/s; 4 = less than 0.3 m/s
+	Sil            int       `json:"sil,omitempty"`      // Source Integrity Level (SIL) indicates the probability of the reported horizontal position exceeding the containment radius defined by the NIC on a per sample or per hour basis, as defined in TSO–C166b and TSO–C154c.
+	SilType        string    `json:"sil_type,omitempty"` // SIL measurement type
+	Gva            int       `json:"gva,omitempty"`      // Geometric Vertical Accuracy (GVA); Accuracy of vertical geometric position; 0 = unknown or greater than 150 meters; 1 = less than or equal to 150 meters; 2 = less than or equal to 45 meters
+	Sda            int       `json:"sda,omitempty"`      // System Design Assurance (SDA) indicates the probability of an aircraft malfunction causing false or misleading information to be transmitted, as defined in TSO–C166b and TSO–C154c.
+	Mlat           fieldList `json:"mlat,omitempty"`     // An object (array) that defines what values in the message have been derived from MLAT vs. the antenna
 	// Tisb           []interface{} `json:"tisb,omitempty"`              // Traffic Information Service-Broadcast (TIS-B); near as I can tell, this would be an array that would define which of these values were obtained through TIS-B (ADS-B IN), but I'm not positive.
 	Messages    int     `json:"messages,omitempty"`          // total number of Mode S messages received from this aircraft
 	Seen        float64 `json:"seen,omitempty"`              // how long ago (in seconds before "now") a message was last received from this aircraft
@@ -53,6 +58,48 @@ type Aircraft struct {
 	Timestamp   int64   `json:"timestamp,omitempty"`         // the timestamp ("now") when this record was created
 	Type        string  `json:"type,omitempty"`              // set to 'AIRCRAFT'
 	StationName string  `json:"groundStationName,omitempty"` // ground station name used to identify the receiver
+	Reg         string  `json:"r,omitempty"`                 // registration (tail number), resolved by readsb and tar1090 from a database
+	AcType      string  `json:"t,omitempty"`                 // ICAO aircraft type designator, resolved by readsb and tar1090 from a database
+
+	// Fields reported by other receivers in place of their dump1090 equivalents
+	NavAltMcp  int     `json:"nav_alt_mcp,omitempty"` // dump978 equivalent of nav_altitude_mcp
+	UatVersion int     `json:"uat_version,omitempty"` // UAT version, dump978 equivalent of version
+	Speed      float64 `json:"speed,omitempty"`       // Ground Speed in knots, reported by older receivers in place of gs
+}
+
+// fieldList is a list of field names, such as those derived from MLAT. It
+// is held as a comma separated string so that Aircraft remain comparable,
+// but is encoded as a JSON array.
+type fieldList string
+
+// contains reports whether name is in the list.
+func (l fieldList) contains(name string) bool {
+	for _, f := range strings.Split(string(l), ",") {
+		if f == name {
+			return true
+		}
+	}
+	return false
+}
+
+// MarshalJSON encodes the list as a JSON array.
+func (l fieldList) MarshalJSON() ([]byte, error) {
+	fields := []string{}
+	if l != "" {
+		fields = strings.Split(string(l), ",")
+	}
+	return json.Marshal(fields)
+}
+
+// UnmarshalJSON decodes the list from a JSON array.
+func (l *fieldList) UnmarshalJSON(b []byte) error {
+	fields := []string{}
+	err := json.Unmarshal(b, &fields)
+	if err != nil {
+		return err
+	}
+	*l = fieldList(strings.Join(fields, ","))
+	return nil
 }
 
 // Scan holds flight details for all currently visible aircraft.
@@ -60,37 +107,409 @@ type Scan struct {
 	Now      float64    `json:"now"`      // the time this file was generated, in seconds since Jan 1 1970 00:00:00 GMT (the Unix epoch)
 	Messages int        `json:"messages"` // the total number of Mode S messages processed since scanning started
 	Aircraft []Aircraft `json:"aircraft"` // a slice of Aircraft, one entry for each known aircraft
+
+	source string // identifies the source the scan was read from
+}
+
+// normalizeScan copies values reported under the field names used by other
+// receivers, such as dump978 and older builds of dump1090, into the fields
+// used by current builds of dump1090 so that all aircraft are handled
+// alike.
+func normalizeScan(s *Scan) {
+	for i := range s.Aircraft {
+		a := &s.Aircraft[i]
+
+		if a.NavAltitudeMcp == 0 {
+			a.NavAltitudeMcp = a.NavAltMcp
+		}
+
+		if a.Version == 0 {
+			a.Version = a.UatVersion
+		}
+
+		if a.Gs == 0 {
+			a.Gs = a.Speed
+		}
+	}
 }
 
 // AircraftPos is a record that maintains the last known position of an aircraft
 type AircraftPos struct {
-	modified bool
-	aircraft Aircraft
+	modified  bool
+	aircraft  Aircraft
+	published time.Time  // when the aircraft was last published
+	inRange   rangeState // whether the aircraft is within range of the station
+	scanned   float64    // the time of the scan the aircraft was last updated from
+	source    string     // the source of the scan the aircraft was last updated from
+	missing   float64    // the time of the first scan the aircraft was missing from, zero if present
+	anchor    location   // where the aircraft was when it last moved beyond idleJitter
+	movedAt   time.Time  // when the aircraft last moved beyond idleJitter, zero if unknown
+
+	lastSent map[string]json.RawMessage // fields of the message last published, if publishing deltas
+
+	// The sinks are sent each change once, even while publishing to
+	// RabbitMQ fails, so their delivery is recorded separately.
+	sinkSent     bool                       // whether the sinks have been sent the aircraft since it last changed
+	sinkLastSent map[string]json.RawMessage // fields of the message last sent to the sinks, if publishing deltas
+	sinkInRange  rangeState                 // the range state last sent to the sinks
+}
+
+// age returns how long before now, in seconds, the aircraft's position was
+// received. If the time of the scan is unknown the age at the time of the
+// scan is returned.
+func (p AircraftPos) age(now time.Time) float64 {
+	seen := p.aircraft.SeenPos
+	if seen == 0 {
+		seen = p.aircraft.Seen
+	}
+
+	if p.scanned == 0 {
+		return seen
+	}
+
+	elapsed := float64(now.UnixNano())/float64(time.Second) - p.scanned
+	return math.Max(0, elapsed+seen)
 }
 
+// Limits used to detect scans in which aircraft have moved implausibly.
+const (
+	maxPlausibleSpeed = 2000 // knots, faster than any aircraft likely to be heard
+	minTeleportSample = 5    // fewest aircraft needed to judge a scan
+)
+
 // Store is an in memory map of aircraft
 type Store struct {
-	lock     *sync.Mutex
+	lock     *sync.RWMutex
 	aircraft map[string]AircraftPos
+
+	minMessages int // aircraft heard fewer times than this are not stored
+	minNacP     int // positions with a lower NACp are ignored
+	minNic      int // positions with a lower NIC are ignored
+
+	allowNoPosition bool // store aircraft without a position so that changes to their identity are published
+	dedupeMlat      bool // ignore MLAT records for aircraft with a broadcast record in the same scan
+	identityChanges bool // treat changes to callsign, squawk or emergency status as updates
+	noPurge         bool // keep every aircraft seen, leaving retention to consumers
+
+	movedFields   movedFields   // fields that count as movement, defaults to position, altitude and track
+	moveThreshold moveThreshold // smallest changes that count as movement, zero counts any change
+
+	categoryMaxAge map[string]time.Duration // overrides maxAge for aircraft categories
+	missingGrace   time.Duration            // how long aircraft missing from scans are kept
+
+	maxPositionStaleness time.Duration // positions not updated for longer are discarded, zero disables
+
+	rejectTeleportFraction float64 // scans in which this fraction of aircraft jump implausibly are rejected, zero disables
+
+	reconcileKeys keyReconcile // how aircraft whose hex code is briefly missing are reconciled
+
+	changes chan struct{} // signalled when aircraft are modified, if set
+}
+
+// Range calls fn for each aircraft in the data Store in key order, stopping
+// early if fn returns false. The Store is read locked for the duration so
+// fn must not modify it.
+func (s *Store) Range(fn func(key string, pos AircraftPos) bool) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, k := range s.sortedKeys(nil, "") {
+		if fn(k, s.aircraft[k]) == false {
+			return
+		}
+	}
+}
+
+// ReplaceAll atomically replaces every aircraft in the data Store with
+// those in aircraft, keyed as by Aircraft.key, so that readers see either
+// the previous contents or the new ones and never a mix. It is intended for
+// loading complete snapshots rather than merging scans. The Store takes
+// ownership of the map, which must not be modified afterwards.
+func (s *Store) ReplaceAll(aircraft map[string]AircraftPos) {
+	if aircraft == nil {
+		aircraft = make(map[string]AircraftPos)
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.aircraft = aircraft
+}
+
+// notify signals that aircraft in the data Store have been modified. It
+// never blocks, so a single pending signal covers any number of changes.
+func (s *Store) notify() {
+	if s.changes == nil {
+		return
+	}
+	select {
+	case s.changes <- struct{}{}:
+	default:
+	}
+}
+
+// sortedKeys returns the keys of the aircraft in the data Store in a
+// stable order, so that output is reproducible. If a station location is
+// provided, aircraft are ordered by distance from it, nearest first, with
+// aircraft without a position last. Otherwise, or where distances are
+// equal, aircraft are ordered by key. The caller must hold the lock.
+func (s *Store) sortedKeys(station *location, method distanceMethod) []string {
+	keys := make([]string, 0, len(s.aircraft))
+	dist := make(map[string]float64, len(s.aircraft))
+	for k, v := range s.aircraft {
+		keys = append(keys, k)
+		if station == nil {
+			continue
+		}
+
+		dist[k] = math.Inf(1)
+		if v.aircraft.hasPosition() {
+			dist[k] = method.distance(*station, location{Lat: v.aircraft.Lat, Lon: v.aircraft.Lon})
+		}
+	}
+
+	sort.Slice(keys, func(i, j int) bool {
+		if di, dj := dist[keys[i]], dist[keys[j]]; di != dj {
+			return di < dj
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
+// key returns the key the aircraft is held against in the data Store: its
+// hex code, the stable 24-bit ICAO address. Callsigns aren't used, as many
+// aircraft don't broadcast one and different aircraft may share one.
+func (a Aircraft) key() string {
+	return a.Hex
+}
+
+// hasPosition reports whether the aircraft has reported a position.
+func (a Aircraft) hasPosition() bool {
+	return a.Lon != 0 || a.Lat != 0
+}
+
+// isMlat reports whether the aircraft's position was derived from
+// multilateration (MLAT) rather than broadcast by the aircraft.
+func (a Aircraft) isMlat() bool {
+	if a.Type == "mlat" {
+		return true
+	}
+
+	return a.Mlat.contains("lat") || a.Mlat.contains("lon")
+}
+
+// mlatDuplicates returns the indices of MLAT records in as for which a
+// record broadcast by the same aircraft, identified by its hex code, is
+// also present.
+func mlatDuplicates(as []Aircraft) map[int]bool {
+	adsb := map[string]bool{}
+	for _, a := range as {
+		if a.Hex != "" && !a.isMlat() {
+			adsb[a.Hex] = true
+		}
+	}
+
+	dups := map[int]bool{}
+	for i, a := range as {
+		if a.isMlat() && adsb[a.Hex] {
+			dups[i] = true
+		}
+	}
+	return dups
+}
+
+// identityChanged reports whether the callsign, squawk, emergency status or
+// category of an aircraft differ between a1 and a2.
+func identityChanged(a1, a2 Aircraft) bool {
+	return a1.Flight != a2.Flight ||
+		a1.Squawk != a2.Squawk ||
+		a1.Emergency != a2.Emergency ||
+		a1.Category != a2.Category
 }
 
 // HasMoved takes two Aircraft positions and returns a boolean to indicate
 // whether the aircraft has moved. An error is returned if the positions
 // provided relate to different aircraft.
 func HasMoved(a1, a2 Aircraft) (bool, error) {
-	if a1.Flight == "" || a2.Flight == "" {
+	return defaultMovedFields.hasMoved(a1, a2, moveThreshold{})
+}
+
+// moveThreshold holds the smallest changes in position, altitude and track
+// that count as movement, so that aircraft whose reports jitter while they
+// are stationary aren't published. A zero threshold counts any change.
+type moveThreshold struct {
+	metres  float64 // horizontal distance
+	feet    float64 // geometric or barometric altitude
+	degrees float64 // track
+}
+
+// horizontal reports whether an aircraft has moved horizontally between
+// the locations a and b, measured along the great circle between them.
+func (t moveThreshold) horizontal(a, b location) bool {
+	if t.metres <= 0 {
+		return a != b
+	}
+	return distanceMetres(a, b) > t.metres
+}
+
+// vertical reports whether an altitude has changed from a to b.
+func (t moveThreshold) vertical(a, b int) bool {
+	return math.Abs(float64(a-b)) > t.feet
+}
+
+// turned reports whether a track has changed from a to b, taking the
+// shorter way around the compass so that 359° to 1° is a change of 2°.
+func (t moveThreshold) turned(a, b float64) bool {
+	d := math.Mod(math.Abs(a-b), 360)
+	return math.Min(d, 360-d) > t.degrees
+}
+
+// movedField names a field compared to decide whether an aircraft has
+// moved.
+type movedField string
+
+// Fields that may be compared to decide whether an aircraft has moved.
+const (
+	movedLat      movedField = "lat"
+	movedLon      movedField = "lon"
+	movedAltitude movedField = "altitude" // geometric or barometric altitude
+	movedTrack    movedField = "track"
+)
+
+// movedFields are the fields compared to decide whether an aircraft has
+// moved. Changes to other fields aren't published.
+type movedFields []movedField
+
+// defaultMovedFields treats a change to any part of the position, altitude
+// or track as movement.
+var defaultMovedFields = movedFields{movedLat, movedLon, movedAltitude, movedTrack}
+
+// parseMovedFields validates the fields that count as movement read from
+// the configuration file. An empty list selects the default fields.
+func parseMovedFields(names []string) (movedFields, error) {
+	if len(names) == 0 {
+		return defaultMovedFields, nil
+	}
+
+	fields := movedFields{}
+	for _, name := range names {
+		switch f := movedField(strings.ToLower(strings.TrimSpace(name))); f {
+		case movedLat, movedLon, movedAltitude, movedTrack:
+			fields = append(fields, f)
+		default:
+			return nil, fmt.Errorf("unknown field %q, expected lat, lon, altitude or track", name)
+		}
+	}
+	return fields, nil
+}
+
+// hasMoved reports whether any of the fields differ between two positions
+// of an aircraft by more than the threshold t. Changes to lat and lon are
+// measured as distances, and with a horizontal threshold set, an aircraft
+// tracking lat and lon has moved once the distance between the positions
+// exceeds it, whatever its direction. An error is returned if the
+// positions provided relate to different aircraft, identified by their
+// hex codes.
+func (f movedFields) hasMoved(a1, a2 Aircraft, t moveThreshold) (bool, error) {
+	if a1.key() == "" || a2.key() == "" {
 		return false, errors.New("a1 and/or a2 represents unknown aircraft")
 	}
 
-	if a1.Flight != a2.Flight {
+	if a1.key() != a2.key() {
 		return false, errors.New("a1 and a2 represent different aircraft")
 	}
 
-	return !(a1.Lon == a2.Lon &&
-		a1.Lat == a2.Lat &&
-		a1.AltGeom == a2.AltGeom &&
-		a1.AltBaro == a2.AltBaro &&
-		a1.Track == a2.Track), nil
+	for _, field := range f {
+		switch field {
+		case movedLat:
+			if t.horizontal(location{Lat: a1.Lat, Lon: a1.Lon}, location{Lat: a2.Lat, Lon: a1.Lon}) {
+				return true, nil
+			}
+		case movedLon:
+			if t.horizontal(location{Lat: a1.Lat, Lon: a1.Lon}, location{Lat: a1.Lat, Lon: a2.Lon}) {
+				return true, nil
+			}
+		case movedAltitude:
+			if t.vertical(a1.AltGeom, a2.AltGeom) || t.vertical(a1.AltBaro, a2.AltBaro) {
+				return true, nil
+			}
+		case movedTrack:
+			if t.turned(a1.Track, a2.Track) {
+				return true, nil
+			}
+		}
+	}
+
+	if t.metres > 0 && f.contains(movedLat) && f.contains(movedLon) {
+		return t.horizontal(location{Lat: a1.Lat, Lon: a1.Lon}, location{Lat: a2.Lat, Lon: a2.Lon}), nil
+	}
+	return false, nil
+}
+
+// contains reports whether field is one of the fields.
+func (f movedFields) contains(field movedField) bool {
+	for _, m := range f {
+		if m == field {
+			return true
+		}
+	}
+	return false
+}
+
+// applyScan updates the data Store with the aircraft in a Scan and removes
+// those older than maxAge, unless the scan is implausible, in which case
+// it is rejected and the data Store left unchanged.
+func applyScan(s Scan, store *Store, station string, maxAge time.Duration) {
+	if n, total := store.teleported(s); store.implausible(n, total) {
+		scansRejected.Add(1)
+		log.Printf("rejected scan of %s: %d of %d aircraft moved implausibly far\n", s.source, n, total)
+		return
+	}
+
+	updateAircraft(s, store, station)
+	purgeAircraft(s, store, maxAge)
+}
+
+// teleported counts the aircraft in a Scan that have moved implausibly far
+// from their stored position, along with the total number of aircraft
+// whose movement could be checked. Movement can only be checked for
+// aircraft from the same source with a position in both, where the time
+// between the scans is known.
+func (s *Store) teleported(scan Scan) (n, total int) {
+	if s.rejectTeleportFraction <= 0 {
+		return 0, 0
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	for _, a := range scan.Aircraft {
+		prev, ok := s.aircraft[a.key()]
+		if !ok || prev.source != scan.source || !a.hasPosition() || !prev.aircraft.hasPosition() {
+			continue
+		}
+
+		elapsed := scan.Now - prev.scanned
+		if prev.scanned == 0 || elapsed <= 0 {
+			continue
+		}
+
+		total++
+		d := distanceNM(location{Lat: prev.aircraft.Lat, Lon: prev.aircraft.Lon}, location{Lat: a.Lat, Lon: a.Lon})
+		if d/(elapsed/3600) > maxPlausibleSpeed {
+			n++
+		}
+	}
+	return n, total
+}
+
+// implausible reports whether a scan in which n of the total aircraft
+// checked moved implausibly far should be rejected.
+func (s *Store) implausible(n, total int) bool {
+	if s.rejectTeleportFraction <= 0 || total < minTeleportSample {
+		return false
+	}
+	return float64(n)/float64(total) >= s.rejectTeleportFraction
 }
 
 // UpdateAircraft takes a Scan and updates the data Store with the latest
@@ -98,53 +517,285 @@ func HasMoved(a1, a2 Aircraft) (bool, error) {
 // from the data Store. The data Store is marked as modified if changes
 // are made.
 func updateAircraft(s Scan, store *Store, station string) {
+	dropped := map[string]int64{}
+	messageRates.update(s.source, s.Now, s.Messages)
+
+	// Feeds may include both a broadcast and an MLAT record for the same
+	// aircraft, in which case the broadcast position is preferred.
+	var duplicates map[int]bool
+	if store.dedupeMlat {
+		duplicates = mlatDuplicates(s.Aircraft)
+	}
 
 	// update aircraft positions in the data Store
 	for i := range s.Aircraft {
 
-		if s.Aircraft[i].Flight == "" || s.Aircraft[i].Lon == 0 || s.Aircraft[i].Lat == 0 {
+		if duplicates[i] {
 			continue
 		}
 
-		// Update and clean the aircraft data
+		// Aircraft whose hex code is briefly missing may be reconciled
+		// with the aircraft broadcasting the same callsign.
 		s.Aircraft[i].Flight = strings.TrimSpace(s.Aircraft[i].Flight)
+		store.reconcileKey(&s.Aircraft[i])
+
+		if reason := store.dropReason(s.Aircraft[i]); reason != "" {
+			dropped[reason]++
+			continue
+		}
+
+		// Low accuracy positions are ignored once the lock is held, as
+		// aircraft already stored keep their last accepted position.
+		lowAccuracy := store.lowAccuracy(s.Aircraft[i])
+
+		// Stale positions of aircraft kept for their identity are removed
+		// so that they don't linger on maps.
+		if store.positionStale(s.Aircraft[i]) {
+			s.Aircraft[i].Lat, s.Aircraft[i].Lon = 0, 0
+		}
+
+		// Update and clean the aircraft data
 		s.Aircraft[i].Type = "AIRCRAFT"
 		s.Aircraft[i].StationName = station
 		if s.Aircraft[i].Timestamp == 0 {
 			s.Aircraft[i].Timestamp = time.Now().UnixNano() / 1000
 		}
 
-		a2, ok := store.aircraft[s.Aircraft[i].Flight]
-		moved, _ := HasMoved(s.Aircraft[i], a2.aircraft)
-		if ok && !moved {
+		// The lock is held from classifying the aircraft until it is
+		// stored, so that a concurrent change isn't overwritten.
+		store.lock.Lock()
+		if lowAccuracy {
+			store.ignorePosition(&s.Aircraft[i])
+		}
+		a2, added, updated := store.classify(s, s.Aircraft[i])
+		if !added && !updated {
+			store.lock.Unlock()
 			continue
 		}
-
-		store.lock.Lock()
-		store.aircraft[s.Aircraft[i].Flight] = AircraftPos{aircraft: s.Aircraft[i], modified: true}
+		store.aircraft[s.Aircraft[i].key()] = AircraftPos{aircraft: s.Aircraft[i], modified: true, published: a2.published, inRange: a2.inRange, scanned: s.Now, source: s.source, anchor: a2.anchor, movedAt: a2.movedAt, lastSent: a2.lastSent, sinkLastSent: a2.sinkLastSent, sinkInRange: a2.sinkInRange}
 		store.lock.Unlock()
+		store.notify()
+
+		if added {
+			aircraftAdded.Add(1)
+		}
+	}
+
+	droppedAircraft.Add(dropNoPosition, dropped[dropNoPosition])
+	droppedAircraft.Add(dropNoHex, dropped[dropNoHex])
+	droppedAircraft.Add(dropFewMessages, dropped[dropFewMessages])
+	droppedAircraft.Add(dropLowAccuracy, dropped[dropLowAccuracy])
+	droppedAircraft.Add(dropStalePosition, dropped[dropStalePosition])
+	if debug && len(dropped) > 0 {
+		log.Printf("dropped %d aircraft without a position, %d without a hex code, %d with too few messages, %d with low accuracy and %d with a stale position\n", dropped[dropNoPosition], dropped[dropNoHex], dropped[dropFewMessages], dropped[dropLowAccuracy], dropped[dropStalePosition])
+	}
+}
+
+// dropReason returns the reason aircraft a would not be stored in the data
+// Store, or an empty string if it would be.
+func (s *Store) dropReason(a Aircraft) string {
+	switch {
+	case !a.hasPosition() && !s.allowNoPosition:
+		return dropNoPosition
+	case a.Hex == "":
+		return dropNoHex
+	case a.Messages < s.minMessages:
+		return dropFewMessages
+
+	// Low accuracy positions are ignored, so aircraft are dropped unless
+	// those without a position are allowed. Aircraft already in the data
+	// Store keep their last trusted position and remain tracked for as
+	// long as they are present in the scan.
+	case s.lowAccuracy(a) && !s.allowNoPosition:
+		return dropLowAccuracy
+
+	// Aircraft whose position is stale are dropped, unless aircraft
+	// without a position are allowed, in which case the position is
+	// removed and the aircraft kept for its identity.
+	case s.positionStale(a) && !s.allowNoPosition:
+		return dropStalePosition
+	}
+	return ""
+}
+
+// lowAccuracy reports whether the position of aircraft a has a NACp or NIC
+// below the configured minimum, and so should be ignored.
+func (s *Store) lowAccuracy(a Aircraft) bool {
+	return a.hasPosition() && (a.NacP < s.minNacP || a.Nic < s.minNic)
+}
+
+// ignorePosition removes the low accuracy position of aircraft a, leaving
+// it with the last accepted position if it is already in the data Store.
+// The caller must hold the Store's lock.
+func (s *Store) ignorePosition(a *Aircraft) {
+	a.Lat, a.Lon = 0, 0
+	if prev, ok := s.aircraft[a.key()]; ok {
+		a.Lat, a.Lon = prev.aircraft.Lat, prev.aircraft.Lon
+	}
+}
+
+// positionStale reports whether the position of aircraft a was last
+// updated longer ago than the configured maximum.
+func (s *Store) positionStale(a Aircraft) bool {
+	if s.maxPositionStaleness <= 0 || !a.hasPosition() {
+		return false
+	}
+	return time.Duration(a.SeenPos*float64(time.Second)) > s.maxPositionStaleness
+}
+
+// classify reports whether aircraft a, read from scan, is new to the data
+// Store or should replace the position already stored. The stored
+// position, if any, is also returned. The caller must hold the Store's
+// lock.
+func (s *Store) classify(scan Scan, a Aircraft) (prev AircraftPos, added, updated bool) {
+	prev, ok := s.aircraft[a.key()]
+	if !ok {
+		return prev, true, false
+	}
+
+	// An aircraft that has changed its callsign is treated as having moved
+	// so that the new callsign is published. Other changes to its identity,
+	// such as a new squawk, are only published if configured, or if the
+	// aircraft may not have a position to change.
+	fields := s.movedFields
+	if fields == nil {
+		fields = defaultMovedFields
+	}
+	moved, err := fields.hasMoved(a, prev.aircraft, s.moveThreshold)
+	identity := s.identityChanges || s.allowNoPosition
+	if err != nil || a.Flight != prev.aircraft.Flight || identity && identityChanged(a, prev.aircraft) {
+		moved = true
+	}
+	if !moved {
+		return prev, false, false
+	}
+
+	// When merging sources, an aircraft heard by another source with a
+	// stronger signal is left attributed to that source.
+	if prev.source != scan.source && prev.aircraft.Rssi > a.Rssi {
+		return prev, false, false
+	}
+
+	return prev, false, true
+}
+
+// missingExpired reports whether an aircraft that has been missing from
+// scans since the scan at time since should be removed at the scan at time
+// now. Scans without a time can't measure the grace period.
+func (s *Store) missingExpired(since, now float64) bool {
+	missingFor := time.Duration((now - since) * float64(time.Second))
+	return missingFor >= s.missingGrace || now == 0
+}
+
+// StoreDiff describes the changes a Scan would make to the data Store.
+type StoreDiff struct {
+	Added   []Aircraft // aircraft not yet in the data Store
+	Updated []Aircraft // aircraft whose stored position would be replaced
+	Removed []string   // keys of aircraft that would be removed, in order
+}
+
+// Diff returns the changes that applying scan would make to the data
+// Store, without modifying it. Aircraft the Store would drop are ignored.
+// Removed aircraft are those from the scan's source that have been missing
+// from it for longer than the missingGrace period; aircraft removed for
+// exceeding their maximum age are not included.
+func (s *Store) Diff(scan Scan) StoreDiff {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	d := StoreDiff{}
+	seen := map[string]bool{}
+
+	for _, a := range scan.Aircraft {
+		a.Flight = strings.TrimSpace(a.Flight)
+		seen[a.key()] = true
+
+		if s.dropReason(a) != "" {
+			continue
+		}
+		if s.lowAccuracy(a) {
+			s.ignorePosition(&a)
+		}
+
+		_, added, updated := s.classify(scan, a)
+		switch {
+		case added:
+			d.Added = append(d.Added, a)
+		case updated:
+			d.Updated = append(d.Updated, a)
+		}
+	}
+
+	for k, v := range s.aircraft {
+		if v.source != scan.source || seen[k] {
+			continue
+		}
+
+		since := v.missing
+		if since == 0 {
+			since = scan.Now
+		}
+		if s.missingExpired(since, scan.Now) {
+			d.Removed = append(d.Removed, k)
+		}
 	}
+	sort.Strings(d.Removed)
+
+	return d
 }
 
-// PurgeAircraft removes any aircraft not present in the scan from the
-// data Store. Any aircraft that are included in the scan but are older
-// than maxAge are also removed.
+// PurgeAircraft removes any aircraft from the scan's source that have been
+// missing from its scans for longer than the Store's missingGrace period.
+// Any aircraft that are included in the scan but are older than maxAge, or
+// the age configured for their category, are also removed. Aircraft
+// attributed to other sources are left for the scans of those sources to
+// purge. Nothing is removed if the Store is configured not to purge.
 func purgeAircraft(s Scan, store *Store, maxAge time.Duration) {
+	if store.noPurge {
+		return
+	}
+
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
 	seen := map[string]bool{}
 	for _, a := range s.Aircraft {
-		seen[a.Flight] = true
+		seen[a.key()] = true
 	}
 
 	for k, v := range store.aircraft {
 
+		if v.source != s.source {
+			continue
+		}
+
 		if _, ok := seen[k]; ok != true {
-			delete(store.aircraft, k)
+			if v.missing == 0 {
+				v.missing = s.Now
+				store.aircraft[k] = v
+			}
+
+			if store.missingExpired(v.missing, s.Now) {
+				delete(store.aircraft, k)
+				aircraftRemoved.Add(1)
+			}
 			continue
 		}
 
+		if v.missing != 0 {
+			v.missing = 0
+			store.aircraft[k] = v
+		}
+
+		age := maxAge
+		if a, ok := store.categoryMaxAge[v.aircraft.Category]; ok {
+			age = a
+		}
+
 		lastSeen := time.Second * time.Duration(v.aircraft.Seen)
-		if lastSeen > maxAge {
+		if lastSeen > age {
 			delete(store.aircraft, k)
+			aircraftRemoved.Add(1)
 		}
 	}
 }
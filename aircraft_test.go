@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"math"
 	"sync"
 	"testing"
 	"time"
@@ -19,43 +22,43 @@ func TestHasMoved(t *testing.T) {
 	}{
 		{
 			name:    "identical",
-			a1:      Aircraft{Flight: "a1", Lat: 1.1, Lon: 2.2, AltGeom: 3, Track: 4.1},
-			a2:      Aircraft{Flight: "a1", Lat: 1.1, Lon: 2.2, AltGeom: 3, Track: 4.1},
+			a1:      Aircraft{Hex: "a1", Lat: 1.1, Lon: 2.2, AltGeom: 3, Track: 4.1},
+			a2:      Aircraft{Hex: "a1", Lat: 1.1, Lon: 2.2, AltGeom: 3, Track: 4.1},
 			wantVal: false,
 			wantErr: nil,
 		},
 		{
 			name:    "moved_lat",
-			a1:      Aircraft{Flight: "a1", Lat: 1, Lon: 2, AltGeom: 3, Track: 4},
-			a2:      Aircraft{Flight: "a1", Lat: 2, Lon: 2, AltGeom: 3, Track: 4},
+			a1:      Aircraft{Hex: "a1", Lat: 1, Lon: 2, AltGeom: 3, Track: 4},
+			a2:      Aircraft{Hex: "a1", Lat: 2, Lon: 2, AltGeom: 3, Track: 4},
 			wantVal: true,
 			wantErr: nil,
 		},
 		{
 			name:    "moved_lon",
-			a1:      Aircraft{Flight: "a1", Lat: 1, Lon: 2, AltGeom: 3, Track: 4},
-			a2:      Aircraft{Flight: "a1", Lat: 1, Lon: 3, AltGeom: 3, Track: 4},
+			a1:      Aircraft{Hex: "a1", Lat: 1, Lon: 2, AltGeom: 3, Track: 4},
+			a2:      Aircraft{Hex: "a1", Lat: 1, Lon: 3, AltGeom: 3, Track: 4},
 			wantVal: true,
 			wantErr: nil,
 		},
 		{
 			name:    "moved_alt",
-			a1:      Aircraft{Flight: "a1", Lat: 1, Lon: 2, AltGeom: 3, Track: 4},
-			a2:      Aircraft{Flight: "a1", Lat: 1, Lon: 2, AltGeom: 4, Track: 4},
+			a1:      Aircraft{Hex: "a1", Lat: 1, Lon: 2, AltGeom: 3, Track: 4},
+			a2:      Aircraft{Hex: "a1", Lat: 1, Lon: 2, AltGeom: 4, Track: 4},
 			wantVal: true,
 			wantErr: nil,
 		},
 		{
 			name:    "moved_track",
-			a1:      Aircraft{Flight: "a1", Lat: 1, Lon: 2, AltGeom: 3, Track: 4},
-			a2:      Aircraft{Flight: "a1", Lat: 1, Lon: 2, AltGeom: 3, Track: 5},
+			a1:      Aircraft{Hex: "a1", Lat: 1, Lon: 2, AltGeom: 3, Track: 4},
+			a2:      Aircraft{Hex: "a1", Lat: 1, Lon: 2, AltGeom: 3, Track: 5},
 			wantVal: true,
 			wantErr: nil,
 		},
 		{
 			name:    "different",
-			a1:      Aircraft{Flight: "a1", Lat: 1, Lon: 2, AltGeom: 3, Track: 4},
-			a2:      Aircraft{Flight: "a2", Lat: 1, Lon: 2, AltGeom: 3, Track: 4},
+			a1:      Aircraft{Hex: "a1", Lat: 1, Lon: 2, AltGeom: 3, Track: 4},
+			a2:      Aircraft{Hex: "a2", Lat: 1, Lon: 2, AltGeom: 3, Track: 4},
 			wantVal: false,
 			wantErr: fmt.Errorf("a1 and a2 represent different aircraft"),
 		},
@@ -89,40 +92,151 @@ func TestHasMoved(t *testing.T) {
 	}
 }
 
+func TestMovedFields(t *testing.T) {
+	fields, err := parseMovedFields([]string{"lat", " LON "})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := Aircraft{Hex: "a1", Lat: 1, Lon: 2, AltGeom: 3, AltBaro: 3, Track: 4}
+	testCases := []struct {
+		name string
+		a2   Aircraft
+		want bool
+	}{
+		{name: "identical", a2: a, want: false},
+		{name: "moved_lat", a2: Aircraft{Hex: "a1", Lat: 2, Lon: 2, AltGeom: 3, AltBaro: 3, Track: 4}, want: true},
+		{name: "moved_lon", a2: Aircraft{Hex: "a1", Lat: 1, Lon: 3, AltGeom: 3, AltBaro: 3, Track: 4}, want: true},
+		{name: "climbed", a2: Aircraft{Hex: "a1", Lat: 1, Lon: 2, AltGeom: 4, AltBaro: 4, Track: 4}, want: false},
+		{name: "turned", a2: Aircraft{Hex: "a1", Lat: 1, Lon: 2, AltGeom: 3, AltBaro: 3, Track: 5}, want: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := fields.hasMoved(a, tc.a2, moveThreshold{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("%v != %v", got, tc.want)
+			}
+		})
+	}
+
+	// An aircraft that only changes altitude isn't published with a
+	// position only policy.
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex), movedFields: fields}
+	b := Aircraft{Hex: "abc123", Flight: "A", Lat: 51.47, Lon: -0.45, AltGeom: 3000}
+	updateAircraft(Scan{Aircraft: []Aircraft{b}}, &store, "dummy station")
+	pos := store.aircraft[b.Hex]
+	pos.modified = false
+	store.aircraft[b.Hex] = pos
+
+	b.AltGeom = 3500
+	updateAircraft(Scan{Aircraft: []Aircraft{b}}, &store, "dummy station")
+	if store.aircraft[b.Hex].modified {
+		t.Error("expected altitude change to be ignored")
+	}
+
+	b.Lat = 51.48
+	updateAircraft(Scan{Aircraft: []Aircraft{b}}, &store, "dummy station")
+	if !store.aircraft[b.Hex].modified {
+		t.Error("expected position change to be published")
+	}
+}
+
+func TestParseMovedFields(t *testing.T) {
+	fields, err := parseMovedFields(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fields) != len(defaultMovedFields) {
+		t.Errorf("%v != %v", fields, defaultMovedFields)
+	}
+
+	_, err = parseMovedFields([]string{"lat", "speed"})
+	if err == nil {
+		t.Error("expected an error")
+	}
+}
+
+func TestMoveThreshold(t *testing.T) {
+	threshold := moveThreshold{metres: 10, feet: 50, degrees: 2}
+
+	a := Aircraft{Hex: "a1", Lat: 51.47, Lon: -0.45, AltGeom: 3000, AltBaro: 3000, Track: 359}
+	testCases := []struct {
+		name string
+		a1   Aircraft
+		a2   Aircraft
+		want bool
+	}{
+		{name: "identical", a1: a, a2: a, want: false},
+		{name: "jitter", a1: a, a2: Aircraft{Hex: "a1", Lat: 51.47001, Lon: -0.44999, AltGeom: 3025, AltBaro: 2975, Track: 1}, want: false},
+		{name: "moved_lat", a1: a, a2: Aircraft{Hex: "a1", Lat: 51.4702, Lon: -0.45, AltGeom: 3000, AltBaro: 3000, Track: 359}, want: true},
+		{name: "moved_diagonally", a1: a, a2: Aircraft{Hex: "a1", Lat: 51.47007, Lon: -0.44989, AltGeom: 3000, AltBaro: 3000, Track: 359}, want: true},
+		{name: "climbed", a1: a, a2: Aircraft{Hex: "a1", Lat: 51.47, Lon: -0.45, AltGeom: 3100, AltBaro: 3000, Track: 359}, want: true},
+		{name: "turned", a1: a, a2: Aircraft{Hex: "a1", Lat: 51.47, Lon: -0.45, AltGeom: 3000, AltBaro: 3000, Track: 2}, want: true},
+		{
+			name: "antimeridian",
+			a1:   Aircraft{Hex: "a1", Lat: 10, Lon: 179.99999},
+			a2:   Aircraft{Hex: "a1", Lat: 10, Lon: -179.99999},
+			want: false,
+		},
+		{
+			name: "pole",
+			a1:   Aircraft{Hex: "a1", Lat: 89.99999, Lon: 0},
+			a2:   Aircraft{Hex: "a1", Lat: 89.99999, Lon: 90},
+			want: false,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := defaultMovedFields.hasMoved(tc.a1, tc.a2, threshold)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tc.want {
+				t.Errorf("%v != %v", got, tc.want)
+			}
+		})
+	}
+}
+
 func TestUpdateAircraft(t *testing.T) {
-	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.Mutex)}
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
 
 	var station = "dummy station"
-	a1 := Aircraft{Flight: "A", Lat: 1, Lon: 2, AltGeom: 3, Track: 4, Seen: 90, Type: "AIRCRAFT", StationName: station, Timestamp: 1}
-	a2 := Aircraft{Flight: "B", Lat: 1, Lon: 2, AltGeom: 3, Track: 4, Seen: 90, Type: "AIRCRAFT", StationName: station, Timestamp: 1}
-	a3 := Aircraft{Flight: "C", Lat: 1, Lon: 2, AltGeom: 3, Track: 4, Seen: 90, Type: "AIRCRAFT", StationName: station, Timestamp: 1}
-	a4 := Aircraft{Lat: 1, Lon: 2, AltGeom: 3, Track: 4, Seen: 60, Type: "AIRCRAFT", StationName: station, Timestamp: 1}
+	a1 := Aircraft{Hex: "a", Flight: "A", Lat: 1, Lon: 2, AltGeom: 3, Track: 4, Seen: 90, Type: "AIRCRAFT", StationName: station, Timestamp: 1}
+	a2 := Aircraft{Hex: "b", Flight: "B", Lat: 1, Lon: 2, AltGeom: 3, Track: 4, Seen: 90, Type: "AIRCRAFT", StationName: station, Timestamp: 1}
+	a3 := Aircraft{Hex: "c", Flight: "C", Lat: 1, Lon: 2, AltGeom: 3, Track: 4, Seen: 90, Type: "AIRCRAFT", StationName: station, Timestamp: 1}
+	a4 := Aircraft{Flight: "D", Lat: 1, Lon: 2, AltGeom: 3, Track: 4, Seen: 60, Type: "AIRCRAFT", StationName: station, Timestamp: 1}
 
 	// Data Store starts off with two known aircraft.
-	store.aircraft[a1.Flight] = AircraftPos{aircraft: a1}
-	store.aircraft[a2.Flight] = AircraftPos{aircraft: a2}
+	store.aircraft[a1.Hex] = AircraftPos{aircraft: a1}
+	store.aircraft[a2.Hex] = AircraftPos{aircraft: a2}
 
 	// One aircraft moves position
 	a1.Lat = -1
 
-	// Scan contains four aircraft (one without a flight identifier)l
+	// Scan contains four aircraft (one without a hex code)
 	scan := Scan{Now: 100.0, Aircraft: []Aircraft{a1, a2, a3, a4}}
 
 	updateAircraft(scan, &store, station)
 
 	// We expect the position of the known aircraft that moved to be updated.
-	if store.aircraft[a1.Flight].aircraft != a1 {
-		t.Errorf("%v != %v", store.aircraft[a1.Flight], a1)
+	if store.aircraft[a1.Hex].aircraft != a1 {
+		t.Errorf("%v != %v", store.aircraft[a1.Hex], a1)
 	}
 
 	// We expect the position of the aircraft that didn't move to remain unchanged
-	if store.aircraft[a1.Flight].aircraft != a1 {
-		t.Errorf("%v != %v", store.aircraft[a2.Flight], a2)
+	if store.aircraft[a2.Hex].aircraft != a2 {
+		t.Errorf("%v != %v", store.aircraft[a2.Hex], a2)
 	}
 
 	// We expect the data store to contain three aircraft the two it knew about and
-	// the new aircraft that contained a flight identifier. We don't expect it to
-	// contain the aircraft that didn't have a flight identifier.
+	// the new aircraft that contained a hex code. We don't expect it to
+	// contain the aircraft that didn't have a hex code.
 	if got, want := len(store.aircraft), 3; got != want {
 		t.Errorf("%d != %d", got, want)
 	}
@@ -130,13 +244,13 @@ func TestUpdateAircraft(t *testing.T) {
 
 func TestPurgeAircraft(t *testing.T) {
 	maxAge := time.Second * 60
-	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.Mutex)}
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
 
 	// Data store contains two aircraft, one old, one new.
-	a1 := Aircraft{Flight: "A", Seen: 10}
-	a2 := Aircraft{Flight: "B", Seen: 90}
-	store.aircraft[a1.Flight] = AircraftPos{aircraft: a1}
-	store.aircraft[a2.Flight] = AircraftPos{aircraft: a2}
+	a1 := Aircraft{Hex: "a", Flight: "A", Seen: 10}
+	a2 := Aircraft{Hex: "b", Flight: "B", Seen: 90}
+	store.aircraft[a1.Hex] = AircraftPos{aircraft: a1}
+	store.aircraft[a2.Hex] = AircraftPos{aircraft: a2}
 
 	// Scan contains no aircraft.
 	scan := Scan{Aircraft: []Aircraft{a1, a2}}
@@ -148,3 +262,846 @@ func TestPurgeAircraft(t *testing.T) {
 		t.Errorf("%d != %d", got, want)
 	}
 }
+
+func TestPurgeAircraftNoPurge(t *testing.T) {
+	maxAge := time.Second * 60
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex), noPurge: true}
+
+	// Data store contains an old aircraft and one that has disappeared.
+	a1 := Aircraft{Hex: "a", Flight: "A", Seen: 90}
+	a2 := Aircraft{Hex: "b", Flight: "B", Seen: 10}
+	store.aircraft[a1.Hex] = AircraftPos{aircraft: a1}
+	store.aircraft[a2.Hex] = AircraftPos{aircraft: a2}
+
+	purgeAircraft(Scan{Now: 100, Aircraft: []Aircraft{a1}}, &store, maxAge)
+	purgeAircraft(Scan{Now: 200, Aircraft: []Aircraft{a1}}, &store, maxAge)
+
+	// We expect both aircraft to be kept.
+	if got, want := len(store.aircraft), 2; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+}
+
+// TestPurgeAircraftConcurrent updates and purges the same data Store
+// concurrently. Run with -race to detect unsynchronised access.
+func TestPurgeAircraftConcurrent(t *testing.T) {
+	maxAge := time.Second * 60
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+
+	scan := func(i int) Scan {
+		as := []Aircraft{}
+		for j := 0; j < 20; j++ {
+			// Half of the aircraft come and go between scans.
+			if j%2 == 1 && i%2 == 1 {
+				continue
+			}
+			as = append(as, Aircraft{Hex: fmt.Sprintf("a%d", j), Flight: fmt.Sprintf("A%d", j), Lat: 1 + float64(i)/1000, Lon: 2, Seen: float64(i % 90)})
+		}
+		return Scan{Now: float64(100 + i), Aircraft: as}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			updateAircraft(scan(i), &store, "dummy station")
+		}
+	}()
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 200; i++ {
+			purgeAircraft(scan(i), &store, maxAge)
+		}
+	}()
+	wg.Wait()
+
+	// Once the last scan has been purged we expect to find only the
+	// aircraft it includes, each with its latest position.
+	last := scan(199)
+	purgeAircraft(last, &store, maxAge)
+	if got, want := len(store.aircraft), len(last.Aircraft); got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+	for _, a := range last.Aircraft {
+		p, ok := store.aircraft[a.Hex]
+		if !ok {
+			t.Errorf("expected %s to be stored", a.Hex)
+			continue
+		}
+		if p.aircraft.Lat != a.Lat || p.scanned != last.Now || !p.modified {
+			t.Errorf("%s: %v != %v", a.Hex, p.aircraft, a)
+		}
+	}
+}
+
+func TestUpdateAircraftConcurrent(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+
+	as := []Aircraft{}
+	for j := 0; j < 500; j++ {
+		as = append(as, Aircraft{Hex: fmt.Sprintf("a%d", j), Flight: fmt.Sprintf("A%d", j), Lat: 1, Lon: 2})
+	}
+
+	// Each aircraft is found to be new by only one of the updates.
+	added := aircraftAdded.Value()
+	var wg sync.WaitGroup
+	for n := 0; n < 8; n++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s := Scan{Now: 100, Aircraft: append([]Aircraft{}, as...)}
+			updateAircraft(s, &store, "dummy station")
+		}()
+	}
+	wg.Wait()
+
+	if got, want := aircraftAdded.Value()-added, int64(len(as)); got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+	if got, want := len(store.aircraft), len(as); got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+}
+
+func TestPurgeAircraftCategory(t *testing.T) {
+	maxAge := time.Second * 60
+	store := Store{
+		aircraft:       make(map[string]AircraftPos),
+		lock:           new(sync.RWMutex),
+		categoryMaxAge: map[string]time.Duration{"A5": time.Second * 20, "A7": time.Second * 120},
+	}
+
+	// Heavy aircraft go stale quickly, rotorcraft slowly, others use maxAge.
+	a1 := Aircraft{Hex: "a", Flight: "A", Category: "A5", Seen: 30}
+	a2 := Aircraft{Hex: "b", Flight: "B", Category: "A7", Seen: 90}
+	a3 := Aircraft{Hex: "c", Flight: "C", Category: "A3", Seen: 90}
+	a4 := Aircraft{Hex: "d", Flight: "D", Category: "A3", Seen: 30}
+	for _, a := range []Aircraft{a1, a2, a3, a4} {
+		store.aircraft[a.Hex] = AircraftPos{aircraft: a}
+	}
+
+	purgeAircraft(Scan{Aircraft: []Aircraft{a1, a2, a3, a4}}, &store, maxAge)
+
+	for _, a := range []Aircraft{a1, a3} {
+		if _, ok := store.aircraft[a.Hex]; ok {
+			t.Errorf("expected %s to be purged", a.Flight)
+		}
+	}
+
+	for _, a := range []Aircraft{a2, a4} {
+		if _, ok := store.aircraft[a.Hex]; !ok {
+			t.Errorf("expected %s to be kept", a.Flight)
+		}
+	}
+}
+
+func TestMergeSources(t *testing.T) {
+	maxAge := time.Second * 60
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+
+	// Each station hears one aircraft on its own and both hear a third, B
+	// with a stronger signal.
+	scanA := Scan{source: "a", Aircraft: []Aircraft{
+		{Hex: "a1", Flight: "A1", Lat: 1, Lon: 2, Rssi: -20},
+		{Hex: "c", Flight: "C", Lat: 1, Lon: 2, Rssi: -30},
+	}}
+	scanB := Scan{source: "b", Aircraft: []Aircraft{
+		{Hex: "b1", Flight: "B1", Lat: 1, Lon: 2, Rssi: -20},
+		{Hex: "c", Flight: "C", Lat: 1, Lon: 2.1, Rssi: -10},
+	}}
+
+	updateAircraft(scanA, &store, "station a")
+	purgeAircraft(scanA, &store, maxAge)
+	updateAircraft(scanB, &store, "station b")
+	purgeAircraft(scanB, &store, maxAge)
+
+	want := map[string]string{"a1": "station a", "b1": "station b", "c": "station b"}
+	for hex, station := range want {
+		if got := store.aircraft[hex].aircraft.StationName; got != station {
+			t.Errorf("%s: %q != %q", hex, got, station)
+		}
+	}
+
+	// A weaker report of C from station a doesn't take it from station b.
+	scanA.Aircraft[1].Lon = 2.2
+	updateAircraft(scanA, &store, "station a")
+	purgeAircraft(scanA, &store, maxAge)
+	if got, want := store.aircraft["c"].aircraft.StationName, "station b"; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+
+	// We expect each station's purge to leave the other's aircraft alone.
+	if got, want := len(store.aircraft), 3; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+}
+
+func TestAircraftPosAge(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+
+	scan := Scan{Now: 1570083881.0, Aircraft: []Aircraft{
+		{Hex: "a", Flight: "A", Lat: 1, Lon: 2, Seen: 0.5, SeenPos: 2.5},
+		{Hex: "b", Flight: "B", Lat: 1, Lon: 2, Seen: 1.5},
+	}}
+	updateAircraft(scan, &store, "dummy station")
+
+	// Three seconds after the scan.
+	now := time.Unix(1570083884, 0)
+
+	testCases := []struct {
+		hex  string
+		want float64
+	}{
+		{hex: "a", want: 5.5},
+		{hex: "b", want: 4.5},
+	}
+
+	for _, tc := range testCases {
+		if got := store.aircraft[tc.hex].age(now); math.Abs(got-tc.want) > 0.001 {
+			t.Errorf("%s: %v != %v", tc.hex, got, tc.want)
+		}
+	}
+
+	// Without a scan time the age at the time of the scan is used.
+	pos := AircraftPos{aircraft: Aircraft{SeenPos: 2.5}}
+	if got, want := pos.age(now), 2.5; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+}
+
+func TestStoreRange(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	store.aircraft["A"] = AircraftPos{aircraft: Aircraft{Hex: "a", Flight: "A"}}
+	store.aircraft["B"] = AircraftPos{aircraft: Aircraft{Hex: "b", Flight: "B"}}
+	store.aircraft["C"] = AircraftPos{aircraft: Aircraft{Hex: "c", Flight: "C"}}
+
+	t.Run("full", func(t *testing.T) {
+		seen := map[string]bool{}
+		store.Range(func(key string, pos AircraftPos) bool {
+			if key != pos.aircraft.Flight {
+				t.Errorf("%s != %s", key, pos.aircraft.Flight)
+			}
+			seen[key] = true
+			return true
+		})
+
+		if got, want := len(seen), 3; got != want {
+			t.Errorf("%d != %d", got, want)
+		}
+	})
+
+	t.Run("early", func(t *testing.T) {
+		calls := 0
+		store.Range(func(key string, pos AircraftPos) bool {
+			calls++
+			return calls < 2
+		})
+
+		if got, want := calls, 2; got != want {
+			t.Errorf("%d != %d", got, want)
+		}
+	})
+}
+
+func TestUpdateAircraftDropped(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+
+	noPosition := counterValue(droppedAircraft, dropNoPosition)
+	noHex := counterValue(droppedAircraft, dropNoHex)
+
+	scan := Scan{Aircraft: []Aircraft{
+		{Hex: "a", Flight: "A", Lat: 1, Lon: 2},
+		{Hex: "b", Flight: "B"},
+		{Hex: "c", Flight: "C", Lat: 1},
+		{Flight: "D", Lat: 1, Lon: 2},
+		{Hex: "e", Lat: 1, Lon: 2},
+	}}
+
+	updateAircraft(scan, &store, "dummy station")
+
+	if got, want := counterValue(droppedAircraft, dropNoPosition)-noPosition, int64(1); got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+
+	if got, want := counterValue(droppedAircraft, dropNoHex)-noHex, int64(1); got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+
+	// We expect an aircraft on the prime meridian to have a position.
+	if _, ok := store.aircraft["c"]; !ok {
+		t.Errorf("aircraft on the prime meridian not stored")
+	}
+
+	// We expect aircraft without a callsign to be stored against their hex code.
+	if _, ok := store.aircraft["e"]; !ok {
+		t.Errorf("aircraft without a callsign not stored")
+	}
+}
+
+func TestUpdateAircraftMinMessages(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex), minMessages: 10}
+
+	a1 := Aircraft{Hex: "a", Flight: "A", Lat: 1, Lon: 2, Messages: 9}
+	a2 := Aircraft{Hex: "b", Flight: "B", Lat: 1, Lon: 2, Messages: 10}
+	a3 := Aircraft{Hex: "c", Flight: "C", Lat: 1, Lon: 2, Messages: 11}
+
+	updateAircraft(Scan{Aircraft: []Aircraft{a1, a2, a3}}, &store, "dummy station")
+
+	// We expect the aircraft below the threshold to be ignored.
+	if _, ok := store.aircraft[a1.Hex]; ok {
+		t.Errorf("expected %s to be ignored", a1.Flight)
+	}
+
+	// We expect aircraft at or above the threshold to be stored.
+	for _, a := range []Aircraft{a2, a3} {
+		if _, ok := store.aircraft[a.Hex]; !ok {
+			t.Errorf("expected %s to be stored", a.Flight)
+		}
+	}
+
+	// Once heard enough, the aircraft below the threshold is stored.
+	a1.Messages = 10
+	updateAircraft(Scan{Aircraft: []Aircraft{a1}}, &store, "dummy station")
+	if _, ok := store.aircraft[a1.Hex]; !ok {
+		t.Errorf("expected %s to be stored", a1.Flight)
+	}
+}
+
+func TestUpdateAircraftAccuracy(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex), minNacP: 8, minNic: 7}
+
+	high := Aircraft{Hex: "a", Flight: "A", Lat: 1, Lon: 2, NacP: 9, Nic: 8}
+	lowNacP := Aircraft{Hex: "b", Flight: "B", Lat: 1, Lon: 2, NacP: 4, Nic: 8}
+	lowNic := Aircraft{Hex: "c", Flight: "C", Lat: 1, Lon: 2, NacP: 9, Nic: 2}
+
+	updateAircraft(Scan{Aircraft: []Aircraft{high, lowNacP, lowNic}}, &store, "dummy station")
+
+	// We expect only the high accuracy position to be stored.
+	if got, want := len(store.aircraft), 1; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+	if _, ok := store.aircraft[high.Hex]; !ok {
+		t.Errorf("expected %s to be stored", high.Flight)
+	}
+
+	// A subsequent low accuracy position is ignored, but the aircraft keeps
+	// its last trusted position.
+	moved := high
+	moved.Lat = 5
+	moved.NacP = 2
+	updateAircraft(Scan{Aircraft: []Aircraft{moved}}, &store, "dummy station")
+	if got, want := store.aircraft[high.Hex].aircraft.Lat, high.Lat; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+}
+
+func TestUpdateAircraftAccuracyNoPosition(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex), minNacP: 8, allowNoPosition: true}
+
+	high := Aircraft{Hex: "a", Flight: "A", Lat: 1, Lon: 2, NacP: 9}
+	updateAircraft(Scan{Aircraft: []Aircraft{high}}, &store, "dummy station")
+
+	// We expect a new aircraft with a low accuracy position to be tracked
+	// without its position.
+	low := Aircraft{Hex: "b", Flight: "B", Lat: 3, Lon: 4, NacP: 4}
+	updateAircraft(Scan{Aircraft: []Aircraft{high, low}}, &store, "dummy station")
+	pos, ok := store.aircraft[low.Hex]
+	if !ok {
+		t.Fatalf("expected %s to be stored", low.Flight)
+	}
+	if pos.aircraft.hasPosition() {
+		t.Errorf("expected %s to be stored without a position: %+v", low.Flight, pos.aircraft)
+	}
+
+	// An aircraft already tracked keeps its last accepted position, while
+	// the rest of the update is stored.
+	moved := high
+	moved.Lat = 5
+	moved.NacP = 2
+	moved.Squawk = "7700"
+	updateAircraft(Scan{Aircraft: []Aircraft{moved, low}}, &store, "dummy station")
+	pos = store.aircraft[high.Hex]
+	if pos.aircraft.Lat != high.Lat || pos.aircraft.Lon != high.Lon {
+		t.Errorf("%v,%v != %v,%v", pos.aircraft.Lat, pos.aircraft.Lon, high.Lat, high.Lon)
+	}
+	if got, want := pos.aircraft.Squawk, moved.Squawk; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+}
+
+// counterValue returns the current value of the integer held against key
+// in m, or zero if no value has been recorded.
+func counterValue(m *expvar.Map, key string) int64 {
+	v, ok := m.Get(key).(*expvar.Int)
+	if !ok {
+		return 0
+	}
+	return v.Value()
+}
+
+func TestUpdateAircraftNoPosition(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	a := Aircraft{Hex: "abc123", Flight: "A", Squawk: "1200"}
+
+	// By default aircraft without a position are not stored.
+	updateAircraft(Scan{Aircraft: []Aircraft{a}}, &store, "dummy station")
+	if got, want := len(store.aircraft), 0; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+
+	store.allowNoPosition = true
+	updateAircraft(Scan{Aircraft: []Aircraft{a}}, &store, "dummy station")
+	pos, ok := store.aircraft[a.Hex]
+	if !ok {
+		t.Fatalf("expected %s to be stored", a.Hex)
+	}
+
+	// Once published, an unchanged aircraft isn't modified by a later scan.
+	pos.modified = false
+	store.aircraft[a.Hex] = pos
+	updateAircraft(Scan{Aircraft: []Aircraft{a}}, &store, "dummy station")
+	if store.aircraft[a.Hex].modified {
+		t.Error("expected unchanged aircraft not to be modified")
+	}
+
+	// A change of squawk is stored and marked for publishing.
+	a.Squawk = "7700"
+	updateAircraft(Scan{Aircraft: []Aircraft{a}}, &store, "dummy station")
+	pos = store.aircraft[a.Hex]
+	if !pos.modified || pos.aircraft.Squawk != a.Squawk {
+		t.Errorf("expected squawk update to be stored, got %+v", pos)
+	}
+
+	// We expect the published message to omit the position.
+	body, err := marshalMessage(newMessage(pos, time.Now()), keyCaseDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := map[string]interface{}{}
+	err = json.Unmarshal(body, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"lat", "lon"} {
+		if _, ok := m[k]; ok {
+			t.Errorf("expected %q to be omitted from %s", k, body)
+		}
+	}
+}
+
+func TestUpdateAircraftIdentityChanges(t *testing.T) {
+	tcs := []struct {
+		name            string
+		identityChanges bool
+		want            bool
+	}{
+		{name: "position only", identityChanges: false, want: false},
+		{name: "identity changes", identityChanges: true, want: true},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex), identityChanges: tc.identityChanges}
+			a := Aircraft{Hex: "abc123", Flight: "A", Lat: 51.47, Lon: -0.45, Squawk: "1200"}
+
+			updateAircraft(Scan{Aircraft: []Aircraft{a}}, &store, "dummy station")
+			pos := store.aircraft[a.Hex]
+			pos.modified = false
+			store.aircraft[a.Hex] = pos
+
+			// A stationary aircraft starts squawking 7700.
+			a.Squawk = "7700"
+			a.Emergency = "general"
+			updateAircraft(Scan{Aircraft: []Aircraft{a}}, &store, "dummy station")
+
+			pos = store.aircraft[a.Hex]
+			if got := pos.modified; got != tc.want {
+				t.Errorf("%t != %t", got, tc.want)
+			}
+			if got := pos.aircraft.Squawk == "7700"; got != tc.want {
+				t.Errorf("unexpected squawk %q", pos.aircraft.Squawk)
+			}
+		})
+	}
+}
+
+func TestUpdateAircraftPositionStaleness(t *testing.T) {
+	fresh := Aircraft{Hex: "a1", Flight: "FRESH", Lat: 51.47, Lon: -0.45, SeenPos: 2}
+	stale := Aircraft{Hex: "a2", Flight: "STALE", Lat: 51.48, Lon: -0.46, SeenPos: 45}
+
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex), maxPositionStaleness: time.Second * 30}
+	updateAircraft(Scan{Aircraft: []Aircraft{fresh, stale}}, &store, "dummy station")
+
+	if _, ok := store.aircraft[fresh.Hex]; !ok {
+		t.Errorf("expected %s to be stored", fresh.Hex)
+	}
+	if _, ok := store.aircraft[stale.Hex]; ok {
+		t.Errorf("expected %s to be dropped", stale.Hex)
+	}
+
+	// With aircraft without a position allowed, we expect the stale
+	// position to be removed and the identity kept.
+	store = Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex), maxPositionStaleness: time.Second * 30, allowNoPosition: true}
+	updateAircraft(Scan{Aircraft: []Aircraft{fresh, stale}}, &store, "dummy station")
+
+	if pos := store.aircraft[fresh.Hex]; pos.aircraft.Lat != fresh.Lat || pos.aircraft.Lon != fresh.Lon {
+		t.Errorf("expected position of %s to be kept, got %+v", fresh.Hex, pos.aircraft)
+	}
+	pos, ok := store.aircraft[stale.Hex]
+	if !ok {
+		t.Fatalf("expected %s to be stored", stale.Hex)
+	}
+	if pos.aircraft.hasPosition() || pos.aircraft.Flight != stale.Flight {
+		t.Errorf("expected position of %s to be removed, got %+v", stale.Hex, pos.aircraft)
+	}
+}
+
+func TestApplyScanTeleport(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex), rejectTeleportFraction: 0.5}
+	maxAge := time.Minute
+
+	scan := func(now, offset float64) Scan {
+		s := Scan{Now: now, source: "dummy source"}
+		for i := 0; i < 6; i++ {
+			s.Aircraft = append(s.Aircraft, Aircraft{
+				Hex:     fmt.Sprintf("a%d", i),
+				Flight:  fmt.Sprintf("F%d", i),
+				Lat:     51 + float64(i)*0.1 + offset,
+				Lon:     -0.45,
+				SeenPos: 0.5,
+			})
+		}
+		return s
+	}
+
+	// Good scans, in which aircraft move plausibly, are applied.
+	rejected := scansRejected.Value()
+	applyScan(scan(100, 0), &store, "dummy station", maxAge)
+	applyScan(scan(101, 0.001), &store, "dummy station", maxAge)
+	if got := scansRejected.Value() - rejected; got != 0 {
+		t.Fatalf("%d scans rejected", got)
+	}
+	if got, want := store.aircraft["a0"].aircraft.Lat, 51.001; got != want {
+		t.Fatalf("%v != %v", got, want)
+	}
+
+	// A scan in which every aircraft jumps hundreds of miles in a second
+	// is rejected, leaving the store unchanged.
+	corrupt := scan(102, 10)
+	corrupt.Aircraft = corrupt.Aircraft[:5]
+	applyScan(corrupt, &store, "dummy station", maxAge)
+	if got := scansRejected.Value() - rejected; got != 1 {
+		t.Errorf("%d != 1 scans rejected", got)
+	}
+	if got, want := store.aircraft["a0"].aircraft.Lat, 51.001; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+	if got, want := len(store.aircraft), 6; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+
+	// Good scans continue to be applied after a rejected scan.
+	applyScan(scan(103, 0.002), &store, "dummy station", maxAge)
+	if got, want := store.aircraft["a0"].aircraft.Lat, 51.002; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+}
+
+func TestPurgeAircraftMissingGrace(t *testing.T) {
+	maxAge := time.Second * 60
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex), missingGrace: time.Second * 10}
+
+	a1 := Aircraft{Hex: "a", Flight: "A", Seen: 1}
+	a2 := Aircraft{Hex: "b", Flight: "B", Seen: 1}
+	store.aircraft[a1.Hex] = AircraftPos{aircraft: a1}
+	store.aircraft[a2.Hex] = AircraftPos{aircraft: a2}
+
+	// A disappears from the scan but is kept within the grace period.
+	purgeAircraft(Scan{Now: 100, Aircraft: []Aircraft{a2}}, &store, maxAge)
+	purgeAircraft(Scan{Now: 105, Aircraft: []Aircraft{a2}}, &store, maxAge)
+	if _, ok := store.aircraft[a1.Hex]; !ok {
+		t.Fatalf("expected %s to be kept", a1.Flight)
+	}
+
+	// Reappearing resets the grace period.
+	purgeAircraft(Scan{Now: 106, Aircraft: []Aircraft{a1, a2}}, &store, maxAge)
+	purgeAircraft(Scan{Now: 112, Aircraft: []Aircraft{a2}}, &store, maxAge)
+	if _, ok := store.aircraft[a1.Hex]; !ok {
+		t.Fatalf("expected %s to be kept", a1.Flight)
+	}
+
+	// Once missing for longer than the grace period it is removed.
+	purgeAircraft(Scan{Now: 122, Aircraft: []Aircraft{a2}}, &store, maxAge)
+	if _, ok := store.aircraft[a1.Hex]; ok {
+		t.Errorf("expected %s to be purged", a1.Flight)
+	}
+
+	// Aircraft present in the scan are still removed once older than
+	// maxAge, regardless of the grace period.
+	a2.Seen = 90
+	store.aircraft[a2.Hex] = AircraftPos{aircraft: a2}
+	purgeAircraft(Scan{Now: 123, Aircraft: []Aircraft{a2}}, &store, maxAge)
+	if _, ok := store.aircraft[a2.Hex]; ok {
+		t.Errorf("expected %s to be purged", a2.Flight)
+	}
+}
+
+func TestStoreDiff(t *testing.T) {
+	a := Aircraft{Hex: "a", Flight: "A", Lat: 1, Lon: 1}
+	b := Aircraft{Hex: "b", Flight: "B", Lat: 2, Lon: 2}
+	bMoved := Aircraft{Hex: "b", Flight: "B", Lat: 2.5, Lon: 2}
+	bWeak := Aircraft{Hex: "b", Flight: "B", Lat: 2.5, Lon: 2, Rssi: -30}
+	c := Aircraft{Hex: "c", Flight: "C", Lat: 3, Lon: 3}
+	noPos := Aircraft{Hex: "d", Flight: "D"}
+
+	testCases := []struct {
+		name    string
+		store   map[string]AircraftPos
+		grace   time.Duration
+		scan    Scan
+		added   []string
+		updated []string
+		removed []string
+	}{
+		{
+			name:  "empty store",
+			store: map[string]AircraftPos{},
+			scan:  Scan{Aircraft: []Aircraft{a, b}},
+			added: []string{"A", "B"},
+		},
+		{
+			name:  "unchanged",
+			store: map[string]AircraftPos{"a": {aircraft: a}, "b": {aircraft: b}},
+			scan:  Scan{Aircraft: []Aircraft{a, b}},
+		},
+		{
+			name:    "moved",
+			store:   map[string]AircraftPos{"a": {aircraft: a}, "b": {aircraft: b}},
+			scan:    Scan{Aircraft: []Aircraft{a, bMoved}},
+			updated: []string{"B"},
+		},
+		{
+			name:    "removed",
+			store:   map[string]AircraftPos{"a": {aircraft: a}, "b": {aircraft: b}, "c": {aircraft: c}},
+			scan:    Scan{Aircraft: []Aircraft{a}},
+			removed: []string{"b", "c"},
+		},
+		{
+			name:  "dropped",
+			store: map[string]AircraftPos{},
+			scan:  Scan{Aircraft: []Aircraft{noPos, {Lat: 1, Lon: 1}}},
+		},
+		{
+			name:  "trimmed callsign",
+			store: map[string]AircraftPos{"a": {aircraft: a}},
+			scan:  Scan{Aircraft: []Aircraft{{Hex: "a", Flight: "A    ", Lat: 1, Lon: 1}}},
+		},
+		{
+			name:  "stronger signal from another source",
+			store: map[string]AircraftPos{"b": {aircraft: Aircraft{Hex: "b", Flight: "B", Lat: 2, Lon: 2, Rssi: -10}, source: "other"}},
+			scan:  Scan{source: "this", Aircraft: []Aircraft{bWeak}},
+		},
+		{
+			name:  "other source not removed",
+			store: map[string]AircraftPos{"c": {aircraft: c, source: "other"}},
+			scan:  Scan{source: "this"},
+		},
+		{
+			name:  "within grace period",
+			store: map[string]AircraftPos{"c": {aircraft: c, missing: 100}},
+			grace: time.Second * 10,
+			scan:  Scan{Now: 105},
+		},
+		{
+			name:    "beyond grace period",
+			store:   map[string]AircraftPos{"c": {aircraft: c, missing: 100}},
+			grace:   time.Second * 10,
+			scan:    Scan{Now: 110},
+			removed: []string{"c"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store := Store{aircraft: tc.store, lock: new(sync.RWMutex), missingGrace: tc.grace}
+			before := len(store.aircraft)
+
+			d := store.Diff(tc.scan)
+
+			if got := flights(d.Added); fmt.Sprint(got) != fmt.Sprint(tc.added) {
+				t.Errorf("added: %v != %v", got, tc.added)
+			}
+			if got := flights(d.Updated); fmt.Sprint(got) != fmt.Sprint(tc.updated) {
+				t.Errorf("updated: %v != %v", got, tc.updated)
+			}
+			if fmt.Sprint(d.Removed) != fmt.Sprint(tc.removed) {
+				t.Errorf("removed: %v != %v", d.Removed, tc.removed)
+			}
+
+			// We expect the data Store to be left unchanged.
+			if got := len(store.aircraft); got != before {
+				t.Errorf("%d != %d", got, before)
+			}
+		})
+	}
+}
+
+// flights returns the callsigns of the aircraft in as, or nil if empty.
+func flights(as []Aircraft) []string {
+	var fs []string
+	for _, a := range as {
+		fs = append(fs, a.Flight)
+	}
+	return fs
+}
+
+func TestUpdateAircraftDedupeMlat(t *testing.T) {
+	b := []byte(`{"now": 1, "aircraft": [
+		{"hex": "abc123", "flight": "A", "lat": 1, "lon": 1, "mlat": []},
+		{"hex": "abc123", "flight": "A", "lat": 5, "lon": 5, "mlat": ["lat", "lon", "track"]},
+		{"hex": "def456", "flight": "B", "lat": 2, "lon": 2, "mlat": ["lat", "lon"]}
+	]}`)
+
+	scan := Scan{}
+	err := json.Unmarshal(b, &scan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if scan.Aircraft[0].isMlat() || !scan.Aircraft[1].isMlat() {
+		t.Fatalf("unexpected decode of mlat fields: %+v", scan.Aircraft)
+	}
+
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex), dedupeMlat: true}
+	updateAircraft(scan, &store, "dummy station")
+
+	// We expect the broadcast record to win over the MLAT record for the
+	// same hex, and MLAT records without a duplicate to be kept.
+	if got, want := store.aircraft["abc123"].aircraft.Lat, 1.0; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+	if _, ok := store.aircraft["def456"]; !ok {
+		t.Error("expected def456 to be stored")
+	}
+
+	// The list of MLAT fields is encoded as an array.
+	out, err := json.Marshal(scan.Aircraft[1].Mlat)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(out), `["lat","lon","track"]`; got != want {
+		t.Errorf("%s != %s", got, want)
+	}
+}
+
+func TestUpdateAircraftDuplicateCallsigns(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+
+	// Two aircraft broadcasting the same callsign.
+	a1 := Aircraft{Hex: "abc123", Flight: "BAW1   ", Lat: 1, Lon: 1}
+	a2 := Aircraft{Hex: "def456", Flight: "BAW1   ", Lat: 2, Lon: 2}
+	scan := Scan{Now: 1, Aircraft: []Aircraft{a1, a2}}
+
+	updateAircraft(scan, &store, "dummy station")
+	purgeAircraft(scan, &store, time.Minute)
+
+	// We expect both to be tracked separately.
+	if got, want := len(store.aircraft), 2; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+	for _, a := range []Aircraft{a1, a2} {
+		pos, ok := store.aircraft[a.Hex]
+		if !ok {
+			t.Fatalf("expected %s to be stored", a.Hex)
+		}
+		if pos.aircraft.Lat != a.Lat {
+			t.Errorf("%s: %v != %v", a.Hex, pos.aircraft.Lat, a.Lat)
+		}
+	}
+
+	// We expect both to be published distinctly.
+	pub := &fakePublisher{}
+	u := updater{store: &store, pub: pub}
+	u.publishUpdates(time.Now())
+
+	hexes := map[string]bool{}
+	for _, b := range pub.bodies {
+		m := aircraft{}
+		err := json.Unmarshal(b, &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Flight != "BAW1" {
+			t.Errorf("%q != %q", m.Flight, "BAW1")
+		}
+		hexes[m.Hex] = true
+	}
+	if !hexes[a1.Hex] || !hexes[a2.Hex] || len(pub.bodies) != 2 {
+		t.Errorf("expected one message for each of %s and %s, got %d", a1.Hex, a2.Hex, len(pub.bodies))
+	}
+
+	// A change of callsign updates the aircraft held against its hex.
+	a1.Flight = "BAW2"
+	updateAircraft(Scan{Now: 2, Aircraft: []Aircraft{a1, a2}}, &store, "dummy station")
+	if got, want := store.aircraft[a1.Hex].aircraft.Flight, "BAW2"; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+}
+
+func TestStoreReplaceAll(t *testing.T) {
+	// snapshot returns a complete state in which every aircraft has the
+	// same callsign.
+	snapshot := func(flight string) map[string]AircraftPos {
+		m := make(map[string]AircraftPos)
+		for i := 0; i < 50; i++ {
+			a := Aircraft{Hex: fmt.Sprintf("a%02d", i), Flight: flight}
+			m[a.key()] = AircraftPos{aircraft: a}
+		}
+		return m
+	}
+
+	store := Store{aircraft: snapshot("OLD"), lock: new(sync.RWMutex)}
+
+	done := make(chan struct{})
+	wg := sync.WaitGroup{}
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				// We expect readers to see a complete state, never a mix.
+				seen := map[string]int{}
+				store.Range(func(key string, pos AircraftPos) bool {
+					seen[pos.aircraft.Flight]++
+					return true
+				})
+				if len(seen) != 1 || (seen["OLD"] != 50 && seen["NEW"] != 50) {
+					t.Errorf("partial state: %v", seen)
+					return
+				}
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		flight := "NEW"
+		if i%2 == 1 {
+			flight = "OLD"
+		}
+		store.ReplaceAll(snapshot(flight))
+	}
+	close(done)
+	wg.Wait()
+
+	store.ReplaceAll(nil)
+	if store.aircraft == nil || len(store.aircraft) != 0 {
+		t.Errorf("expected an empty store, got %v", store.aircraft)
+	}
+}
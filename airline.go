@@ -0,0 +1,87 @@
+package main
+
+import "strings"
+
+// defaultAirlines maps the ICAO designators of common airlines to their
+// names.
+var defaultAirlines = map[string]string{
+	"AAL": "American Airlines",
+	"ACA": "Air Canada",
+	"AFR": "Air France",
+	"AIC": "Air India",
+	"ANA": "All Nippon Airways",
+	"ASA": "Alaska Airlines",
+	"AUA": "Austrian Airlines",
+	"AZA": "Alitalia",
+	"BAW": "British Airways",
+	"BEL": "Brussels Airlines",
+	"CCA": "Air China",
+	"CPA": "Cathay Pacific",
+	"DAL": "Delta Air Lines",
+	"DLH": "Lufthansa",
+	"EIN": "Aer Lingus",
+	"EJU": "easyJet Europe",
+	"ETD": "Etihad Airways",
+	"EXS": "Jet2",
+	"EZY": "easyJet",
+	"FDX": "FedEx",
+	"FIN": "Finnair",
+	"IBE": "Iberia",
+	"JAL": "Japan Airlines",
+	"JBU": "JetBlue",
+	"KAL": "Korean Air",
+	"KLM": "KLM",
+	"LOT": "LOT Polish Airlines",
+	"NAX": "Norwegian Air Shuttle",
+	"QFA": "Qantas",
+	"QTR": "Qatar Airways",
+	"RYR": "Ryanair",
+	"SAS": "Scandinavian Airlines",
+	"SIA": "Singapore Airlines",
+	"SWA": "Southwest Airlines",
+	"SWR": "Swiss",
+	"TAP": "TAP Air Portugal",
+	"THY": "Turkish Airlines",
+	"TOM": "TUI Airways",
+	"UAE": "Emirates",
+	"UAL": "United Airlines",
+	"UPS": "UPS Airlines",
+	"VIR": "Virgin Atlantic",
+	"VLG": "Vueling",
+	"WZZ": "Wizz Air",
+}
+
+// airlineLookup maps ICAO airline designators to airline names.
+type airlineLookup map[string]string
+
+// newAirlineLookup returns a lookup of the default airlines along with
+// those in overrides, which take precedence. Designators are case
+// insensitive.
+func newAirlineLookup(overrides map[string]string) airlineLookup {
+	l := make(airlineLookup, len(defaultAirlines)+len(overrides))
+	for k, v := range defaultAirlines {
+		l[k] = v
+	}
+	for k, v := range overrides {
+		l[strings.ToUpper(k)] = v
+	}
+	return l
+}
+
+// lookup returns the name of the airline operating the flight with the
+// given callsign, or an empty string if it isn't known. Airline callsigns
+// are a three letter designator followed by a flight number starting with
+// a digit, e.g. BAW123, so registrations used as callsigns by general
+// aviation, such as GABCD or N123AB, are never matched.
+func (l airlineLookup) lookup(callsign string) string {
+	c := strings.ToUpper(strings.TrimSpace(callsign))
+	if len(c) < 4 || c[3] < '0' || c[3] > '9' {
+		return ""
+	}
+	for i := 0; i < 3; i++ {
+		if c[i] < 'A' || c[i] > 'Z' {
+			return ""
+		}
+	}
+	return l[c[:3]]
+}
@@ -0,0 +1,29 @@
+package main
+
+import "testing"
+
+func TestAirlineLookup(t *testing.T) {
+	l := newAirlineLookup(map[string]string{"xyz": "Example Air", "EXS": "Jet2.com"})
+
+	tcs := []struct {
+		callsign string
+		want     string
+	}{
+		{callsign: "BAW123", want: "British Airways"},
+		{callsign: "DLH4AB", want: "Lufthansa"},
+		{callsign: "ual1  ", want: "United Airlines"},
+		{callsign: "XYZ12", want: "Example Air"},
+		{callsign: "EXS7", want: "Jet2.com"},
+		{callsign: "ZZZ123", want: ""},
+		{callsign: "GABCD", want: ""},
+		{callsign: "N123AB", want: ""},
+		{callsign: "BAW", want: ""},
+		{callsign: "", want: ""},
+	}
+
+	for _, tc := range tcs {
+		if got := l.lookup(tc.callsign); got != tc.want {
+			t.Errorf("%q: %q != %q", tc.callsign, got, tc.want)
+		}
+	}
+}
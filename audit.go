@@ -0,0 +1,135 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// auditLog appends published messages to a local file, each on its own
+// line prefixed by the time it was published. Once the file grows beyond
+// maxBytes it is moved aside, replacing any file previously moved aside,
+// so that at most twice maxBytes of disk is used.
+type auditLog struct {
+	lock     sync.Mutex
+	path     string
+	maxBytes int64
+	f        *os.File
+	size     int64 // bytes written to f, including any it held when opened
+	errLog   errorLimiter
+}
+
+// openAuditLog opens the audit log at path for appending, creating it if
+// it doesn't exist.
+func openAuditLog(path string, maxBytes int64) (*auditLog, error) {
+	l := &auditLog{path: path, maxBytes: maxBytes, errLog: errorLimiter{w: os.Stderr}}
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// open opens the file at the audit log's path for appending.
+func (l *auditLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open audit log: %w", err)
+	}
+
+	l.f, l.size = f, info.Size()
+	return nil
+}
+
+// write appends body to the audit log, prefixed by now, rotating the log
+// first if it has grown too large.
+func (l *auditLog) write(body []byte, now time.Time) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.maxBytes > 0 && l.size >= l.maxBytes {
+		err := l.rotate()
+		if err != nil {
+			return err
+		}
+	}
+
+	line := append([]byte(now.UTC().Format(time.RFC3339Nano)+" "), body...)
+	n, err := l.f.Write(append(line, '\n'))
+	l.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("failed to write audit log: %w", err)
+	}
+	return nil
+}
+
+// rotate moves the audit log aside, to its path with a .1 suffix, and
+// opens a new one in its place.
+func (l *auditLog) rotate() error {
+	l.f.Close()
+	err := os.Rename(l.path, l.path+".1")
+	if err != nil {
+		return fmt.Errorf("failed to rotate audit log: %w", err)
+	}
+	return l.open()
+}
+
+// Close closes the audit log.
+func (l *auditLog) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.f.Close()
+}
+
+// wrap returns a Publisher that sends messages to p and records those it
+// accepts in the audit log. Failures to write the audit log are reported
+// but never returned, so that they don't affect publishing.
+func (l *auditLog) wrap(p Publisher) Publisher {
+	return &auditPublisher{pub: p, audit: l}
+}
+
+// auditPublisher records the messages accepted by a Publisher in an audit
+// log.
+type auditPublisher struct {
+	pub   Publisher
+	audit *auditLog
+}
+
+func (p *auditPublisher) Publish(routingKey string, body []byte) error {
+	err := p.pub.Publish(routingKey, body)
+	if err != nil {
+		return err
+	}
+
+	p.record(body)
+	return nil
+}
+
+// publishBatch sends msgs to the Publisher as a batch, recording those it
+// accepts.
+func (p *auditPublisher) publishBatch(msgs []pendingMessage) []error {
+	errs := publishBatch(p.pub, msgs)
+	for i, err := range errs {
+		if err == nil {
+			p.record(msgs[i].body)
+		}
+	}
+	return errs
+}
+
+// record writes body to the audit log, reporting any failure.
+func (p *auditPublisher) record(body []byte) {
+	err := p.audit.write(body, time.Now())
+	if err != nil {
+		p.audit.lock.Lock()
+		p.audit.errLog.print(err)
+		p.audit.lock.Unlock()
+	}
+}
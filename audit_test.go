@@ -0,0 +1,104 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAuditPublisher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	audit, err := openAuditLog(path, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	primary := &fakePublisher{}
+	pub := audit.wrap(primary)
+
+	for _, body := range []string{`{"flight":"A"}`, `{"flight":"B"}`} {
+		err = pub.Publish(keyAircraft, []byte(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// We expect messages rejected by the primary sink not to be recorded.
+	primary.err = errors.New("publish failed")
+	err = pub.Publish(keyAircraft, []byte(`{"flight":"C"}`))
+	if err == nil {
+		t.Error("expected the primary sink's error")
+	}
+
+	if got, want := len(primary.bodies), 2; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(string(b)), "\n")
+	if got, want := len(lines), 2; got != want {
+		t.Fatalf("%d != %d: %q", got, want, b)
+	}
+
+	for i, want := range []string{`{"flight":"A"}`, `{"flight":"B"}`} {
+		parts := strings.SplitN(lines[i], " ", 2)
+		if len(parts) != 2 || parts[1] != want {
+			t.Errorf("%q != %q", lines[i], want)
+			continue
+		}
+		if _, err := time.Parse(time.RFC3339Nano, parts[0]); err != nil {
+			t.Errorf("expected a timestamp prefix: %v", err)
+		}
+	}
+}
+
+func TestAuditLogRotate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "audit.log")
+	audit, err := openAuditLog(path, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer audit.Close()
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 5; i++ {
+		err = audit.write([]byte(`{"flight":"DUMMY"}`), now)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Each line is 40 bytes, so we expect the log to rotate every two lines.
+	for _, tc := range []struct {
+		path  string
+		lines int
+	}{{path, 1}, {path + ".1", 2}} {
+		b, err := ioutil.ReadFile(tc.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := strings.Count(string(b), "\n"); got != tc.lines {
+			t.Errorf("%s: %d != %d", tc.path, got, tc.lines)
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"errors"
+	"expvar"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// States reported by the publish_breaker metric.
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// errBreakerOpen is returned for messages skipped while the circuit breaker
+// is open.
+var errBreakerOpen = errors.New("circuit breaker open")
+
+// breakerState reports the state of the circuit breaker around the
+// publisher.
+var breakerState = expvar.NewString("publish_breaker")
+
+// breaker is a circuit breaker around one or more Publishers. After
+// threshold consecutive failures it opens, skipping publishes for the
+// coolDown period. Once the period has elapsed a single publish is
+// attempted, which closes the breaker if it succeeds or reopens it if not.
+// It is safe for concurrent use.
+type breaker struct {
+	threshold int
+	coolDown  time.Duration
+	clock     func() time.Time // returns the current time, defaults to time.Now
+
+	lock     sync.Mutex
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+// wrap returns a Publisher that publishes to pub through the breaker.
+func (b *breaker) wrap(pub Publisher) Publisher {
+	return breakerPublisher{b: b, pub: pub}
+}
+
+// breakerPublisher publishes to a Publisher through a circuit breaker.
+type breakerPublisher struct {
+	b   *breaker
+	pub Publisher
+}
+
+// Publish sends body to the underlying Publisher unless the breaker is
+// open, in which case errBreakerOpen is returned.
+func (p breakerPublisher) Publish(routingKey string, body []byte) error {
+	return p.b.publish(p.pub, routingKey, body)
+}
+
+// publishBatch sends msgs to the underlying Publisher as a batch unless
+// the breaker is open.
+func (p breakerPublisher) publishBatch(msgs []pendingMessage) []error {
+	return p.b.publishBatch(p.pub, msgs)
+}
+
+// publish sends body to pub unless the breaker is open, or is half open
+// with a publish already in progress, in which case errBreakerOpen is
+// returned.
+func (b *breaker) publish(pub Publisher, routingKey string, body []byte) error {
+	now := time.Now()
+	if b.clock != nil {
+		now = b.clock()
+	}
+
+	b.lock.Lock()
+	switch {
+	case b.state == breakerHalfOpen:
+		b.lock.Unlock()
+		return errBreakerOpen
+	case b.state == breakerOpen && now.Sub(b.openedAt) < b.coolDown:
+		b.lock.Unlock()
+		return errBreakerOpen
+	case b.state == breakerOpen:
+		b.setState(breakerHalfOpen)
+	}
+	b.lock.Unlock()
+
+	err := pub.Publish(routingKey, body)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	b.record(err, now)
+	return err
+}
+
+// publishBatch sends msgs to pub unless the breaker is open. Once the cool
+// down has elapsed the first message is published alone, and the rest only
+// if it succeeds. While the breaker is closed the messages are published
+// in chunks no larger than the failures left before it opens, so that it
+// opens after the same message as if they were published in turn, and the
+// rest aren't attempted.
+func (b *breaker) publishBatch(pub Publisher, msgs []pendingMessage) []error {
+	errs := make([]error, len(msgs))
+	if len(msgs) == 0 {
+		return errs
+	}
+
+	b.lock.Lock()
+	closed := b.state != breakerOpen && b.state != breakerHalfOpen
+	b.lock.Unlock()
+
+	rest := msgs
+	if !closed {
+		errs[0] = b.publish(pub, msgs[0].routingKey, msgs[0].body)
+		if errs[0] != nil {
+			for i := range msgs[1:] {
+				errs[i+1] = errBreakerOpen
+			}
+			return errs
+		}
+		rest = msgs[1:]
+	}
+
+	now := time.Now()
+	if b.clock != nil {
+		now = b.clock()
+	}
+
+	for len(rest) > 0 {
+		b.lock.Lock()
+		if b.state == breakerOpen {
+			b.lock.Unlock()
+			for i := range rest {
+				errs[len(msgs)-len(rest)+i] = errBreakerOpen
+			}
+			return errs
+		}
+		n := b.threshold - b.failures
+		b.lock.Unlock()
+
+		if n < 1 {
+			n = 1
+		}
+		if n > len(rest) {
+			n = len(rest)
+		}
+		results := publishBatch(pub, rest[:n])
+
+		b.lock.Lock()
+		for i, err := range results {
+			b.record(err, now)
+			errs[len(msgs)-len(rest)+i] = err
+		}
+		b.lock.Unlock()
+		rest = rest[n:]
+	}
+	return errs
+}
+
+// record updates the breaker with the result of a publish attempted at
+// now. The caller must hold the lock.
+func (b *breaker) record(err error, now time.Time) {
+	if err == nil {
+		b.failures = 0
+		b.setState(breakerClosed)
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		b.openedAt = now
+		b.setState(breakerOpen)
+	}
+}
+
+// setState records a change of state, logging transitions to and from
+// open. The caller must hold the lock.
+func (b *breaker) setState(state string) {
+	if state == b.state {
+		return
+	}
+
+	switch {
+	case state == breakerOpen && b.state != breakerHalfOpen:
+		fmt.Fprintf(os.Stderr, "circuit breaker opened after %d failures, skipping publishes for %v\n", b.failures, b.coolDown)
+	case state == breakerClosed && b.state != "":
+		fmt.Fprintf(os.Stderr, "circuit breaker closed\n")
+	}
+
+	b.state = state
+	breakerState.Set(state)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestBreaker(t *testing.T) {
+	now := time.Now()
+	pub := &fakePublisher{err: errors.New("publish failed")}
+	b := &breaker{threshold: 3, coolDown: time.Minute, clock: func() time.Time { return now }}
+	p := b.wrap(pub)
+
+	// Failures below the threshold are passed through.
+	for i := 0; i < 3; i++ {
+		err := p.Publish(keyAircraft, []byte("{}"))
+		if err != pub.err {
+			t.Fatalf("%v != %v", err, pub.err)
+		}
+	}
+
+	// We expect the breaker to open once the threshold is reached.
+	if got, want := b.state, breakerOpen; got != want {
+		t.Fatalf("%q != %q", got, want)
+	}
+	if got, want := breakerState.Value(), breakerOpen; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+
+	// Publishes are skipped during the cool down, even once the publisher
+	// recovers.
+	pub.err = nil
+	now = now.Add(time.Second * 30)
+	err := p.Publish(keyAircraft, []byte("{}"))
+	if err != errBreakerOpen {
+		t.Fatalf("%v != %v", err, errBreakerOpen)
+	}
+	if got, want := len(pub.bodies), 0; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+
+	// After the cool down a failed probe reopens the breaker.
+	pub.err = errors.New("publish failed")
+	now = now.Add(time.Minute)
+	err = p.Publish(keyAircraft, []byte("{}"))
+	if err != pub.err {
+		t.Fatalf("%v != %v", err, pub.err)
+	}
+	if got, want := b.state, breakerOpen; got != want {
+		t.Fatalf("%q != %q", got, want)
+	}
+	err = p.Publish(keyAircraft, []byte("{}"))
+	if err != errBreakerOpen {
+		t.Fatalf("%v != %v", err, errBreakerOpen)
+	}
+
+	// A successful probe closes it.
+	pub.err = nil
+	now = now.Add(time.Minute)
+	err = p.Publish(keyAircraft, []byte("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := b.state, breakerClosed; got != want {
+		t.Fatalf("%q != %q", got, want)
+	}
+
+	// Once closed, failures are counted afresh.
+	pub.err = errors.New("publish failed")
+	p.Publish(keyAircraft, []byte("{}"))
+	if got, want := b.state, breakerClosed; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+}
+
+func TestBreakerSinks(t *testing.T) {
+	pub := &fakePublisher{err: errors.New("publish failed")}
+	sink := &fakePublisher{}
+	u := updater{opts: publishOptions{
+		breaker: &breaker{threshold: 1, coolDown: time.Minute},
+		sinks:   []Publisher{sink},
+	}}
+	p := u.withSinks(pub)
+
+	for n := 0; n < 3; n++ {
+		p.Publish(keyAircraft, []byte("{}"))
+	}
+
+	// We expect the sinks to be sent every message, though the breaker
+	// around the primary publisher is open.
+	if got, want := u.opts.breaker.state, breakerOpen; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+	if got, want := len(sink.bodies), 3; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+}
+
+func TestBreakerPublishBatch(t *testing.T) {
+	now := time.Now()
+	b := &breaker{threshold: 2, coolDown: time.Minute, clock: func() time.Time { return now }}
+	pub := &fakePublisher{err: errors.New("publish failed")}
+	p := b.wrap(pub)
+
+	msgs := []pendingMessage{{body: []byte("1")}, {body: []byte("2")}, {body: []byte("3")}}
+
+	// Failures in a batch are counted as though published in turn, so the
+	// breaker opens before the last message.
+	errs := publishBatch(p, msgs)
+	for i, want := range []error{pub.err, pub.err, errBreakerOpen} {
+		if errs[i] != want {
+			t.Errorf("%d: %v != %v", i, errs[i], want)
+		}
+	}
+	if got, want := b.state, breakerOpen; got != want {
+		t.Fatalf("%q != %q", got, want)
+	}
+
+	// While open, nothing is published.
+	errs = publishBatch(p, msgs)
+	for i, err := range errs {
+		if !errors.Is(err, errBreakerOpen) {
+			t.Errorf("%d: %v != %v", i, err, errBreakerOpen)
+		}
+	}
+
+	// After the cool down the first message probes the publisher, and
+	// once it succeeds the rest are published.
+	pub.err = nil
+	now = now.Add(time.Minute)
+	errs = publishBatch(p, msgs)
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("%d: unexpected error: %v", i, err)
+		}
+	}
+	if got, want := len(pub.bodies), len(msgs); got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+	if got, want := b.state, breakerClosed; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+}
+
+// failingPublisher accepts the first n messages published to it and fails
+// the rest, counting every attempt.
+type failingPublisher struct {
+	n        int
+	attempts int
+	fakePublisher
+}
+
+func (p *failingPublisher) Publish(routingKey string, body []byte) error {
+	p.attempts++
+	if len(p.bodies) >= p.n {
+		return errors.New("publish failed")
+	}
+	return p.fakePublisher.Publish(routingKey, body)
+}
+
+func TestBreakerPublishBatchPartialFailure(t *testing.T) {
+	b := &breaker{threshold: 2, coolDown: time.Minute}
+	pub := &failingPublisher{n: 2}
+
+	msgs := []pendingMessage{}
+	for i := 0; i < 6; i++ {
+		msgs = append(msgs, pendingMessage{body: []byte("{}")})
+	}
+
+	// The publisher fails from the third message, so we expect the breaker
+	// to open after the fourth and the rest not to be attempted.
+	errs := publishBatch(b.wrap(pub), msgs)
+	for i, err := range errs {
+		switch {
+		case i < 2 && err != nil:
+			t.Errorf("%d: unexpected error: %v", i, err)
+		case i >= 2 && i < 4 && (err == nil || errors.Is(err, errBreakerOpen)):
+			t.Errorf("%d: expected the publish to fail, got %v", i, err)
+		case i >= 4 && !errors.Is(err, errBreakerOpen):
+			t.Errorf("%d: %v != %v", i, err, errBreakerOpen)
+		}
+	}
+	if got, want := pub.attempts, 4; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+	if got, want := b.state, breakerOpen; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+}
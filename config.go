@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+
+	"github.com/spf13/viper"
+)
+
+// envRef matches ${VAR} references to environment variables.
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// readConfig reads the configuration file, expanding references to
+// environment variables. References to unset variables are an error if
+// strictEnv is set in the configuration file.
+func readConfig() error {
+	err := viper.ReadInConfig()
+	if err != nil {
+		return err
+	}
+
+	b, err := ioutil.ReadFile(viper.ConfigFileUsed())
+	if err != nil {
+		return err
+	}
+
+	expanded, err := expandEnv(b, viper.GetBool("strictEnv"))
+	if err != nil {
+		return fmt.Errorf("failed to expand %s: %w", viper.ConfigFileUsed(), err)
+	}
+
+	return viper.ReadConfig(bytes.NewReader(expanded))
+}
+
+// expandEnv replaces ${VAR} references in the configuration with the value
+// of the environment variable. Unset variables are replaced with an empty
+// string, or reported as an error if strict is true. Other uses of $ are
+// left untouched so they may appear in values such as passwords.
+func expandEnv(config []byte, strict bool) ([]byte, error) {
+	var missing []string
+
+	expanded := envRef.ReplaceAllFunc(config, func(ref []byte) []byte {
+		name := string(envRef.FindSubmatch(ref)[1])
+		v, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+		return []byte(v)
+	})
+
+	if strict && len(missing) > 0 {
+		return nil, fmt.Errorf("environment variables not set: %v", missing)
+	}
+
+	return expanded, nil
+}
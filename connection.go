@@ -0,0 +1,285 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// Delays between attempts to reconnect to RabbitMQ. The delay doubles
+// after each failed attempt, up to the maximum.
+var (
+	reconnectDelay    = time.Second
+	maxReconnectDelay = time.Second * 30
+)
+
+// brokerReconnects counts the times the connection to RabbitMQ was
+// re-established after being lost.
+var brokerReconnects = expvar.NewInt("broker_reconnects")
+
+// brokerConnection is a connection to RabbitMQ along with the channels
+// opened on it, one for each publish worker, as channels aren't safe for
+// concurrent use. The exchange is declared whenever the connection is
+// made.
+type brokerConnection struct {
+	url      string
+	exchange string
+	kind     string
+	durable  bool          // declare the exchange as durable
+	channels int           // number of channels to open, at least one
+	confirm  time.Duration // wait this long for the broker to confirm each message, zero disables confirms
+
+	// dial makes the connection and opens its channels, defaulting to
+	// open. It is replaced in tests.
+	dial func() (*amqp.Connection, []brokerChannel, error)
+
+	lock *sync.Mutex
+	conn *amqp.Connection
+	chs  []brokerChannel // nil while disconnected
+}
+
+// brokerChannel is a channel opened on the connection to RabbitMQ.
+type brokerChannel struct {
+	*amqp.Channel
+	confirms *confirmer // nil unless publisher confirms are enabled
+}
+
+// newBrokerConnection connects to RabbitMQ at url, opening n channels and
+// declaring the exchange, as durable if durable is set. If confirm is set
+// the channels are put into confirm mode. An error is returned if the
+// connection can't be made.
+func newBrokerConnection(url, exchange, kind string, durable bool, n int, confirm time.Duration) (*brokerConnection, error) {
+	if n < 1 {
+		n = 1
+	}
+	c := &brokerConnection{url: url, exchange: exchange, kind: kind, durable: durable, channels: n, confirm: confirm, lock: new(sync.Mutex)}
+	c.dial = c.open
+
+	conn, chs, err := c.dial()
+	if err != nil {
+		return nil, err
+	}
+	c.conn, c.chs = conn, chs
+	return c, nil
+}
+
+// open connects to RabbitMQ, opens the channels and declares the exchange
+// on the first of them, with the same settings on every reconnection. The
+// connection is closed if any step fails.
+func (c *brokerConnection) open() (*amqp.Connection, []brokerChannel, error) {
+	conn, err := amqp.Dial(c.url)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+	}
+
+	chs := []brokerChannel{}
+	for n := 0; n < c.channels; n++ {
+		ch, err := conn.Channel()
+		if err != nil {
+			conn.Close()
+			return nil, nil, fmt.Errorf("failed to open a channel: %w", err)
+		}
+
+		bc := brokerChannel{Channel: ch}
+		if c.confirm > 0 {
+			bc.confirms, err = newConfirmer(ch, c.confirm)
+			if err != nil {
+				conn.Close()
+				return nil, nil, err
+			}
+		}
+		chs = append(chs, bc)
+	}
+
+	err = chs[0].ExchangeDeclare(
+		c.exchange, // name
+		c.kind,     // kind
+		c.durable,  // durable
+		false,      // delete when unused
+		false,      // exclusive
+		false,      // no-wait
+		nil,        // arguments
+	)
+	if err != nil {
+		conn.Close()
+		return nil, nil, &exchangeError{exchange: c.exchange, kind: c.kind, err: err}
+	}
+
+	return conn, chs, nil
+}
+
+// current returns the open channels, or nil while disconnected.
+func (c *brokerConnection) current() []brokerChannel {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.chs
+}
+
+// maintain reconnects to RabbitMQ whenever the connection, or any of its
+// channels, is closed, until the context is cancelled. The connection is
+// re-established in full, as a channel can't be reopened on a connection
+// that has died. Attempts are made with exponential backoff. The channels
+// are nil until the connection is re-established.
+func (c *brokerConnection) maintain(ctx context.Context) {
+	defer c.close()
+
+	for {
+		c.lock.Lock()
+		conn, chs := c.conn, c.chs
+		c.lock.Unlock()
+
+		// Each listener is given its own channel, as they are closed when
+		// the connection is, and buffered so that the close isn't blocked.
+		closed := make(chan *amqp.Error, len(chs)+1)
+		watch := func(errs chan *amqp.Error) {
+			go func() {
+				closed <- <-errs
+			}()
+		}
+		watch(conn.NotifyClose(make(chan *amqp.Error, 1)))
+		for _, ch := range chs {
+			watch(ch.NotifyClose(make(chan *amqp.Error, 1)))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case err := <-closed:
+			fmt.Fprintf(os.Stderr, "lost connection to RabbitMQ, reconnecting: %v\n", err)
+		}
+
+		c.lock.Lock()
+		c.chs = nil
+		c.lock.Unlock()
+		conn.Close()
+
+		if !c.reconnect(ctx) {
+			return
+		}
+	}
+}
+
+// reconnect dials RabbitMQ with exponential backoff until the connection
+// is re-established, reporting whether it was. It gives up, returning
+// false, once the context is cancelled.
+func (c *brokerConnection) reconnect(ctx context.Context) bool {
+	delay := reconnectDelay
+	for {
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return false
+		}
+
+		conn, chs, err := c.dial()
+		if err == nil {
+			c.lock.Lock()
+			c.conn, c.chs = conn, chs
+			c.lock.Unlock()
+			brokerReconnects.Add(1)
+			log.Println("reconnected to RabbitMQ")
+			return true
+		}
+
+		delay = nextReconnectDelay(delay)
+		fmt.Fprintf(os.Stderr, "failed to reconnect to RabbitMQ, retrying in %s: %v\n", delay, err)
+	}
+}
+
+// nextReconnectDelay returns the delay to wait after an attempt to
+// reconnect that followed a delay of d, which is doubled up to the
+// maximum.
+func nextReconnectDelay(d time.Duration) time.Duration {
+	d *= 2
+	if d > maxReconnectDelay {
+		d = maxReconnectDelay
+	}
+	return d
+}
+
+// close closes the connection, along with its channels.
+func (c *brokerConnection) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.conn.Close()
+	c.chs = nil
+}
+
+// Counts of messages the broker failed to confirm.
+var (
+	messagesNacked  = expvar.NewInt("messages_nacked")
+	confirmTimeouts = expvar.NewInt("confirm_timeouts")
+)
+
+// errNacked is returned when the broker rejects a published message.
+var errNacked = errors.New("message rejected by the broker")
+
+// errConfirmTimeout is returned when the broker doesn't confirm a
+// published message in time.
+var errConfirmTimeout = errors.New("timed out waiting for the broker to confirm message")
+
+// confirmer waits for the broker to confirm the messages published on a
+// channel in confirm mode. Messages are confirmed in the order they are
+// published, identified by their delivery tags, which start at one.
+type confirmer struct {
+	confirms <-chan amqp.Confirmation
+	timeout  time.Duration
+	tag      uint64 // delivery tag of the last message published
+}
+
+// newConfirmer puts ch into confirm mode, returning a confirmer that waits
+// up to timeout for each message published on it to be confirmed.
+func newConfirmer(ch *amqp.Channel, timeout time.Duration) (*confirmer, error) {
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+
+	// The broker may confirm messages that have timed out once later
+	// messages are waited for, so the listener is buffered to avoid
+	// blocking the connection.
+	confirms := ch.NotifyPublish(make(chan amqp.Confirmation, 128))
+	return &confirmer{confirms: confirms, timeout: timeout}, nil
+}
+
+// wait waits for the broker to confirm the last message published,
+// skipping confirmations of earlier messages that timed out. Messages that
+// are rejected or not confirmed in time are counted and reported with an
+// error.
+func (c *confirmer) wait() error {
+	return c.waitUntil(time.Now().Add(c.timeout))
+}
+
+// waitUntil waits as wait does, but only until deadline, so that a batch
+// of messages can share one. Once the deadline has passed, messages not
+// already confirmed fail at once.
+func (c *confirmer) waitUntil(deadline time.Time) error {
+	c.tag++
+	timer := time.NewTimer(time.Until(deadline))
+	defer timer.Stop()
+	for {
+		select {
+		case conf, ok := <-c.confirms:
+			if !ok {
+				return amqp.ErrClosed
+			}
+			if conf.DeliveryTag < c.tag {
+				continue
+			}
+			if !conf.Ack {
+				messagesNacked.Add(1)
+				return errNacked
+			}
+			return nil
+		case <-timer.C:
+			confirmTimeouts.Add(1)
+			return errConfirmTimeout
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+func TestConfirmerWait(t *testing.T) {
+	confirms := make(chan amqp.Confirmation, 10)
+	c := &confirmer{confirms: confirms, timeout: time.Millisecond * 50}
+
+	nacked := messagesNacked.Value()
+	timeouts := confirmTimeouts.Value()
+
+	// The first message is acknowledged.
+	confirms <- amqp.Confirmation{DeliveryTag: 1, Ack: true}
+	if err := c.wait(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	// The second is rejected.
+	confirms <- amqp.Confirmation{DeliveryTag: 2, Ack: false}
+	if err := c.wait(); !errors.Is(err, errNacked) {
+		t.Errorf("%v != %v", err, errNacked)
+	}
+
+	// The third isn't confirmed in time.
+	if err := c.wait(); !errors.Is(err, errConfirmTimeout) {
+		t.Errorf("%v != %v", err, errConfirmTimeout)
+	}
+
+	// We expect the late confirmation of the third message to be skipped
+	// when waiting for the fourth.
+	confirms <- amqp.Confirmation{DeliveryTag: 3, Ack: false}
+	confirms <- amqp.Confirmation{DeliveryTag: 4, Ack: true}
+	if err := c.wait(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+
+	if got, want := messagesNacked.Value()-nacked, int64(1); got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+	if got, want := confirmTimeouts.Value()-timeouts, int64(1); got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+
+	// Waiting fails once the channel is closed.
+	close(confirms)
+	if err := c.wait(); !errors.Is(err, amqp.ErrClosed) {
+		t.Errorf("%v != %v", err, amqp.ErrClosed)
+	}
+}
+
+func TestNextReconnectDelay(t *testing.T) {
+	// We expect the delay to double after each failed attempt, up to the
+	// maximum.
+	delay := reconnectDelay
+	want := []time.Duration{2, 4, 8, 16, 30, 30}
+	for i, w := range want {
+		delay = nextReconnectDelay(delay)
+		if delay != w*time.Second {
+			t.Errorf("%d: %v != %v", i, delay, w*time.Second)
+		}
+	}
+}
+
+func TestBrokerConnectionReconnect(t *testing.T) {
+	defer func(d, max time.Duration) {
+		reconnectDelay, maxReconnectDelay = d, max
+	}(reconnectDelay, maxReconnectDelay)
+	reconnectDelay, maxReconnectDelay = time.Millisecond, time.Millisecond*4
+
+	// The connection has been lost, and the first few attempts to dial
+	// fail.
+	c := &brokerConnection{lock: new(sync.Mutex)}
+	chs := []brokerChannel{{}, {}}
+	attempts := []time.Time{}
+	c.dial = func() (*amqp.Connection, []brokerChannel, error) {
+		attempts = append(attempts, time.Now())
+		if c.current() != nil {
+			t.Error("expected no channels while disconnected")
+		}
+		if len(attempts) < 5 {
+			return nil, nil, errors.New("dial failed")
+		}
+		return nil, chs, nil
+	}
+
+	reconnects := brokerReconnects.Value()
+	start := time.Now()
+	if !c.reconnect(context.Background()) {
+		t.Fatal("expected to reconnect")
+	}
+
+	// We expect the attempts to be made after delays of 1, 2, 4, 4 and 4ms.
+	if got, want := len(attempts), 5; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+	prev := start
+	for i, d := range []time.Duration{1, 2, 4, 4, 4} {
+		if got := attempts[i].Sub(prev); got < d*time.Millisecond {
+			t.Errorf("%d: %v < %v", i, got, d*time.Millisecond)
+		}
+		prev = attempts[i]
+	}
+
+	// Once reconnected the new channels are current.
+	if got, want := len(c.current()), len(chs); got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+	if got, want := brokerReconnects.Value()-reconnects, int64(1); got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+
+	// Attempts stop once the context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.dial = func() (*amqp.Connection, []brokerChannel, error) {
+		return nil, nil, errors.New("dial failed")
+	}
+	if c.reconnect(ctx) {
+		t.Error("expected not to reconnect once cancelled")
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/streadway/amqp"
+)
+
+// consume connects to the exchange at url, binds a temporary queue to it
+// and writes every message received to w as newline delimited JSON, until
+// the context is cancelled. It lets users confirm that messages are
+// reaching the broker. If indent is not empty, messages are written as
+// indented JSON instead, with each level of nesting prefixed by indent.
+// The exchange is declared as durable if durable is set, which must match
+// the exchange declared by the publisher.
+func consume(ctx context.Context, url, exchange, kind, indent string, durable bool, w io.Writer) error {
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		return fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+	}
+	defer conn.Close()
+
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open a channel: %w", err)
+	}
+
+	err = ch.ExchangeDeclare(exchange, kind, durable, false, false, false, nil)
+	if err != nil {
+		return &exchangeError{exchange: exchange, kind: kind, err: err}
+	}
+
+	// The queue is named by the broker and deleted once we disconnect.
+	q, err := ch.QueueDeclare("", false, true, true, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to declare a queue: %w", err)
+	}
+
+	for _, key := range bindingKeys(kind) {
+		err = ch.QueueBind(q.Name, key, exchange, false, nil)
+		if err != nil {
+			return fmt.Errorf("failed to bind queue to %s with key %q: %w", exchange, key, err)
+		}
+	}
+
+	deliveries, err := ch.Consume(q.Name, "", true, true, false, false, nil)
+	if err != nil {
+		return fmt.Errorf("failed to consume: %w", err)
+	}
+
+	return writeDeliveries(ctx, w, deliveries, indent)
+}
+
+// bindingKeys returns the keys a queue must be bound to an exchange of the
+// given kind with to receive every message published to it.
+func bindingKeys(kind string) []string {
+	switch kind {
+	case exchangeTopic:
+		return []string{"#"}
+	case exchangeDirect:
+		keys := []string{keyAircraft, keyRange, keyNormal, keySummary}
+		for _, e := range []Emergency{EmergencyGeneral, EmergencyLifeguard, EmergencyMinFuel, EmergencyNoRadio, EmergencyUnlawful, EmergencyDowned} {
+			keys = append(keys, string(e))
+		}
+		return keys
+	default:
+		return []string{""}
+	}
+}
+
+// writeDeliveries writes the body of each delivery to w on its own line,
+// decompressing those that were compressed, until the context is cancelled
+// or the deliveries channel is closed. Bodies are indented if indent is not
+// empty.
+func writeDeliveries(ctx context.Context, w io.Writer, deliveries <-chan amqp.Delivery, indent string) error {
+	for {
+		select {
+		case d, ok := <-deliveries:
+			if !ok {
+				return errors.New("connection to RabbitMQ closed")
+			}
+
+			body, err := deliveryBody(d)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to read message: %v\n", err)
+				continue
+			}
+
+			_, err = w.Write(append(indentJSON(body, indent), '\n'))
+			if err != nil {
+				return fmt.Errorf("failed to write message: %w", err)
+			}
+
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// indentJSON returns body indented with indent, for reading by people. The
+// body is returned unchanged if indent is empty or body isn't valid JSON.
+func indentJSON(body []byte, indent string) []byte {
+	if indent == "" {
+		return body
+	}
+
+	var buf bytes.Buffer
+	err := json.Indent(&buf, body, "", indent)
+	if err != nil {
+		return body
+	}
+	return buf.Bytes()
+}
+
+// deliveryBody returns the body of a delivery, decompressing it if it was
+// published compressed.
+func deliveryBody(d amqp.Delivery) ([]byte, error) {
+	if d.ContentEncoding != "gzip" {
+		return d.Body, nil
+	}
+
+	zr, err := gzip.NewReader(bytes.NewReader(d.Body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress message: %w", err)
+	}
+	defer zr.Close()
+	return ioutil.ReadAll(zr)
+}
@@ -0,0 +1,116 @@
+//go:build integration
+// +build integration
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// TestPublishConsume publishes a message to a real broker and asserts that
+// it is consumed. The broker is read from ADSB_TEST_AMQP_URL, for example
+// one started with: docker run -p 5672:5672 rabbitmq:3
+func TestPublishConsume(t *testing.T) {
+	url := os.Getenv("ADSB_TEST_AMQP_URL")
+	if url == "" {
+		t.Skip("ADSB_TEST_AMQP_URL not set")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	exchange := "adsb-console-test"
+	r, w := io.Pipe()
+	consumed := make(chan error, 1)
+	go func() {
+		consumed <- consume(ctx, url, exchange, exchangeFanout, "", false, w)
+	}()
+
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := make(chan string, 1)
+	go func() {
+		s := bufio.NewScanner(r)
+		if s.Scan() {
+			lines <- s.Text()
+		}
+	}()
+
+	// The consumer's queue may not be bound yet, so publish until the
+	// message is received.
+	pub := &amqpPublisher{ch: ch, exchange: exchange}
+	want := `{"flight":"A"}`
+	deadline := time.After(time.Second * 10)
+	for {
+		err := pub.Publish(keyAircraft, []byte(want))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		select {
+		case got := <-lines:
+			if got != want {
+				t.Errorf("%q != %q", got, want)
+			}
+			return
+		case err := <-consumed:
+			t.Fatalf("consume returned: %v", err)
+		case <-deadline:
+			t.Fatal("timed out waiting for message")
+		case <-time.After(time.Millisecond * 100):
+		}
+	}
+}
+
+// TestExchangeMismatch asserts that declaring an exchange that already
+// exists with a different kind is reported as a permanent failure.
+func TestExchangeMismatch(t *testing.T) {
+	url := os.Getenv("ADSB_TEST_AMQP_URL")
+	if url == "" {
+		t.Skip("ADSB_TEST_AMQP_URL not set")
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	conn, err := amqp.Dial(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	ch, err := conn.Channel()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	exchange := "adsb-console-test-mismatch"
+	err = ch.ExchangeDeclare(exchange, exchangeDirect, false, true, false, false, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	err = startUpdater(ctx, url, exchange, time.Second, "dummy station", &store, publishOptions{exchangeKind: exchangeFanout})
+
+	var xe *exchangeError
+	if !errors.As(err, &xe) || !xe.permanent() {
+		t.Errorf("expected a permanent exchange error, got %v", err)
+	}
+}
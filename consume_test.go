@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/streadway/amqp"
+)
+
+func TestWriteDeliveries(t *testing.T) {
+	large := []byte(`[` + string(bytes.Repeat([]byte(`{"flight":"A"},`), 100)) + `{"flight":"A"}]`)
+	compressed, err := newPublishing(large, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deliveries := make(chan amqp.Delivery, 3)
+	deliveries <- amqp.Delivery{Body: []byte(`{"flight":"A"}`)}
+	deliveries <- amqp.Delivery{Body: compressed.Body, ContentEncoding: compressed.ContentEncoding}
+	deliveries <- amqp.Delivery{Body: []byte("corrupt"), ContentEncoding: "gzip"}
+	close(deliveries)
+
+	var buf bytes.Buffer
+	err = writeDeliveries(context.Background(), &buf, deliveries, "")
+	if err == nil {
+		t.Error("expected an error once deliveries are closed")
+	}
+
+	// We expect compressed messages to be decompressed and corrupt messages
+	// to be skipped.
+	want := `{"flight":"A"}` + "\n" + string(large) + "\n"
+	if got := buf.String(); got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+}
+
+func TestIndentJSON(t *testing.T) {
+	body := []byte(`{"flight":"A","tags":{"owner":"B"}}`)
+
+	tcs := []struct {
+		name   string
+		body   []byte
+		indent string
+		want   string
+	}{
+		{name: "compact", body: body, want: `{"flight":"A","tags":{"owner":"B"}}`},
+		{name: "indented", body: body, indent: "  ", want: "{\n  \"flight\": \"A\",\n  \"tags\": {\n    \"owner\": \"B\"\n  }\n}"},
+		{name: "invalid", body: []byte("corrupt"), indent: "  ", want: "corrupt"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := string(indentJSON(tc.body, tc.indent)); got != tc.want {
+				t.Errorf("%q != %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestBindingKeys(t *testing.T) {
+	tcs := []struct {
+		kind string
+		want string
+	}{
+		{kind: exchangeFanout, want: ""},
+		{kind: exchangeTopic, want: "#"},
+		{kind: exchangeDirect, want: string(EmergencyGeneral)},
+	}
+
+	for _, tc := range tcs {
+		found := false
+		for _, k := range bindingKeys(tc.kind) {
+			if k == tc.want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected %s exchange to be bound with %q", tc.kind, tc.want)
+		}
+	}
+}
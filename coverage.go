@@ -0,0 +1,174 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+)
+
+// fieldCount records how many aircraft in a scan populated a field, along
+// with the first value seen.
+type fieldCount struct {
+	Name   string
+	Count  int
+	Sample interface{}
+}
+
+// fieldCoverage counts, for each field of Aircraft in declaration order,
+// the number of aircraft in the scan with a non-zero value for it. Fields
+// are named by their JSON keys.
+func fieldCoverage(s Scan) []fieldCount {
+	t := reflect.TypeOf(Aircraft{})
+	counts := []fieldCount{}
+
+	for i := 0; i < t.NumField(); i++ {
+		name := jsonName(t.Field(i))
+		if name == "" {
+			continue
+		}
+
+		fc := fieldCount{Name: name}
+		for _, a := range s.Aircraft {
+			v := reflect.ValueOf(a).Field(i)
+			if v.IsZero() {
+				continue
+			}
+
+			fc.Count++
+			if fc.Sample == nil {
+				fc.Sample = v.Interface()
+			}
+		}
+		counts = append(counts, fc)
+	}
+
+	return counts
+}
+
+// formatCoverage summarises field coverage across total aircraft, for
+// example "alt_geom: 12/40, alt_baro: 38/40".
+func formatCoverage(counts []fieldCount, total int) string {
+	parts := make([]string, len(counts))
+	for i, fc := range counts {
+		parts[i] = fmt.Sprintf("%s: %d/%d", fc.Name, fc.Count, total)
+	}
+	return strings.Join(parts, ", ")
+}
+
+// schemaCheck warns, once, if any of a set of expected fields isn't
+// populated by a single aircraft across the first scans read from a source.
+// It catches upgrades to the decoder that rename or remove fields, which
+// otherwise go unnoticed.
+type schemaCheck struct {
+	fields  []string        // JSON names of the fields expected
+	scans   int             // number of scans observed before warning
+	seen    map[string]bool // fields populated so far
+	checked int             // number of scans observed so far
+}
+
+// newSchemaCheck returns a check that the fields, named by their JSON keys,
+// are populated within the given number of scans. A nil check, which does
+// nothing, is returned if no fields are expected.
+func newSchemaCheck(fields []string, scans int) *schemaCheck {
+	if len(fields) == 0 {
+		return nil
+	}
+	return &schemaCheck{fields: fields, scans: scans, seen: map[string]bool{}}
+}
+
+// observe records the fields populated in scan s. Once the configured
+// number of scans have been observed it returns the expected fields that
+// were never populated. Nil is returned at any other time.
+func (c *schemaCheck) observe(s Scan) []string {
+	if c == nil || c.checked >= c.scans {
+		return nil
+	}
+
+	for _, fc := range fieldCoverage(s) {
+		if fc.Count > 0 {
+			c.seen[fc.Name] = true
+		}
+	}
+
+	c.checked++
+	if c.checked < c.scans {
+		return nil
+	}
+
+	missing := []string{}
+	for _, f := range c.fields {
+		if !c.seen[f] {
+			missing = append(missing, f)
+		}
+	}
+	if len(missing) == 0 {
+		return nil
+	}
+	return missing
+}
+
+// warn logs a warning if observing scan s, read from the source at path,
+// finds expected fields that were never populated.
+func (c *schemaCheck) warn(path string, s Scan) {
+	missing := c.observe(s)
+	if missing == nil {
+		return
+	}
+	log.Printf("warning: %s didn't populate %s in %d scans, check the decoder hasn't changed its JSON schema\n", path, strings.Join(missing, ", "), c.scans)
+}
+
+// validateFields returns an error if any of the names isn't the JSON key of
+// a field of Aircraft.
+func validateFields(names []string) error {
+	known := map[string]bool{}
+	for _, fc := range fieldCoverage(Scan{}) {
+		known[fc.Name] = true
+	}
+
+	for _, n := range names {
+		if !known[n] {
+			return fmt.Errorf("unknown field %q", n)
+		}
+	}
+	return nil
+}
+
+// listFields writes a table to w listing, for each field of Aircraft, how
+// many aircraft in the scan populated it and a sample value. Strings are
+// quoted so that padding is visible.
+func listFields(w io.Writer, s Scan) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FIELD\tPRESENT\tSAMPLE")
+
+	for _, fc := range fieldCoverage(s) {
+		sample := ""
+		switch v := fc.Sample.(type) {
+		case nil:
+		case string, fieldList:
+			sample = fmt.Sprintf("%q", v)
+		default:
+			sample = fmt.Sprintf("%v", v)
+		}
+		fmt.Fprintf(tw, "%s\t%d/%d\t%s\n", fc.Name, fc.Count, len(s.Aircraft), sample)
+	}
+
+	return tw.Flush()
+}
+
+// jsonName returns the JSON key of a struct field, or an empty string if
+// the field isn't encoded.
+func jsonName(f reflect.StructField) string {
+	tag := f.Tag.Get("json")
+	if tag == "-" {
+		return ""
+	}
+
+	name := strings.Split(tag, ",")[0]
+	if name == "" {
+		return f.Name
+	}
+	return name
+}
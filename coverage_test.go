@@ -0,0 +1,131 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestFieldCoverage(t *testing.T) {
+	scan := Scan{Aircraft: []Aircraft{
+		{Hex: "a1", AltBaro: 1000, AltGeom: 1100, Gs: 200},
+		{Hex: "a2", AltBaro: 2000, Gs: 210},
+		{Hex: "a3", Gs: 220, Tas: 230},
+	}}
+
+	counts := map[string]int{}
+	for _, fc := range fieldCoverage(scan) {
+		counts[fc.Name] = fc.Count
+	}
+
+	want := map[string]int{"hex": 3, "alt_baro": 2, "alt_geom": 1, "gs": 3, "tas": 1, "flight": 0}
+	for k, v := range want {
+		got, ok := counts[k]
+		if !ok {
+			t.Errorf("expected coverage for %s", k)
+			continue
+		}
+		if got != v {
+			t.Errorf("%s: %d != %d", k, got, v)
+		}
+	}
+}
+
+func TestFormatCoverage(t *testing.T) {
+	counts := []fieldCount{{Name: "alt_geom", Count: 12}, {Name: "alt_baro", Count: 38}}
+
+	got := formatCoverage(counts, 40)
+	if want := "alt_geom: 12/40, alt_baro: 38/40"; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+
+	if !strings.HasPrefix(formatCoverage(fieldCoverage(Scan{}), 0), "hex: 0/0") {
+		t.Errorf("expected coverage to start with hex")
+	}
+}
+
+func TestListFields(t *testing.T) {
+	scan, err := readScan("data/uat_aircraft.json", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	buf := &bytes.Buffer{}
+	err = listFields(buf, scan)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lines := map[string][]string{}
+	for _, l := range strings.Split(buf.String(), "\n") {
+		fields := strings.Fields(l)
+		if len(fields) > 0 {
+			lines[fields[0]] = fields[1:]
+		}
+	}
+
+	want := map[string][]string{
+		"FIELD":    {"PRESENT", "SAMPLE"},
+		"hex":      {"3/3", `"a8b5c2"`},
+		"flight":   {"2/3", `"N657CD`, `"`},
+		"alt_geom": {"1/3", "6625"},
+		"gs":       {"2/3", "112"},
+		"ias":      {"0/3"},
+	}
+	for k, v := range want {
+		if got := lines[k]; strings.Join(got, " ") != strings.Join(v, " ") {
+			t.Errorf("%s: %q != %q", k, got, v)
+		}
+	}
+}
+
+func TestSchemaCheck(t *testing.T) {
+	scan := Scan{Aircraft: []Aircraft{
+		{Hex: "a1", AltBaro: 1000, Gs: 200},
+		{Hex: "a2", AltBaro: 2000, Gs: 210},
+	}}
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	c := newSchemaCheck([]string{"alt_baro", "alt_geom", "gs"}, 2)
+
+	// We expect a warning for the missing field once, after the second scan.
+	for i := 0; i < 3; i++ {
+		c.warn("/run/dump1090-fa/aircraft.json", scan)
+	}
+
+	got := buf.String()
+	if n := strings.Count(got, "warning:"); n != 1 {
+		t.Fatalf("%d != %d: %q", n, 1, got)
+	}
+	if !strings.Contains(got, "didn't populate alt_geom in 2 scans") {
+		t.Errorf("unexpected warning: %q", got)
+	}
+	if strings.Contains(got, "gs") {
+		t.Errorf("warning includes a populated field: %q", got)
+	}
+
+	// We expect no warning once every field has been populated.
+	c = newSchemaCheck([]string{"alt_baro", "gs"}, 1)
+	if got := c.observe(scan); got != nil {
+		t.Errorf("%v != %v", got, nil)
+	}
+
+	// We expect no check if no fields are expected.
+	if c := newSchemaCheck(nil, 1); c != nil {
+		t.Errorf("%v != %v", c, nil)
+	}
+}
+
+func TestValidateFields(t *testing.T) {
+	if err := validateFields([]string{"alt_geom", "gs", "lat", "lon"}); err != nil {
+		t.Error(err)
+	}
+	if err := validateFields([]string{"altitude"}); err == nil {
+		t.Error("expected an error for an unknown field")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"math"
+	"reflect"
+	"strconv"
+)
+
+// UnmarshalJSON decodes an Aircraft, tolerating numeric fields reported as
+// strings and string fields reported as numbers, as some receivers do
+// intermittently. Values that can't be converted, such as an alt_baro of
+// "ground", are ignored rather than failing the whole scan.
+func (a *Aircraft) UnmarshalJSON(b []byte) error {
+	type plain Aircraft
+
+	err := json.Unmarshal(b, (*plain)(a))
+	var typeErr *json.UnmarshalTypeError
+	if err == nil || !errors.As(err, &typeErr) {
+		return err
+	}
+
+	fields := map[string]json.RawMessage{}
+	err = json.Unmarshal(b, &fields)
+	if err != nil {
+		return err
+	}
+
+	t := reflect.TypeOf(plain{})
+	for i := 0; i < t.NumField(); i++ {
+		name := jsonName(t.Field(i))
+		raw, ok := fields[name]
+		if !ok {
+			continue
+		}
+
+		v, ok := coerce(raw, t.Field(i).Type.Kind())
+		if !ok {
+			delete(fields, name)
+			continue
+		}
+		fields[name] = v
+	}
+
+	b, err = json.Marshal(fields)
+	if err != nil {
+		return err
+	}
+
+	*a = Aircraft{}
+	return json.Unmarshal(b, (*plain)(a))
+}
+
+// coerce converts a raw JSON value to suit a field of the given kind:
+// strings holding numbers are converted for numeric fields, and numbers
+// are quoted for string fields. Values that are already suitable are
+// returned unchanged. False is returned if the value can't be converted.
+func coerce(raw json.RawMessage, kind reflect.Kind) (json.RawMessage, bool) {
+	raw = bytes.TrimSpace(raw)
+	if len(raw) == 0 || bytes.Equal(raw, []byte("null")) {
+		return raw, true
+	}
+
+	quoted := raw[0] == '"'
+
+	switch kind {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if !quoted {
+			return raw, isInt(raw)
+		}
+		s := ""
+		if json.Unmarshal(raw, &s) != nil {
+			return nil, false
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil || f != math.Trunc(f) {
+			return nil, false
+		}
+		return json.RawMessage(strconv.FormatInt(int64(f), 10)), true
+
+	case reflect.Float32, reflect.Float64:
+		if !quoted {
+			return raw, true
+		}
+		s := ""
+		if json.Unmarshal(raw, &s) != nil {
+			return nil, false
+		}
+		f, err := strconv.ParseFloat(s, 64)
+		if err != nil {
+			return nil, false
+		}
+		return json.RawMessage(strconv.FormatFloat(f, 'f', -1, 64)), true
+
+	case reflect.String:
+		if quoted || raw[0] == '[' {
+			return raw, true
+		}
+		return json.RawMessage(strconv.Quote(string(raw))), true
+	}
+
+	return raw, true
+}
+
+// isInt reports whether raw holds a JSON number that fits an int.
+func isInt(raw json.RawMessage) bool {
+	_, err := strconv.ParseInt(string(raw), 10, 64)
+	return err == nil
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestDecodeMixedTypes(t *testing.T) {
+	b := `{"now": 1, "aircraft": [
+		{"hex": "a1", "flight": "A", "squawk": 7700, "nav_qnh": "1013.2", "alt_baro": "ground", "gs": 12.5},
+		{"hex": "a2", "flight": "B", "alt_baro": "35000", "squawk": "1200", "version": 2.5},
+		{"hex": "a3", "flight": "C", "alt_baro": 12000, "squawk": "7000", "mlat": ["lat", "lon"]}
+	]}`
+
+	scan, err := decodeScan(strings.NewReader(b), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := len(scan.Aircraft), 3; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+
+	// We expect values of the wrong type to be converted where possible,
+	// and ignored otherwise, without losing the rest of the aircraft.
+	a1 := scan.Aircraft[0]
+	if a1.Squawk != "7700" || a1.NavQnh != 1013.2 || a1.AltBaro != 0 || a1.Gs != 12.5 || a1.Flight != "A" {
+		t.Errorf("unexpected decode: %+v", a1)
+	}
+
+	a2 := scan.Aircraft[1]
+	if a2.AltBaro != 35000 || a2.Squawk != "1200" || a2.Version != 0 || a2.Flight != "B" {
+		t.Errorf("unexpected decode: %+v", a2)
+	}
+
+	a3 := scan.Aircraft[2]
+	if a3.AltBaro != 12000 || a3.Squawk != "7000" || !a3.isMlat() {
+		t.Errorf("unexpected decode: %+v", a3)
+	}
+}
+
+func TestDecodeInvalid(t *testing.T) {
+	// Malformed JSON still fails to decode.
+	_, err := decodeScan(strings.NewReader(`{"aircraft": [{"hex": "a1",]}`), 0)
+	if err == nil {
+		t.Error("expected an error, got none")
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// deltaKeys are included in every delta, whether or not they have changed,
+// so that consumers can identify the aircraft and order its updates.
+var deltaKeys = []string{"hex", "type", "timestamp", "seq"}
+
+// messageFields returns the JSON encoded fields of message m by key.
+func messageFields(m interface{}) (map[string]json.RawMessage, error) {
+	body, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+
+	fields := map[string]json.RawMessage{}
+	err = json.Unmarshal(body, &fields)
+	return fields, err
+}
+
+// delta returns the fields of next that differ from those of prev, the last
+// message published for the same aircraft, along with the deltaKeys and a
+// delta field set to true. Fields of prev missing from next are included
+// as null so that consumers remove them.
+func delta(prev, next map[string]json.RawMessage) map[string]json.RawMessage {
+	d := map[string]json.RawMessage{"delta": json.RawMessage("true")}
+
+	for k, v := range next {
+		if old, ok := prev[k]; !ok || !bytes.Equal(old, v) {
+			d[k] = v
+		}
+	}
+	for k := range prev {
+		if _, ok := next[k]; !ok {
+			d[k] = json.RawMessage("null")
+		}
+	}
+	for _, k := range deltaKeys {
+		if v, ok := next[k]; ok {
+			d[k] = v
+		}
+	}
+
+	return d
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDelta(t *testing.T) {
+	prev := map[string]json.RawMessage{
+		"hex":       json.RawMessage(`"a1"`),
+		"type":      json.RawMessage(`"AIRCRAFT"`),
+		"timestamp": json.RawMessage(`1`),
+		"flight":    json.RawMessage(`"DUMMY"`),
+		"altitude":  json.RawMessage(`1000`),
+		"squawk":    json.RawMessage(`"7000"`),
+	}
+	next := map[string]json.RawMessage{
+		"hex":       json.RawMessage(`"a1"`),
+		"type":      json.RawMessage(`"AIRCRAFT"`),
+		"timestamp": json.RawMessage(`2`),
+		"flight":    json.RawMessage(`"DUMMY"`),
+		"altitude":  json.RawMessage(`1100`),
+	}
+
+	want := map[string]json.RawMessage{
+		"delta":     json.RawMessage(`true`),
+		"hex":       json.RawMessage(`"a1"`),
+		"type":      json.RawMessage(`"AIRCRAFT"`),
+		"timestamp": json.RawMessage(`2`),
+		"altitude":  json.RawMessage(`1100`),
+		"squawk":    json.RawMessage(`null`),
+	}
+	if got := delta(prev, next); !reflect.DeepEqual(got, want) {
+		t.Errorf("%s != %s", got, want)
+	}
+}
+
+func TestPublishUpdatesDelta(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	pub := &fakePublisher{}
+	u := updater{store: &store, pub: pub, opts: publishOptions{deltaFields: true}}
+
+	publish := func(a Aircraft) []string {
+		v := store.aircraft[a.key()]
+		v.aircraft = a
+		v.modified = true
+		store.aircraft[a.key()] = v
+
+		u.publishUpdates(time.Now())
+		fields := map[string]json.RawMessage{}
+		err := json.Unmarshal(pub.bodies[len(pub.bodies)-1], &fields)
+		if err != nil {
+			t.Fatal(err)
+		}
+		keys := []string{}
+		for k := range fields {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+
+	// We expect the first message to be published in full.
+	a := Aircraft{Hex: "a1", Flight: "DUMMY", Lat: 51.47, Lon: -0.45, AltGeom: 1000, Timestamp: 1}
+	if got := publish(a); len(got) < 10 {
+		t.Errorf("expected a full message, got %v", got)
+	}
+
+	// We expect only the changed fields and keys in the delta.
+	a.AltGeom, a.Timestamp = 1100, 2
+	want := []string{"altitude", "delta", "hex", "timestamp", "type"}
+	if got := publish(a); !reflect.DeepEqual(got, want) {
+		t.Errorf("%v != %v", got, want)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import "strings"
+
+// Emergency is the emergency or priority status reported by an aircraft.
+type Emergency string
+
+// Emergency states reported by dump1090.
+const (
+	EmergencyNone      Emergency = "none"      // no emergency
+	EmergencyGeneral   Emergency = "general"   // general emergency (7700)
+	EmergencyLifeguard Emergency = "lifeguard" // lifeguard or medical emergency
+	EmergencyMinFuel   Emergency = "minfuel"   // minimum fuel
+	EmergencyNoRadio   Emergency = "nordo"     // no communications (7600)
+	EmergencyUnlawful  Emergency = "unlawful"  // unlawful interference (7500)
+	EmergencyDowned    Emergency = "downed"    // downed aircraft
+)
+
+// parseEmergency normalises an emergency status as reported by a receiver.
+// Unknown values are passed through unchanged.
+func parseEmergency(s string) Emergency {
+	e := Emergency(strings.ToLower(strings.TrimSpace(s)))
+	switch e {
+	case EmergencyNone, EmergencyGeneral, EmergencyLifeguard, EmergencyMinFuel,
+		EmergencyNoRadio, EmergencyUnlawful, EmergencyDowned:
+		return e
+	}
+	return Emergency(s)
+}
+
+// Active reports whether the aircraft has declared an emergency.
+func (e Emergency) Active() bool {
+	return e != "" && e != EmergencyNone
+}
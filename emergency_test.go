@@ -0,0 +1,43 @@
+package main
+
+import "testing"
+
+func TestParseEmergency(t *testing.T) {
+	testCases := []struct {
+		in   string
+		want Emergency
+	}{
+		{in: "none", want: EmergencyNone},
+		{in: "general", want: EmergencyGeneral},
+		{in: "lifeguard", want: EmergencyLifeguard},
+		{in: "minfuel", want: EmergencyMinFuel},
+		{in: "nordo", want: EmergencyNoRadio},
+		{in: "unlawful", want: EmergencyUnlawful},
+		{in: "downed", want: EmergencyDowned},
+		{in: " General ", want: EmergencyGeneral},
+		{in: "reserved", want: Emergency("reserved")},
+		{in: "", want: Emergency("")},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.in, func(t *testing.T) {
+			if got := parseEmergency(tc.in); got != tc.want {
+				t.Errorf("%q != %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestEmergencyActive(t *testing.T) {
+	for _, e := range []Emergency{"", EmergencyNone} {
+		if e.Active() {
+			t.Errorf("expected %q to be inactive", e)
+		}
+	}
+
+	for _, e := range []Emergency{EmergencyGeneral, EmergencyMinFuel, Emergency("reserved")} {
+		if !e.Active() {
+			t.Errorf("expected %q to be active", e)
+		}
+	}
+}
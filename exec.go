@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"os"
+	"os/exec"
+	"time"
+)
+
+// execQueueSize is the number of messages queued for an external command
+// before further messages are dropped.
+const execQueueSize = 1024
+
+// execDropped counts messages dropped because the external command wasn't
+// keeping up.
+var execDropped = expvar.NewInt("exec_dropped")
+
+// execSink writes published messages as newline delimited JSON to the
+// standard input of an external command.
+type execSink struct {
+	queue chan []byte
+}
+
+// StartExecSink starts a new Go routine running command with the shell and
+// feeding it published messages. If the command exits it is restarted,
+// waiting longer after each restart up to maxDelay. Cancelling the provided
+// context stops the command.
+func startExecSink(ctx context.Context, command string, maxDelay time.Duration) *execSink {
+	s := &execSink{queue: make(chan []byte, execQueueSize)}
+
+	go func() {
+		delay := time.Second
+		for ctx.Err() == nil {
+			started := time.Now()
+			err := s.run(ctx, command)
+			if ctx.Err() != nil {
+				return
+			}
+			fmt.Fprintf(os.Stderr, "exec sink command exited, restarting in %s: %v\n", delay, err)
+
+			// Reset the delay if the command had been running for a while.
+			if time.Since(started) > maxDelay {
+				delay = time.Second
+			}
+
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return
+			}
+
+			delay *= 2
+			if delay > maxDelay {
+				delay = maxDelay
+			}
+		}
+	}()
+
+	return s
+}
+
+// Publish queues body for the command, dropping it if the queue is full.
+func (s *execSink) Publish(routingKey string, body []byte) error {
+	select {
+	case s.queue <- body:
+	default:
+		execDropped.Add(1)
+	}
+	return nil
+}
+
+// run starts command and writes queued messages to it until it exits or
+// the context is cancelled.
+func (s *execSink) run(ctx context.Context, command string) error {
+	cmd := exec.CommandContext(ctx, "sh", "-c", command)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return fmt.Errorf("failed to open stdin: %w", err)
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return fmt.Errorf("failed to start command: %w", err)
+	}
+
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	// Bodies are shared with the other sinks, so each line is built in a
+	// buffer of its own rather than appended to the body.
+	line := []byte{}
+	for {
+		select {
+		case body := <-s.queue:
+			line = append(append(line[:0], body...), '\n')
+			_, err := stdin.Write(line)
+			if err != nil {
+				stdin.Close()
+				return <-exited
+			}
+
+		case err := <-exited:
+			return err
+
+		case <-ctx.Done():
+			stdin.Close()
+			return <-exited
+		}
+	}
+}
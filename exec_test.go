@@ -0,0 +1,90 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestExecSink(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.jsonl")
+
+	sink := startExecSink(ctx, "cat >> "+path, time.Second)
+	sink.Publish(keyAircraft, []byte(`{"flight":"A"}`))
+
+	// The body has spare capacity, as bodies built with append may.
+	body := append(make([]byte, 0, 32), `{"flight":"B"}`...)
+	spare := body[:len(body)+1]
+	spare[len(body)] = 'x'
+	sink.Publish(keyAircraft, body)
+
+	want := "{\"flight\":\"A\"}\n{\"flight\":\"B\"}\n"
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		b, _ := ioutil.ReadFile(path)
+		if string(b) == want {
+			// We expect the body shared with other sinks to be left unchanged.
+			if got, want := spare[len(body)], byte('x'); got != want {
+				t.Errorf("%q != %q", got, want)
+			}
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	t.Errorf("%q != %q", b, want)
+}
+
+func TestExecSinkRestart(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "exec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "out.jsonl")
+
+	// The command exits after handling a single message and so must be
+	// restarted to handle the second.
+	sink := startExecSink(ctx, "head -n 1 >> "+path, time.Second)
+	sink.Publish(keyAircraft, []byte(`{"flight":"A"}`))
+
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		b, _ := ioutil.ReadFile(path)
+		if len(b) > 0 {
+			break
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	sink.Publish(keyAircraft, []byte(`{"flight":"B"}`))
+
+	want := "{\"flight\":\"A\"}\n{\"flight\":\"B\"}\n"
+	for time.Now().Before(deadline) {
+		b, _ := ioutil.ReadFile(path)
+		if string(b) == want {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	b, _ := ioutil.ReadFile(path)
+	t.Errorf("%q != %q", b, want)
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// earthRadiusNM is the mean radius of the Earth in nautical miles.
+const earthRadiusNM = 3440.065
+
+// location is a point on the Earth's surface in decimal degrees.
+type location struct {
+	Lat float64
+	Lon float64
+}
+
+// distanceNM returns the great-circle distance between two locations in
+// nautical miles, calculated using the haversine formula.
+func distanceNM(a, b location) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLat := (b.Lat - a.Lat) * math.Pi / 180
+	dLon := (b.Lon - a.Lon) * math.Pi / 180
+
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(lat1)*math.Cos(lat2)*math.Sin(dLon/2)*math.Sin(dLon/2)
+
+	return 2 * earthRadiusNM * math.Asin(math.Sqrt(h))
+}
+
+// metresPerNM is the number of metres in a nautical mile.
+const metresPerNM = 1852
+
+// distanceMetres returns the great-circle distance between two locations
+// in metres, calculated using the haversine formula.
+func distanceMetres(a, b location) float64 {
+	return distanceNM(a, b) * metresPerNM
+}
+
+// rhumbDistanceNM returns the distance between two locations in nautical
+// miles along a rhumb line, a path of constant bearing.
+func rhumbDistanceNM(a, b location) float64 {
+	lat1 := a.Lat * math.Pi / 180
+	lat2 := b.Lat * math.Pi / 180
+	dLat := lat2 - lat1
+	dLon := (b.Lon - a.Lon) * math.Pi / 180
+
+	// take the shorter way around if crossing the antimeridian
+	if math.Abs(dLon) > math.Pi {
+		if dLon > 0 {
+			dLon -= 2 * math.Pi
+		} else {
+			dLon += 2 * math.Pi
+		}
+	}
+
+	// stretch in latitude of the Mercator projection between the points
+	dPsi := math.Log(math.Tan(math.Pi/4+lat2/2) / math.Tan(math.Pi/4+lat1/2))
+
+	// east-west lines have no stretch so use the cosine of the latitude
+	q := math.Cos(lat1)
+	if math.Abs(dPsi) > 1e-12 {
+		q = dLat / dPsi
+	}
+
+	return math.Sqrt(dLat*dLat+q*q*dLon*dLon) * earthRadiusNM
+}
+
+// distanceMethod determines how distances between locations are measured.
+type distanceMethod string
+
+// Supported distance methods.
+const (
+	greatCircle distanceMethod = "great-circle" // shortest path over the Earth's surface
+	rhumbLine   distanceMethod = "rhumb"        // path of constant bearing
+)
+
+// parseDistanceMethod validates a distance method read from the
+// configuration file. An empty value selects great-circle distances.
+func parseDistanceMethod(s string) (distanceMethod, error) {
+	switch m := distanceMethod(s); m {
+	case "":
+		return greatCircle, nil
+	case greatCircle, rhumbLine:
+		return m, nil
+	}
+	return greatCircle, fmt.Errorf("unknown distance method %q, expected %q or %q", s, greatCircle, rhumbLine)
+}
+
+// distance returns the distance between two locations in nautical miles
+// measured using the method.
+func (m distanceMethod) distance(a, b location) float64 {
+	if m == rhumbLine {
+		return rhumbDistanceNM(a, b)
+	}
+	return distanceNM(a, b)
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestDistanceNM(t *testing.T) {
+	testCases := []struct {
+		name string
+		a, b location
+		want float64
+	}{
+		{name: "same", a: location{51.47, -0.4543}, b: location{51.47, -0.4543}, want: 0},
+		{name: "LHR-CDG", a: location{51.4700, -0.4543}, b: location{49.0097, 2.5479}, want: 187.4},
+		{name: "London-New York", a: location{51.5074, -0.1278}, b: location{40.7128, -74.0060}, want: 3007.7},
+		{name: "antimeridian", a: location{0, 179.5}, b: location{0, -179.5}, want: 60.0},
+		{name: "pole", a: location{89.5, 0}, b: location{89.5, 180}, want: 60.0},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := distanceNM(tc.a, tc.b)
+			if math.Abs(got-tc.want) > 0.5 {
+				t.Errorf("%.1f != %.1f", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestRhumbDistanceNM(t *testing.T) {
+	testCases := []struct {
+		name string
+		a, b location
+		want float64
+	}{
+		{name: "same", a: location{51.47, -0.4543}, b: location{51.47, -0.4543}, want: 0},
+		{name: "equator", a: location{0, 0}, b: location{0, 10}, want: 600.4},
+		{name: "meridian", a: location{10, 5}, b: location{20, 5}, want: 600.4},
+		{name: "parallel", a: location{60, 0}, b: location{60, 10}, want: 300.2},
+		{name: "antimeridian", a: location{0, 179.5}, b: location{0, -179.5}, want: 60.0},
+		{name: "LHR-CDG", a: location{51.4700, -0.4543}, b: location{49.0097, 2.5479}, want: 187.4},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got := rhumbDistanceNM(tc.a, tc.b)
+			if math.Abs(got-tc.want) > 0.5 {
+				t.Errorf("%.1f != %.1f", got, tc.want)
+			}
+		})
+	}
+
+	// Away from the equator and meridians a rhumb line is longer than the
+	// great-circle route.
+	a, b := location{51.5074, -0.1278}, location{40.7128, -74.0060}
+	if rhumbDistanceNM(a, b) <= distanceNM(a, b) {
+		t.Errorf("expected rhumb line to be longer than great circle: %.1f <= %.1f", rhumbDistanceNM(a, b), distanceNM(a, b))
+	}
+}
+
+func TestParseDistanceMethod(t *testing.T) {
+	if m, err := parseDistanceMethod(""); err != nil || m != greatCircle {
+		t.Errorf("expected default of %q, got %q (%v)", greatCircle, m, err)
+	}
+
+	if m, err := parseDistanceMethod("rhumb"); err != nil || m != rhumbLine {
+		t.Errorf("expected %q, got %q (%v)", rhumbLine, m, err)
+	}
+
+	if _, err := parseDistanceMethod("manhattan"); err == nil {
+		t.Error("expected an error, got none")
+	}
+}
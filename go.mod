@@ -3,6 +3,7 @@ module github.com/billglover/go-adsb-console
 go 1.13
 
 require (
+	github.com/fsnotify/fsnotify v1.4.7
 	github.com/spf13/viper v1.4.0
 	github.com/streadway/amqp v0.0.0-20190827072141-edfb9018d271
 )
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// sourceStale is reported for a source that reads successfully but hasn't
+// produced a scan recently.
+const sourceStale = "stale"
+
+// sourceHealth tracks the health of every source being monitored.
+var sourceHealth = newHealthTracker()
+
+// healthTracker records the outcome of the latest attempt to read each
+// source and when each last produced a scan. It is safe for concurrent use.
+type healthTracker struct {
+	lock    sync.Mutex
+	sources map[string]sourceState
+}
+
+// sourceState is the health of a single source.
+type sourceState struct {
+	status   string    // outcome of the latest attempt to read the source
+	lastScan time.Time // when the source last produced a scan
+}
+
+// sourceReport describes the health of a single source.
+type sourceReport struct {
+	Source           string     `json:"source"`
+	Status           string     `json:"status"`
+	LastScan         *time.Time `json:"lastScan,omitempty"`
+	SecondsSinceScan *float64   `json:"secondsSinceScan,omitempty"`
+}
+
+// healthReport describes the health of every source. The process is
+// healthy if all of its sources are.
+type healthReport struct {
+	Healthy bool           `json:"healthy"`
+	Sources []sourceReport `json:"sources"`
+}
+
+// newHealthTracker returns a healthTracker with no sources.
+func newHealthTracker() *healthTracker {
+	return &healthTracker{sources: make(map[string]sourceState)}
+}
+
+// add starts tracking source, which is reported as stale until it
+// produces a scan.
+func (h *healthTracker) add(source string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if _, ok := h.sources[source]; !ok {
+		h.sources[source] = sourceState{status: sourceStale}
+	}
+}
+
+// record sets the outcome of the latest attempt to read source. If the
+// attempt succeeded, now is recorded as the time of its last scan.
+func (h *healthTracker) record(source, status string, now time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	s := h.sources[source]
+	s.status = status
+	if status == sourceOK {
+		s.lastScan = now
+	}
+	h.sources[source] = s
+}
+
+// report returns the health of each source, ordered by name. Sources that
+// haven't produced a scan within staleAfter of now are reported as stale.
+func (h *healthTracker) report(now time.Time, staleAfter time.Duration) healthReport {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	r := healthReport{Healthy: true, Sources: []sourceReport{}}
+	for name, s := range h.sources {
+		sr := sourceReport{Source: name, Status: s.status}
+		if !s.lastScan.IsZero() {
+			t := s.lastScan
+			since := now.Sub(t).Seconds()
+			sr.LastScan, sr.SecondsSinceScan = &t, &since
+		}
+		if sr.Status == sourceOK && (s.lastScan.IsZero() || now.Sub(s.lastScan) > staleAfter) {
+			sr.Status = sourceStale
+		}
+		if sr.Status != sourceOK {
+			r.Healthy = false
+		}
+		r.Sources = append(r.Sources, sr)
+	}
+
+	sort.Slice(r.Sources, func(i, j int) bool {
+		return r.Sources[i].Source < r.Sources[j].Source
+	})
+	return r
+}
+
+// healthHandler serves the health of each source tracked by h. The
+// response status is 503 Service Unavailable if any source is unhealthy.
+func healthHandler(h *healthTracker, staleAfter time.Duration) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		report := h.report(time.Now(), staleAfter)
+
+		w.Header().Set("Content-Type", "application/json")
+		if !report.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		err := json.NewEncoder(w).Encode(report)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to encode health: %v\n", err)
+		}
+	}
+}
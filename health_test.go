@@ -0,0 +1,98 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestHealthReport(t *testing.T) {
+	now := time.Now()
+
+	h := newHealthTracker()
+	h.add("/run/a/aircraft.json")
+	h.add("/run/b/aircraft.json")
+	h.add("/run/c/aircraft.json")
+	h.record("/run/a/aircraft.json", sourceOK, now.Add(-time.Second))
+	h.record("/run/b/aircraft.json", sourceOK, now.Add(-time.Minute*5))
+	h.record("/run/c/aircraft.json", sourcePermissionDenied, now)
+
+	r := h.report(now, time.Minute)
+
+	if r.Healthy {
+		t.Error("expected report to be unhealthy")
+	}
+
+	want := []string{sourceOK, sourceStale, sourcePermissionDenied}
+	if got := len(r.Sources); got != len(want) {
+		t.Fatalf("%d != %d", got, len(want))
+	}
+	for i, s := range r.Sources {
+		if s.Status != want[i] {
+			t.Errorf("%s: %q != %q", s.Source, s.Status, want[i])
+		}
+	}
+
+	// We expect the time of the last scan to be kept through failures.
+	h.record("/run/a/aircraft.json", sourceError, now)
+	r = h.report(now, time.Minute)
+	if s := r.Sources[0]; s.SecondsSinceScan == nil || *s.SecondsSinceScan != 1 {
+		t.Errorf("unexpected time since last scan: %+v", s)
+	}
+}
+
+func TestHealthReportNoScan(t *testing.T) {
+	h := newHealthTracker()
+	h.add("/run/a/aircraft.json")
+
+	r := h.report(time.Now(), time.Minute)
+	if r.Healthy {
+		t.Error("expected report to be unhealthy")
+	}
+	if got, want := r.Sources[0].Status, sourceStale; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+	if r.Sources[0].LastScan != nil {
+		t.Errorf("unexpected last scan: %v", r.Sources[0].LastScan)
+	}
+}
+
+func TestHealthEndpoint(t *testing.T) {
+	now := time.Now()
+
+	tcs := []struct {
+		name     string
+		lastScan time.Time
+		want     int
+	}{
+		{name: "healthy", lastScan: now, want: http.StatusOK},
+		{name: "stale", lastScan: now.Add(-time.Minute * 5), want: http.StatusServiceUnavailable},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			h := newHealthTracker()
+			h.record("/run/a/aircraft.json", sourceOK, now)
+			h.record("/run/b/aircraft.json", sourceOK, tc.lastScan)
+
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/health", nil)
+			healthHandler(h, time.Minute).ServeHTTP(rec, req)
+
+			if got := rec.Code; got != tc.want {
+				t.Errorf("%d != %d", got, tc.want)
+			}
+
+			r := healthReport{}
+			err := json.Unmarshal(rec.Body.Bytes(), &r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := len(r.Sources), 2; got != want {
+				t.Errorf("%d != %d", got, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// httpSourceTimeout is the time allowed to fetch a scan over HTTP.
+const httpSourceTimeout = time.Second * 10
+
+// gzipMagic are the first bytes of gzip compressed data.
+var gzipMagic = []byte{0x1f, 0x8b}
+
+// isRemote reports whether the source at path is served over HTTP.
+func isRemote(path string) bool {
+	return strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+}
+
+// errNotModified is returned when an HTTP source reports that the scan
+// hasn't changed since it was last fetched.
+var errNotModified = errors.New("scan not modified")
+
+// validators are the ETag and Last-Modified headers of the last scan
+// fetched from an HTTP source. They are sent with the next request so that
+// the server can report an unchanged scan rather than send it again.
+type validators struct {
+	etag         string
+	lastModified string
+}
+
+// fetchScan fetches and decodes the Scan served at url. Responses are
+// decompressed if the server compresses them, whether or not it sets a
+// Content-Encoding. If v is provided the request is made conditional on
+// the scan having changed since v was recorded, errNotModified is returned
+// if it hasn't, and v is updated once a scan is decoded. Other errors are
+// returned as a *monitorError.
+func fetchScan(client *http.Client, url string, maxBytes int64, v *validators) (Scan, error) {
+	scan := Scan{}
+
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return scan, newMonitorError("fetch", url, err)
+	}
+	if v != nil && v.etag != "" {
+		req.Header.Set("If-None-Match", v.etag)
+	}
+	if v != nil && v.lastModified != "" {
+		req.Header.Set("If-Modified-Since", v.lastModified)
+	}
+
+	// The Accept-Encoding header is left for the client to set, as setting
+	// it here would disable the client's own decompression of gzip.
+	resp, err := client.Do(req)
+	if err != nil {
+		return scan, newMonitorError("fetch", url, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified {
+		return scan, errNotModified
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return scan, newMonitorError("fetch", url, &statusError{code: resp.StatusCode, status: resp.Status})
+	}
+
+	r, err := decompress(resp.Body, resp.Header.Get("Content-Encoding"))
+	if err != nil {
+		return scan, newMonitorError("read", url, err)
+	}
+
+	scan, err = decodeScan(r, maxBytes)
+	if err != nil {
+		return scan, newMonitorError("read", url, err)
+	}
+
+	if v != nil {
+		v.etag = resp.Header.Get("ETag")
+		v.lastModified = resp.Header.Get("Last-Modified")
+	}
+	return scan, nil
+}
+
+// statusError is returned when a server responds with a status other than
+// success.
+type statusError struct {
+	code   int
+	status string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("unexpected status %s", e.status)
+}
+
+// fetchRetries counts fetches of HTTP sources retried after a transient
+// error.
+var fetchRetries = expvar.NewInt("fetch_retries")
+
+// retryFetch calls fetch until it succeeds, fails with an error that
+// isn't transient, or has been attempted the given number of times. The
+// delay between attempts doubles after each retry.
+func retryFetch(fetch func() (Scan, error), attempts int, delay time.Duration) (Scan, error) {
+	scan, err := fetch()
+	for n := 1; n < attempts && err != nil && isTransientFetch(err); n++ {
+		fetchRetries.Add(1)
+		time.Sleep(delay)
+		delay *= 2
+		scan, err = fetch()
+	}
+	return scan, err
+}
+
+// isTransientFetch reports whether a failed fetch of an HTTP source may
+// succeed if retried. Network errors and server errors are transient, as
+// is a server asking for requests to slow down. Other responses, and
+// responses that can't be read, are not.
+func isTransientFetch(err error) bool {
+	var se *statusError
+	if errors.As(err, &se) {
+		return se.code >= 500 || se.code == http.StatusTooManyRequests
+	}
+
+	var me *monitorError
+	return errors.As(err, &me) && me.op == "fetch"
+}
+
+// decompress returns a reader of the decompressed content of r. Deflate is
+// detected by the content encoding and gzip by its leading magic bytes, so
+// that content compressed without saying so is handled. Other content is
+// returned unchanged.
+func decompress(r io.Reader, encoding string) (io.Reader, error) {
+	if strings.EqualFold(encoding, "deflate") {
+		zr, err := zlib.NewReader(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decompress deflate: %w", err)
+		}
+		return zr, nil
+	}
+
+	br := bufio.NewReader(r)
+	magic, _ := br.Peek(len(gzipMagic))
+	if !bytes.Equal(magic, gzipMagic) {
+		return br, nil
+	}
+
+	zr, err := gzip.NewReader(br)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress gzip: %w", err)
+	}
+	return zr, nil
+}
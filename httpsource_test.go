@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestFetchScan(t *testing.T) {
+	raw, err := ioutil.ReadFile("data/aircraft.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := readScan("data/aircraft.json", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(raw)
+	zw.Close()
+
+	var deflated bytes.Buffer
+	fw := zlib.NewWriter(&deflated)
+	fw.Write(raw)
+	fw.Close()
+
+	tcs := []struct {
+		name     string
+		encoding string
+		body     []byte
+	}{
+		{name: "plain", body: raw},
+		{name: "gzip", encoding: "gzip", body: gz.Bytes()},
+		{name: "gzip regardless", body: gz.Bytes()},
+		{name: "deflate", encoding: "deflate", body: deflated.Bytes()},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tc.encoding != "" {
+					w.Header().Set("Content-Encoding", tc.encoding)
+				}
+				w.Write(tc.body)
+			}))
+			defer srv.Close()
+
+			scan, err := fetchScan(srv.Client(), srv.URL+"/data/aircraft.json", 0, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got, want := len(scan.Aircraft), len(want.Aircraft); got != want {
+				t.Fatalf("%d != %d", got, want)
+			}
+			for i := range scan.Aircraft {
+				if scan.Aircraft[i] != want.Aircraft[i] {
+					t.Errorf("%+v != %+v", scan.Aircraft[i], want.Aircraft[i])
+				}
+			}
+		})
+	}
+}
+
+func TestFetchScanStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "not found", http.StatusNotFound)
+	}))
+	defer srv.Close()
+
+	_, err := fetchScan(srv.Client(), srv.URL, 0, nil)
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+
+	var me *monitorError
+	if !errors.As(err, &me) || me.op != "fetch" {
+		t.Errorf("unexpected error: %v", err)
+	}
+}
+
+func TestFetchScanConditional(t *testing.T) {
+	raw, err := ioutil.ReadFile("data/aircraft.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		name   string
+		header string // validator set by the server
+		value  string
+		cond   string // conditional header expected from the client
+	}{
+		{name: "etag", header: "ETag", value: `"abc123"`, cond: "If-None-Match"},
+		{name: "last modified", header: "Last-Modified", value: "Tue, 15 Oct 2019 10:00:00 GMT", cond: "If-Modified-Since"},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.Header.Get(tc.cond) == tc.value {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set(tc.header, tc.value)
+				w.Write(raw)
+			}))
+			defer srv.Close()
+
+			v := &validators{}
+
+			// The first fetch returns the scan and records its validator.
+			scan, err := fetchScan(srv.Client(), srv.URL, 0, v)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(scan.Aircraft) == 0 {
+				t.Error("expected aircraft")
+			}
+
+			// The second fetch is reported as not modified.
+			_, err = fetchScan(srv.Client(), srv.URL, 0, v)
+			if !errors.Is(err, errNotModified) {
+				t.Errorf("%v != %v", err, errNotModified)
+			}
+
+			// We expect an unchanged scan not to be retried.
+			if isTransientFetch(err) {
+				t.Error("expected not modified not to be transient")
+			}
+		})
+	}
+}
+
+func TestRetryFetch(t *testing.T) {
+	raw, err := ioutil.ReadFile("data/aircraft.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tcs := []struct {
+		name     string
+		failures []int // statuses returned before the scan is served
+		attempts int
+		wantErr  bool
+		wantReqs int
+	}{
+		{name: "success", attempts: 3, wantReqs: 1},
+		{name: "server errors", failures: []int{http.StatusBadGateway, http.StatusServiceUnavailable}, attempts: 3, wantReqs: 3},
+		{name: "too many requests", failures: []int{http.StatusTooManyRequests}, attempts: 3, wantReqs: 2},
+		{name: "persistent", failures: []int{500, 500, 500, 500}, attempts: 3, wantErr: true, wantReqs: 3},
+		{name: "not found", failures: []int{http.StatusNotFound}, attempts: 3, wantErr: true, wantReqs: 1},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			reqs := 0
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				reqs++
+				if reqs <= len(tc.failures) {
+					code := tc.failures[reqs-1]
+					http.Error(w, http.StatusText(code), code)
+					return
+				}
+				w.Write(raw)
+			}))
+			defer srv.Close()
+
+			scan, err := retryFetch(func() (Scan, error) {
+				return fetchScan(srv.Client(), srv.URL, 0, nil)
+			}, tc.attempts, time.Millisecond)
+
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if reqs != tc.wantReqs {
+				t.Errorf("%d != %d", reqs, tc.wantReqs)
+			}
+			if err == nil && len(scan.Aircraft) == 0 {
+				t.Error("expected aircraft in the scan")
+			}
+		})
+	}
+}
+
+func TestIsTransientFetch(t *testing.T) {
+	// We expect a server that can't be reached to be retried.
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	url := srv.URL
+	srv.Close()
+
+	_, err := fetchScan(&http.Client{Timeout: time.Second}, url, 0, nil)
+	if err == nil || !isTransientFetch(err) {
+		t.Errorf("expected a transient error, got %v", err)
+	}
+
+	// We expect responses that can't be decoded not to be retried.
+	err = newMonitorError("read", url, errors.New("invalid character"))
+	if isTransientFetch(err) {
+		t.Errorf("expected %v not to be transient", err)
+	}
+}
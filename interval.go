@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// errInvalidInterval is returned when an interval is set to a duration
+// that isn't positive.
+var errInvalidInterval = errors.New("interval must be greater than zero")
+
+// interval is a duration that may be changed while in use, such as the
+// period of a ticker. It is safe for concurrent use.
+type interval struct {
+	lock    sync.Mutex
+	d       time.Duration
+	changed chan struct{}
+}
+
+// newInterval returns an interval of d.
+func newInterval(d time.Duration) *interval {
+	return &interval{d: d, changed: make(chan struct{})}
+}
+
+// get returns the current duration and a channel that is closed when it
+// next changes.
+func (i *interval) get() (time.Duration, <-chan struct{}) {
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	return i.d, i.changed
+}
+
+// set changes the duration to d, notifying anything waiting on a change.
+func (i *interval) set(d time.Duration) error {
+	if d <= 0 {
+		return errInvalidInterval
+	}
+
+	i.lock.Lock()
+	defer i.lock.Unlock()
+	i.d = d
+	close(i.changed)
+	i.changed = make(chan struct{})
+	return nil
+}
+
+// tick returns a channel that receives the time at the end of every
+// interval, adapting to changes in its duration. As with a time.Ticker,
+// ticks are dropped if the receiver falls behind. Cancelling the provided
+// context stops the ticks.
+func (i *interval) tick(ctx context.Context) <-chan time.Time {
+	c := make(chan time.Time, 1)
+
+	go func() {
+		d, changed := i.get()
+		t := time.NewTicker(d)
+		defer func() { t.Stop() }()
+
+		for {
+			select {
+			case now := <-t.C:
+				select {
+				case c <- now:
+				default:
+				}
+
+			case <-changed:
+				t.Stop()
+				d, changed = i.get()
+				t = time.NewTicker(d)
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return c
+}
+
+// intervals are the monitor and update intervals as served by the
+// intervals endpoint, formatted as durations such as 1s.
+type intervals struct {
+	Monitor string `json:"monitor,omitempty"`
+	Update  string `json:"update,omitempty"`
+}
+
+// intervalsHandler serves the monitor and update intervals. A PUT request
+// with either or both intervals changes them without restarting.
+func intervalsHandler(monitor, update *interval) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+		case http.MethodPut:
+			req := intervals{}
+			err := json.NewDecoder(r.Body).Decode(&req)
+			if err != nil {
+				http.Error(w, fmt.Sprintf("invalid request: %v", err), http.StatusBadRequest)
+				return
+			}
+
+			// Both intervals are validated before either is changed.
+			changes := map[*interval]time.Duration{}
+			for iv, s := range map[*interval]string{monitor: req.Monitor, update: req.Update} {
+				if s == "" {
+					continue
+				}
+				d, err := time.ParseDuration(s)
+				if err == nil && d <= 0 {
+					err = errInvalidInterval
+				}
+				if err != nil {
+					http.Error(w, fmt.Sprintf("invalid interval %q: %v", s, err), http.StatusBadRequest)
+					return
+				}
+				changes[iv] = d
+			}
+			for iv, d := range changes {
+				iv.set(d)
+			}
+
+		default:
+			w.Header().Set("Allow", "GET, PUT")
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+
+		m, _ := monitor.get()
+		u, _ := update.get()
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(intervals{Monitor: m.String(), Update: u.String()})
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to encode intervals: %v\n", err)
+		}
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIntervalTick(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	iv := newInterval(time.Hour)
+	ticks := iv.tick(ctx)
+
+	select {
+	case <-ticks:
+		t.Fatal("unexpected tick")
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	// We expect the new cadence to apply without waiting for the old
+	// interval to elapse.
+	err := iv.set(time.Millisecond * 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	for n := 0; n < 5; n++ {
+		select {
+		case <-ticks:
+		case <-time.After(time.Second * 5):
+			t.Fatalf("timed out waiting for tick %d", n)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("5 ticks took %s", elapsed)
+	}
+
+	if err := iv.set(0); err != errInvalidInterval {
+		t.Errorf("%v != %v", err, errInvalidInterval)
+	}
+}
+
+func TestIntervalsEndpoint(t *testing.T) {
+	monitor := newInterval(time.Second)
+	update := newInterval(time.Second * 5)
+	h := newServeMux(serverInfo{}, serverOptions{authUser: "user", monitorInterval: monitor, updateInterval: update})
+
+	tcs := []struct {
+		name        string
+		method      string
+		body        string
+		wantCode    int
+		wantMonitor time.Duration
+		wantUpdate  time.Duration
+	}{
+		{name: "get", method: http.MethodGet, wantCode: http.StatusOK, wantMonitor: time.Second, wantUpdate: time.Second * 5},
+		{name: "change update", method: http.MethodPut, body: `{"update":"10s"}`, wantCode: http.StatusOK, wantMonitor: time.Second, wantUpdate: time.Second * 10},
+		{name: "change both", method: http.MethodPut, body: `{"monitor":"2s","update":"3s"}`, wantCode: http.StatusOK, wantMonitor: time.Second * 2, wantUpdate: time.Second * 3},
+		{name: "invalid", method: http.MethodPut, body: `{"monitor":"1s","update":"-1s"}`, wantCode: http.StatusBadRequest, wantMonitor: time.Second * 2, wantUpdate: time.Second * 3},
+		{name: "method", method: http.MethodDelete, wantCode: http.StatusMethodNotAllowed, wantMonitor: time.Second * 2, wantUpdate: time.Second * 3},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(tc.method, "/intervals", strings.NewReader(tc.body))
+			h.ServeHTTP(rec, req)
+
+			if got := rec.Code; got != tc.wantCode {
+				t.Fatalf("%d != %d", got, tc.wantCode)
+			}
+			if m, _ := monitor.get(); m != tc.wantMonitor {
+				t.Errorf("%s != %s", m, tc.wantMonitor)
+			}
+			if u, _ := update.get(); u != tc.wantUpdate {
+				t.Errorf("%s != %s", u, tc.wantUpdate)
+			}
+
+			if rec.Code == http.StatusOK {
+				got := intervals{}
+				err := json.Unmarshal(rec.Body.Bytes(), &got)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if got.Monitor != tc.wantMonitor.String() || got.Update != tc.wantUpdate.String() {
+					t.Errorf("unexpected intervals: %+v", got)
+				}
+			}
+		})
+	}
+
+	// Without authentication the endpoint isn't served.
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/intervals", nil)
+	newServeMux(serverInfo{}, serverOptions{monitorInterval: monitor, updateInterval: update}).ServeHTTP(rec, req)
+	if got, want := rec.Code, http.StatusNotFound; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// keyCase determines the casing of keys in published JSON messages.
+type keyCase string
+
+// Supported key casings. The default leaves keys as defined on the
+// message types, which mixes snake_case and camelCase.
+const (
+	keyCaseDefault keyCase = ""
+	keyCaseSnake   keyCase = "snake"
+	keyCaseCamel   keyCase = "camel"
+)
+
+// parseKeyCase validates a key casing read from the configuration file.
+func parseKeyCase(s string) (keyCase, error) {
+	switch c := keyCase(s); c {
+	case keyCaseDefault, keyCaseSnake, keyCaseCamel:
+		return c, nil
+	}
+	return keyCaseDefault, fmt.Errorf("unknown key case %q, expected %q or %q", s, keyCaseSnake, keyCaseCamel)
+}
+
+// marshalMessage returns the JSON encoding of v with its top level keys
+// converted to the requested casing.
+func marshalMessage(v interface{}, c keyCase) ([]byte, error) {
+	body, err := json.Marshal(v)
+	if err != nil || c == keyCaseDefault {
+		return body, err
+	}
+
+	fields := map[string]json.RawMessage{}
+	err = json.Unmarshal(body, &fields)
+	if err != nil {
+		return nil, err
+	}
+
+	converted := make(map[string]json.RawMessage, len(fields))
+	for k, v := range fields {
+		switch c {
+		case keyCaseSnake:
+			converted[toSnakeCase(k)] = v
+		case keyCaseCamel:
+			converted[toCamelCase(k)] = v
+		}
+	}
+
+	return json.Marshal(converted)
+}
+
+// toSnakeCase converts a camelCase key to snake_case.
+func toSnakeCase(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
+
+// toCamelCase converts a snake_case key to camelCase.
+func toCamelCase(s string) string {
+	var b strings.Builder
+	upper := false
+	for _, r := range s {
+		if r == '_' {
+			upper = true
+			continue
+		}
+		if upper {
+			r = unicode.ToUpper(r)
+			upper = false
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
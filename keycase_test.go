@@ -0,0 +1,74 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestMarshalMessage(t *testing.T) {
+	m := aircraft{Flight: "A", SeenPos: 1.5, VertRate: -64, StationName: "dummy station"}
+
+	testCases := []struct {
+		name    string
+		keyCase keyCase
+		want    []string
+		notWant []string
+	}{
+		{
+			name:    "default",
+			keyCase: keyCaseDefault,
+			want:    []string{"flight", "seen_pos", "vert_rate", "groundStationName"},
+		},
+		{
+			name:    "snake",
+			keyCase: keyCaseSnake,
+			want:    []string{"flight", "seen_pos", "vert_rate", "ground_station_name"},
+			notWant: []string{"groundStationName"},
+		},
+		{
+			name:    "camel",
+			keyCase: keyCaseCamel,
+			want:    []string{"flight", "seenPos", "vertRate", "groundStationName"},
+			notWant: []string{"seen_pos", "vert_rate"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			body, err := marshalMessage(m, tc.keyCase)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			fields := map[string]interface{}{}
+			err = json.Unmarshal(body, &fields)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, k := range tc.want {
+				if _, ok := fields[k]; !ok {
+					t.Errorf("expected key %q in %s", k, body)
+				}
+			}
+
+			for _, k := range tc.notWant {
+				if _, ok := fields[k]; ok {
+					t.Errorf("unexpected key %q in %s", k, body)
+				}
+			}
+		})
+	}
+}
+
+func TestParseKeyCase(t *testing.T) {
+	for _, s := range []string{"", "snake", "camel"} {
+		if _, err := parseKeyCase(s); err != nil {
+			t.Errorf("unexpected error for %q: %v", s, err)
+		}
+	}
+
+	if _, err := parseKeyCase("kebab"); err == nil {
+		t.Error("expected an error, got none")
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// maxLogLineBytes bounds the length of each line held by a logRing. Longer
+// lines are truncated.
+const maxLogLineBytes = 4096
+
+// logRing holds the most recent lines written to it, up to a fixed number,
+// so that they can be read without access to the host's logs.
+type logRing struct {
+	lock    sync.Mutex
+	size    int      // maximum number of lines held
+	lines   []string // lines held, oldest at next once full
+	next    int      // index of the line overwritten next once full
+	partial []byte   // line written so far without a trailing newline
+}
+
+// newLogRing returns a logRing holding at most size lines.
+func newLogRing(size int) *logRing {
+	return &logRing{size: size}
+}
+
+// Write adds each complete line in p to the ring, dropping the oldest lines
+// once it is full. It never fails.
+func (r *logRing) Write(p []byte) (int, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	buf := p
+	for len(buf) > 0 {
+		i := bytes.IndexByte(buf, '\n')
+		if i < 0 {
+			r.appendPartial(buf)
+			break
+		}
+
+		r.appendPartial(buf[:i])
+		r.add(string(r.partial))
+		r.partial = r.partial[:0]
+		buf = buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// appendPartial adds b to the line being written, up to maxLogLineBytes.
+func (r *logRing) appendPartial(b []byte) {
+	if n := maxLogLineBytes - len(r.partial); len(b) > n {
+		b = b[:n]
+	}
+	r.partial = append(r.partial, b...)
+}
+
+// add holds line, replacing the oldest line if the ring is full.
+func (r *logRing) add(line string) {
+	if len(r.lines) < r.size {
+		r.lines = append(r.lines, line)
+		return
+	}
+	r.lines[r.next] = line
+	r.next = (r.next + 1) % r.size
+}
+
+// Lines returns the lines held, oldest first.
+func (r *logRing) Lines() []string {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	lines := make([]string, 0, len(r.lines))
+	lines = append(lines, r.lines[r.next:]...)
+	return append(lines, r.lines[:r.next]...)
+}
+
+// logsHandler serves the lines held by the ring as plain text, oldest
+// first.
+func logsHandler(r *logRing) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, l := range r.Lines() {
+			fmt.Fprintln(w, l)
+		}
+	}
+}
+
+// captureLogs copies everything logged, or written to standard error, to
+// w as well as standard error. Standard error is replaced by a pipe, so
+// that output from the exec sink's command is included.
+func captureLogs(w io.Writer) error {
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create pipe: %w", err)
+	}
+
+	// The standard logger writes directly so that messages logged before
+	// exiting aren't lost.
+	stderr := os.Stderr
+	log.SetOutput(io.MultiWriter(stderr, w))
+	os.Stderr = pw
+
+	go io.Copy(io.MultiWriter(stderr, w), pr)
+	return nil
+}
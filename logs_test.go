@@ -0,0 +1,60 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestLogRing(t *testing.T) {
+	r := newLogRing(3)
+
+	// We expect lines split across writes to be joined.
+	for _, s := range []string{"one\ntwo\n", "thr", "ee\nfour\n", "five"} {
+		n, err := r.Write([]byte(s))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n != len(s) {
+			t.Errorf("%d != %d", n, len(s))
+		}
+	}
+
+	// We expect the oldest lines to be dropped and the incomplete line to
+	// be held back.
+	want := []string{"two", "three", "four"}
+	if got := r.Lines(); !reflect.DeepEqual(got, want) {
+		t.Errorf("%v != %v", got, want)
+	}
+
+	r.Write([]byte("\n"))
+	want = []string{"three", "four", "five"}
+	if got := r.Lines(); !reflect.DeepEqual(got, want) {
+		t.Errorf("%v != %v", got, want)
+	}
+}
+
+func TestLogRingLongLine(t *testing.T) {
+	r := newLogRing(1)
+	r.Write([]byte(strings.Repeat("a", maxLogLineBytes+10) + "\n"))
+
+	lines := r.Lines()
+	if got, want := len(lines[0]), maxLogLineBytes; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+}
+
+func TestLogsHandler(t *testing.T) {
+	r := newLogRing(2)
+	r.Write([]byte("failed to parse file\nreconnecting\n"))
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/logs", nil)
+	logsHandler(r).ServeHTTP(rec, req)
+
+	if got, want := rec.Body.String(), "failed to parse file\nreconnecting\n"; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+}
@@ -2,10 +2,17 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
 	"log"
+	"math/rand"
+	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
 
 	"github.com/spf13/viper"
@@ -14,13 +21,41 @@ import (
 var (
 	// GitRevision is set by the build process
 	GitRevision string
+
+	// startTime records when the process started
+	startTime = time.Now()
+
+	// debug enables verbose logging and is set from the configuration file
+	debug bool
+
+	// listFieldsFlag lists the fields populated by the source and exits
+	listFieldsFlag = flag.Bool("list-fields", false, "list the fields populated in a scan of aircraftJSON and exit")
+
+	// consumeFlag prints the messages published to the exchange
+	consumeFlag = flag.Bool("consume", false, "print messages published to amqpExchange until interrupted")
+
+	// jsonIndentFlag pretty prints the messages printed by -consume
+	jsonIndentFlag = flag.Int("json-indent", 0, "indent messages printed by -consume by this many spaces, zero prints compact JSON")
 )
 
+// sourceConfig describes an additional receiver whose aircraft are merged
+// into the data Store.
+type sourceConfig struct {
+	AircraftJSON string
+	StationName  string
+	StationID    string
+	StationLat   *float64
+	StationLon   *float64
+}
+
 func main() {
+	rand.Seed(time.Now().UnixNano())
+	flag.Parse()
+
 	viper.SetConfigName("config")
 	viper.AddConfigPath("/etc/go-adsb-console/")
 	viper.AddConfigPath(".")
-	err := viper.ReadInConfig()
+	err := readConfig()
 	if err != nil {
 		log.Fatalln(err.Error())
 	}
@@ -30,6 +65,25 @@ func main() {
 	}
 	aircraftJSON := viper.GetString("aircraftJSON")
 
+	// List the fields populated by the source and exit if requested
+	if *listFieldsFlag {
+		read := func() (Scan, error) { return readScan(aircraftJSON, 0) }
+		if isRemote(aircraftJSON) {
+			read = func() (Scan, error) {
+				return fetchScan(&http.Client{Timeout: httpSourceTimeout}, aircraftJSON, 0, nil)
+			}
+		}
+		scan, err := read()
+		if err != nil {
+			log.Fatalln(err)
+		}
+		err = listFields(os.Stdout, scan)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
 	if viper.IsSet("monitorDuration") == false {
 		log.Fatalln("Configuration file doesn't include a value for monitorDuration.")
 	}
@@ -40,11 +94,25 @@ func main() {
 	}
 	updateDuration := viper.GetDuration("updateDuration")
 
+	// The intervals may be changed at runtime through the HTTP endpoints
+	monitorInterval := newInterval(monitorDuration)
+	updateInterval := newInterval(updateDuration)
+
 	if viper.IsSet("maxAircraftAge") == false {
 		log.Fatalln("Configuration file doesn't include a value for maxAircraftAge.")
 	}
 	maxAircraftAge := viper.GetDuration("maxAircraftAge")
 
+	categoryMaxAge := map[string]time.Duration{}
+	for category, age := range viper.GetStringMapString("categoryMaxAge") {
+		d, err := time.ParseDuration(age)
+		if err != nil {
+			log.Fatalf("Configuration file includes an invalid value for categoryMaxAge.%s: %s\n", category, err)
+		}
+		// viper lowercases keys but categories are reported in upper case
+		categoryMaxAge[strings.ToUpper(category)] = d
+	}
+
 	if viper.IsSet("amqpURL") == false {
 		log.Fatalln("Configuration file doesn't include a value for amqpURL.")
 	}
@@ -54,17 +122,83 @@ func main() {
 		log.Fatalln("Configuration file doesn't include a value for amqpExchange.")
 	}
 	amqpExchange := viper.GetString("amqpExchange")
+	err = validateExchangeName(amqpExchange)
+	if err != nil {
+		log.Fatalln("Configuration file includes an invalid value for amqpExchange:", err)
+	}
 
 	if viper.IsSet("stationName") == false {
 		log.Fatalln("Configuration file doesn't include a value for stationName.")
 	}
 	stationName := viper.GetString("stationName")
+	if id := viper.GetString("stationID"); id != "" {
+		stationIDs[stationName] = id
+	}
+
+	debug = viper.GetBool("debug")
+	httpAddr := viper.GetString("httpAddr")
+	viper.SetDefault("staleSourceAfter", time.Second*60)
+	tcpSinkAddr := viper.GetString("tcpSinkAddr")
+	replayLog := viper.GetString("replayLog")
+
+	sources := []sourceConfig{}
+	err = viper.UnmarshalKey("sources", &sources)
+	if err != nil {
+		log.Fatalln("Configuration file includes an invalid value for sources:", err)
+	}
+	for _, src := range sources {
+		if src.AircraftJSON == "" || src.StationName == "" {
+			log.Fatalln("Configuration file includes a source without an aircraftJSON or stationName.")
+		}
+		if src.StationID != "" {
+			stationIDs[src.StationName] = src.StationID
+		}
+		if (src.StationLat == nil) != (src.StationLon == nil) {
+			log.Fatalln("Configuration file includes a source with only one of stationLat and stationLon.")
+		}
+	}
+
+	keyCase, err := parseKeyCase(viper.GetString("keyCase"))
+	if err != nil {
+		log.Fatalln("Configuration file includes an invalid value for keyCase:", err)
+	}
+
+	publishMode, err := parsePublishMode(viper.GetString("publishMode"))
+	if err != nil {
+		log.Fatalln("Configuration file includes an invalid value for publishMode:", err)
+	}
+
+	distanceMethod, err := parseDistanceMethod(viper.GetString("distanceMethod"))
+	if err != nil {
+		log.Fatalln("Configuration file includes an invalid value for distanceMethod:", err)
+	}
+
+	routeByEmergency := viper.GetBool("routeByEmergency")
+	exchangeKind, err := parseExchangeKind(viper.GetString("exchangeKind"), routeByEmergency)
+	if err != nil {
+		log.Fatalln("Configuration file includes an invalid value for exchangeKind:", err)
+	}
+	durable := viper.GetBool("amqpDurable")
+
+	// Record the PID for init systems that need it
+	if pidFile := viper.GetString("pidFile"); pidFile != "" {
+		err = writePidFile(pidFile)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		defer func() {
+			err := removePidFile(pidFile)
+			if err != nil {
+				log.Println("failed to remove pid file:", err)
+			}
+		}()
+	}
 
 	// Handle OS signals gracefully
 	ctx := context.Background()
 	ctx, cancel := context.WithCancel(ctx)
 	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
 	defer func() {
 		signal.Stop(c)
 		cancel()
@@ -78,21 +212,394 @@ func main() {
 		}
 	}()
 
+	// Print the messages published to the exchange and exit if requested
+	if *consumeFlag {
+		if *jsonIndentFlag < 0 {
+			log.Fatalln("invalid value for -json-indent, expected zero or more spaces")
+		}
+		indent := strings.Repeat(" ", *jsonIndentFlag)
+		err := consume(ctx, amqpURL, amqpExchange, exchangeKind, indent, durable, os.Stdout)
+		if err != nil {
+			log.Fatalln("failed to consume messages:", err)
+		}
+		return
+	}
+
+	movedFields, err := parseMovedFields(viper.GetStringSlice("movedFields"))
+	if err != nil {
+		log.Fatalln("Configuration file includes an invalid value for movedFields:", err)
+	}
+
+	reconcileKeys, err := parseKeyReconcile(viper.GetString("reconcileKeys"))
+	if err != nil {
+		log.Fatalln("Configuration file includes an invalid value for reconcileKeys:", err)
+	}
+
 	// Create an in-memory store to hold the latest aircraft positions
+	viper.SetDefault("trackOnlyWithPosition", true)
 	var store = Store{
-		aircraft: make(map[string]AircraftPos),
-		lock:     new(sync.Mutex),
+		aircraft:    make(map[string]AircraftPos),
+		lock:        new(sync.RWMutex),
+		minMessages: viper.GetInt("minMessages"),
+		minNacP:     viper.GetInt("minNacp"),
+		minNic:      viper.GetInt("minNic"),
+
+		allowNoPosition: viper.GetBool("allowNoPosition"),
+		dedupeMlat:      viper.GetBool("dedupeMlat"),
+		identityChanges: !viper.GetBool("trackOnlyWithPosition"),
+		noPurge:         viper.GetBool("noPurge"),
+
+		movedFields: movedFields,
+		moveThreshold: moveThreshold{
+			metres:  viper.GetFloat64("moveThresholdMetres"),
+			feet:    viper.GetFloat64("moveThresholdFeet"),
+			degrees: viper.GetFloat64("moveThresholdDegrees"),
+		},
+
+		categoryMaxAge: categoryMaxAge,
+		missingGrace:   viper.GetDuration("missingGrace"),
+
+		maxPositionStaleness: viper.GetDuration("maxPositionStaleness"),
+
+		rejectTeleportFraction: viper.GetFloat64("rejectTeleportFraction"),
+
+		reconcileKeys: reconcileKeys,
+	}
+	publishDebounce := viper.GetDuration("publishDebounce")
+	if publishDebounce > 0 {
+		store.changes = make(chan struct{}, 1)
+	}
+	if store.rejectTeleportFraction < 0 || store.rejectTeleportFraction > 1 {
+		log.Fatalln("Configuration file includes an invalid value for rejectTeleportFraction:", store.rejectTeleportFraction)
+	}
+
+	// Start serving metrics if an address has been configured
+	if httpAddr != "" {
+		info := serverInfo{
+			GitRevision: GitRevision,
+			GoVersion:   runtime.Version(),
+			StartTime:   startTime,
+			Source:      aircraftJSON,
+			SourceType:  "file",
+			Sinks:       []string{"amqp"},
+			StationName: stationName,
+		}
+		if replayLog != "" {
+			info.Source, info.SourceType = replayLog, "replay"
+		}
+		if isRemote(aircraftJSON) && replayLog == "" {
+			info.SourceType = "http"
+		}
+		if isSocket(aircraftJSON) && replayLog == "" {
+			info.SourceType = "socket"
+		}
+		if tcpSinkAddr != "" {
+			info.Sinks = append(info.Sinks, "tcp")
+		}
+		if viper.GetString("execSink") != "" {
+			info.Sinks = append(info.Sinks, "exec")
+		}
+		if viper.GetString("webhookURL") != "" {
+			info.Sinks = append(info.Sinks, "webhook")
+		}
+
+		serverOpts := serverOptions{
+			certFile: viper.GetString("httpTLSCert"),
+			keyFile:  viper.GetString("httpTLSKey"),
+			authUser: viper.GetString("httpAuthUser"),
+			authPass: viper.GetString("httpAuthPass"),
+
+			staleAfter: viper.GetDuration("staleSourceAfter"),
+		}
+		if (serverOpts.certFile == "") != (serverOpts.keyFile == "") {
+			log.Fatalln("Configuration file must include both httpTLSCert and httpTLSKey, or neither.")
+		}
+		if viper.GetBool("runtimeIntervals") {
+			if serverOpts.authUser == "" {
+				log.Fatalln("Configuration file includes runtimeIntervals without httpAuthUser.")
+			}
+			serverOpts.monitorInterval, serverOpts.updateInterval = monitorInterval, updateInterval
+		}
+
+		// Keep recent log lines so that they can be read over HTTP
+		if n := viper.GetInt("logBufferLines"); n > 0 {
+			if serverOpts.authUser == "" {
+				log.Fatalln("Configuration file includes logBufferLines without httpAuthUser.")
+			}
+			serverOpts.logs = newLogRing(n)
+			err = captureLogs(serverOpts.logs)
+			if err != nil {
+				log.Fatalln("failed to capture logs:", err)
+			}
+		}
+
+		err = startServer(ctx, httpAddr, info, serverOpts)
+		if err != nil {
+			log.Fatalln("failed to start server:", err)
+		}
 	}
 
-	// Start monitoring for aircraft positions
-	err = startMonitor(ctx, aircraftJSON, monitorDuration, maxAircraftAge, &store, stationName)
+	viper.SetDefault("maxScanBytes", 8*1024*1024)
+	viper.SetDefault("readAttempts", 3)
+	viper.SetDefault("readRetryDelay", 50*time.Millisecond)
+	viper.SetDefault("maxBadScans", 10)
+	viper.SetDefault("expectFieldsScans", 10)
+	viper.SetDefault("fetchAttempts", 3)
+	viper.SetDefault("fetchRetryDelay", 500*time.Millisecond)
+	monitorOpts := monitorOptions{
+		maxScanBytes: viper.GetInt64("maxScanBytes"),
+		readAttempts: viper.GetInt("readAttempts"),
+		retryDelay:   viper.GetDuration("readRetryDelay"),
+		logCoverage:  viper.GetBool("verboseDecode"),
+		waitQuietly:  viper.GetBool("waitForSource"),
+		dumpDir:      viper.GetString("badScanDir"),
+		maxDumps:     viper.GetInt("maxBadScans"),
+		interval:     monitorInterval,
+		expectFields: viper.GetStringSlice("expectFields"),
+		expectScans:  viper.GetInt("expectFieldsScans"),
+
+		fetchAttempts:   viper.GetInt("fetchAttempts"),
+		fetchRetryDelay: viper.GetDuration("fetchRetryDelay"),
+	}
+
+	err = validateFields(monitorOpts.expectFields)
 	if err != nil {
-		log.Fatalln("failed to start monitor:", err)
+		log.Fatalln("Configuration file includes an invalid value for expectFields:", err)
+	}
+	if len(monitorOpts.expectFields) > 0 && monitorOpts.expectScans < 1 {
+		log.Fatalln("Configuration file includes an invalid value for expectFieldsScans, expected at least one scan.")
+	}
+
+	// Replay a recorded log instead of monitoring if one has been configured
+	if replayLog != "" {
+		viper.SetDefault("replaySpeed", 1.0)
+		err = startReplay(ctx, replayLog, viper.GetFloat64("replaySpeed"), &store, stationName)
+		if err != nil {
+			log.Fatalln("failed to start replay:", err)
+		}
+	} else {
+		// Start monitoring for aircraft positions
+		err = startMonitor(ctx, aircraftJSON, monitorDuration, maxAircraftAge, &store, stationName, monitorOpts)
+		if err != nil {
+			log.Fatalln("failed to start monitor:", err)
+		}
+
+		// Merge aircraft heard on the UAT band if enabled
+		uatJSON := viper.GetString("uatJSON")
+		if uatJSON == "" && viper.GetBool("uat") {
+			uatJSON = dump978Path
+		}
+		if uatJSON != "" {
+			err = startMonitor(ctx, uatJSON, monitorDuration, maxAircraftAge, &store, stationName, monitorOpts)
+			if err != nil {
+				log.Fatalln("failed to start UAT monitor:", err)
+			}
+		}
+
+		// Merge aircraft from any additional receivers
+		for _, src := range sources {
+			err = startMonitor(ctx, src.AircraftJSON, monitorDuration, maxAircraftAge, &store, src.StationName, monitorOpts)
+			if err != nil {
+				log.Fatalln("failed to start monitor:", err)
+			}
+		}
 	}
 
 	// Start sending updates to RabbitMQ
+	viper.SetDefault("idleJitter", 0.05)
+	opts := publishOptions{
+		mode:          publishMode,
+		refreshEvery:  viper.GetDuration("refreshEvery"),
+		flushOnEmpty:  viper.GetDuration("flushOnEmpty"),
+		keyCase:       keyCase,
+		statsEvery:    viper.GetDuration("statsEvery"),
+		sampleRate:    viper.GetFloat64("sampleRate"),
+		updateJitter:  viper.GetDuration("updateJitter"),
+		sequence:      viper.GetBool("sequenceNumbers"),
+		compressAbove: viper.GetInt("compressAbove"),
+
+		exchangeKind:     exchangeKind,
+		durable:          durable,
+		persistent:       viper.GetBool("amqpPersistent"),
+		routeByEmergency: routeByEmergency,
+		includeSource:    viper.GetBool("includeSource"),
+		publishWorkers:   viper.GetInt("publishWorkers"),
+
+		interval: updateInterval,
+
+		idleAfter:  viper.GetDuration("idleAfter"),
+		idleJitter: viper.GetFloat64("idleJitter"),
+
+		deltaFields: viper.GetBool("deltaFields"),
+		summary:     viper.GetBool("publishSummary"),
+	}
+	opts.debounce = publishDebounce
+	if viper.GetBool("publisherConfirms") {
+		viper.SetDefault("confirmTimeout", time.Second*5)
+		opts.confirmTimeout = viper.GetDuration("confirmTimeout")
+		if opts.confirmTimeout <= 0 {
+			log.Fatalln("Configuration file includes an invalid value for confirmTimeout, expected a positive duration.")
+		}
+	}
+	opts.maxMessageBytes = viper.GetInt("maxMessageBytes")
+	if opts.maxMessageBytes < 0 {
+		log.Fatalln("Configuration file includes an invalid value for maxMessageBytes:", opts.maxMessageBytes)
+	}
+	if viper.GetBool("airlineLookup") {
+		opts.airlines = newAirlineLookup(viper.GetStringMapString("airlines"))
+	}
+
+	if opts.idleJitter < 0 {
+		log.Fatalln("Configuration file includes an invalid value for idleJitter, expected a distance of zero or more.")
+	}
+
+	if opts.publishWorkers < 0 || opts.publishWorkers > maxPublishWorkers {
+		log.Fatalf("Configuration file includes an invalid value for publishWorkers, expected a value between 0 and %d.\n", maxPublishWorkers)
+	}
+
+	// Add custom tags to aircraft if a lookup file has been configured,
+	// reloading it on SIGHUP
+	if tagsCSV := viper.GetString("tagsCSV"); tagsCSV != "" {
+		opts.tags, err = loadTags(tagsCSV, viper.GetStringSlice("tagFields"))
+		if err != nil {
+			log.Fatalln("failed to load tags:", err)
+		}
+
+		hup := make(chan os.Signal, 1)
+		signal.Notify(hup, syscall.SIGHUP)
+		go func() {
+			defer signal.Stop(hup)
+			for {
+				select {
+				case <-hup:
+					err := opts.tags.reload()
+					if err != nil {
+						log.Println("failed to reload tags:", err)
+						continue
+					}
+					log.Printf("reloaded tags from %s\n", tagsCSV)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	if viper.GetBool("qualityScore") || viper.IsSet("qualityWeights") {
+		weights := map[string]float64{}
+		err = viper.UnmarshalKey("qualityWeights", &weights)
+		if err != nil {
+			log.Fatalln("Configuration file includes an invalid value for qualityWeights:", err)
+		}
+		w, err := parseQualityWeights(weights)
+		if err != nil {
+			log.Fatalln("Configuration file includes an invalid value for qualityWeights:", err)
+		}
+		opts.quality = &w
+	}
+
+	if threshold := viper.GetInt("breakerThreshold"); threshold > 0 {
+		viper.SetDefault("breakerCoolDown", 30*time.Second)
+		opts.breaker = &breaker{threshold: threshold, coolDown: viper.GetDuration("breakerCoolDown")}
+	}
+
+	if opts.sampleRate < 0 || opts.sampleRate > 1 {
+		log.Fatalln("Configuration file includes an invalid value for sampleRate, expected a value between 0 and 1.")
+	}
+
+	if viper.IsSet("stationLat") && viper.IsSet("stationLon") {
+		opts.station = &location{
+			Lat: viper.GetFloat64("stationLat"),
+			Lon: viper.GetFloat64("stationLon"),
+		}
+	}
+
+	// Prefer the location the decoder has been configured with, if known
+	if receiverJSON := viper.GetString("receiverJSON"); receiverJSON != "" {
+		r, err := readReceiver(receiverJSON)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			log.Fatalln("failed to read receiver:", err)
+		}
+		if err == nil {
+			log.Printf("receiver version %s\n", r.Version)
+			loc, err := r.location()
+			if err != nil {
+				log.Printf("%s, using stationLat and stationLon\n", err)
+			} else {
+				opts.station = &loc
+			}
+		}
+	}
+
+	for _, src := range sources {
+		if src.StationLat == nil {
+			continue
+		}
+		if opts.stations == nil {
+			opts.stations = map[string]location{}
+		}
+		opts.stations[src.StationName] = location{Lat: *src.StationLat, Lon: *src.StationLon}
+	}
+
+	viper.SetDefault("rangeHysteresis", 2.0)
+	opts.distanceMethod = distanceMethod
+	opts.maxRange = viper.GetFloat64("maxRange")
+	opts.rangeHysteresis = viper.GetFloat64("rangeHysteresis")
+	if opts.maxRange > 0 && opts.station == nil && len(opts.stations) == 0 {
+		log.Fatalln("Configuration file includes maxRange without stationLat and stationLon for the station or any of its sources.")
+	}
+
+	// Record published messages in an audit log if one has been configured
+	viper.SetDefault("auditMaxBytes", 100*1024*1024)
+	if auditFile := viper.GetString("auditFile"); auditFile != "" {
+		audit, err := openAuditLog(auditFile, viper.GetInt64("auditMaxBytes"))
+		if err != nil {
+			log.Fatalln("failed to start audit log:", err)
+		}
+		defer audit.Close()
+		opts.audit = audit
+	}
+
+	// Start streaming updates to TCP clients if an address has been configured
+	if tcpSinkAddr != "" {
+		sink, err := startTCPSink(ctx, tcpSinkAddr, &store, keyCase)
+		if err != nil {
+			log.Fatalln("failed to start TCP sink:", err)
+		}
+		opts.sinks = append(opts.sinks, sink)
+	}
+
+	// Feed updates to an external command if one has been configured
+	if execSink := viper.GetString("execSink"); execSink != "" {
+		opts.sinks = append(opts.sinks, startExecSink(ctx, execSink, time.Second*30))
+	}
+
+	// Post updates to a webhook if one has been configured
+	viper.SetDefault("webhookTimeout", time.Second*10)
+	viper.SetDefault("webhookAttempts", 3)
+	if webhookURL := viper.GetString("webhookURL"); webhookURL != "" {
+		webhookOpts := webhookOptions{
+			contentType: viper.GetString("webhookContentType"),
+			headers:     viper.GetStringMapString("webhookHeaders"),
+			timeout:     viper.GetDuration("webhookTimeout"),
+			batchSize:   viper.GetInt("webhookBatchSize"),
+			attempts:    viper.GetInt("webhookAttempts"),
+			retryDelay:  time.Second,
+			flushEvery:  viper.GetDuration("flushEvery"),
+			maxBytes:    opts.maxMessageBytes,
+		}
+		if webhookOpts.batchSize < 0 {
+			log.Fatalln("Configuration file includes an invalid value for webhookBatchSize:", webhookOpts.batchSize)
+		}
+		opts.sinks = append(opts.sinks, startWebhookSink(ctx, webhookURL, webhookOpts))
+	}
+
 	for n := 1; n <= 10; n++ {
-		err = startUpdater(ctx, amqpURL, amqpExchange, updateDuration, stationName, &store)
+		err = startUpdater(ctx, amqpURL, amqpExchange, updateDuration, stationName, &store, opts)
+		var xe *exchangeError
+		if errors.As(err, &xe) && xe.permanent() {
+			log.Fatalln("failed to start updater:", err)
+		}
 		if err != nil {
 			log.Printf("failed to start updater: attempt %d/%d: %s\n", n, 10, err)
 			time.Sleep(time.Second * time.Duration(n))
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"expvar"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+// Reasons recorded against the droppedAircraft counter.
+const (
+	dropNoPosition    = "no_position"
+	dropNoHex         = "no_hex"
+	dropFewMessages   = "few_messages"
+	dropLowAccuracy   = "low_accuracy"
+	dropStalePosition = "stale_position"
+)
+
+// droppedAircraft counts the aircraft that were present in a scan but not
+// stored, keyed by the reason they were dropped.
+var droppedAircraft = expvar.NewMap("dropped_aircraft")
+
+// Counts of aircraft added to and removed from the data Store.
+var (
+	aircraftAdded   = expvar.NewInt("aircraft_added")
+	aircraftRemoved = expvar.NewInt("aircraft_removed")
+)
+
+// scansRejected counts scans rejected because their aircraft had moved
+// implausibly.
+var scansRejected = expvar.NewInt("scans_rejected")
+
+// keysReconciled counts aircraft reconciled with the entry held against
+// their hex code or callsign.
+var keysReconciled = expvar.NewInt("keys_reconciled")
+
+// messagesTooLarge counts messages dropped because they were larger than
+// maxMessageBytes.
+var messagesTooLarge = expvar.NewInt("messages_too_large")
+
+// dropTooLarge counts and logs a message of n bytes dropped for being too
+// large.
+func dropTooLarge(n int) {
+	messagesTooLarge.Add(1)
+	fmt.Fprintf(os.Stderr, "dropping message of %d bytes, larger than maxMessageBytes\n", n)
+}
+
+// lastPublished records when a message was last accepted by the broker.
+var lastPublished = &timestamp{t: startTime}
+
+func init() {
+	expvar.Publish("seconds_since_publish", expvar.Func(func() interface{} {
+		return lastPublished.since(time.Now())
+	}))
+	expvar.Publish("message_rate", expvar.Func(func() interface{} {
+		rate, _ := messageRates.total()
+		return rate
+	}))
+	expvar.Publish("aircraft_churn_per_minute", expvar.Func(func() interface{} {
+		return churnRate(aircraftAdded.Value(), aircraftRemoved.Value(), time.Since(startTime))
+	}))
+}
+
+// churnRate returns the average number of aircraft added and removed per
+// minute over the elapsed period.
+func churnRate(added, removed int64, elapsed time.Duration) float64 {
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(added+removed) / elapsed.Minutes()
+}
+
+// timestamp is a time that is safe to update and read concurrently.
+type timestamp struct {
+	lock sync.Mutex
+	t    time.Time
+}
+
+// set records t as the latest time.
+func (ts *timestamp) set(t time.Time) {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	ts.t = t
+}
+
+// since returns the number of seconds between the latest time and now.
+func (ts *timestamp) since(now time.Time) float64 {
+	ts.lock.Lock()
+	defer ts.lock.Unlock()
+	return now.Sub(ts.t).Seconds()
+}
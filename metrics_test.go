@@ -0,0 +1,58 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTimestamp(t *testing.T) {
+	start := time.Now()
+	ts := &timestamp{t: start}
+
+	// We expect the time since to grow until a new time is set.
+	if got, want := ts.since(start.Add(time.Second*5)), 5.0; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+	if got, want := ts.since(start.Add(time.Second*30)), 30.0; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+
+	ts.set(start.Add(time.Second * 30))
+	if got, want := ts.since(start.Add(time.Second*31)), 1.0; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+}
+
+func TestChurnCounters(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	added, removed := aircraftAdded.Value(), aircraftRemoved.Value()
+
+	a1 := Aircraft{Hex: "a1", Flight: "A", Lat: 1, Lon: 1}
+	a2 := Aircraft{Hex: "a2", Flight: "B", Lat: 2, Lon: 2}
+	scan := Scan{Aircraft: []Aircraft{a1, a2}}
+	updateAircraft(scan, &store, "dummy station")
+	purgeAircraft(scan, &store, time.Minute)
+
+	// Moving an aircraft already in the store doesn't count as an add.
+	a1.Lat = 1.5
+	scan = Scan{Aircraft: []Aircraft{a1}}
+	updateAircraft(scan, &store, "dummy station")
+	purgeAircraft(scan, &store, time.Minute)
+
+	if got, want := aircraftAdded.Value()-added, int64(2); got != want {
+		t.Errorf("added: %d != %d", got, want)
+	}
+	if got, want := aircraftRemoved.Value()-removed, int64(1); got != want {
+		t.Errorf("removed: %d != %d", got, want)
+	}
+}
+
+func TestChurnRate(t *testing.T) {
+	if got, want := churnRate(30, 30, time.Minute*2), 30.0; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+	if got, want := churnRate(30, 30, 0), 0.0; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+}
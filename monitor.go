@@ -4,57 +4,301 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"expvar"
 	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
 	"os"
+	"path/filepath"
 	"time"
 )
 
+// Values reported by the source_status metric.
+const (
+	sourceOK               = "ok"
+	sourceNotFound         = "not_found"
+	sourcePermissionDenied = "permission_denied"
+	sourceError            = "error"
+)
+
+// watchedPollInterval is how often a source whose changes are notified is
+// still polled, in case a change is missed.
+var watchedPollInterval = time.Second * 30
+
+// errScanTooLarge is returned when a scan exceeds the configured size limit.
+var errScanTooLarge = errors.New("scan exceeds maximum size")
+
+// monitorError records the operation and path of a failed attempt to read
+// the source. Errors are formatted with consistent op and path fields so
+// that logs can be grouped by operation.
+type monitorError struct {
+	op   string // the operation that failed, e.g. stat, read, open, parse or fetch
+	path string // the path of the source
+	err  error
+}
+
+func (e *monitorError) Error() string {
+	return fmt.Sprintf("monitor: op=%s path=%s: %v", e.op, e.path, e.err)
+}
+
+func (e *monitorError) Unwrap() error {
+	return e.err
+}
+
+// parseError is returned when a scan can't be parsed, holding the raw scan
+// so that it can be inspected.
+type parseError struct {
+	raw []byte
+	err error
+}
+
+func (e *parseError) Error() string {
+	return fmt.Sprintf("failed to parse file: %v", e.err)
+}
+
+func (e *parseError) Unwrap() error {
+	return e.err
+}
+
+// newMonitorError wraps err with the operation and path that caused it.
+// The path is removed from errors that already record it so that it isn't
+// repeated in logs.
+func newMonitorError(op, path string, err error) error {
+	var pe *os.PathError
+	if errors.As(err, &pe) && pe.Path == path {
+		err = pe.Err
+	}
+	return &monitorError{op: op, path: path, err: err}
+}
+
+// monitorOptions control how the source is read.
+type monitorOptions struct {
+	maxScanBytes int64         // scans larger than this are skipped, zero disables the limit
+	readAttempts int           // attempts made to read a scan before giving up
+	retryDelay   time.Duration // delay before the first retry, doubled for each subsequent retry
+	logCoverage  bool          // log the fields populated in the first scan read
+	waitQuietly  bool          // wait for a missing source to appear without logging errors
+	dumpDir      string        // directory scans that fail to parse are written to, if set
+	maxDumps     int           // maximum number of scans written to dumpDir
+	interval     *interval     // interval between checks of the source, overriding dur if set
+	expectFields []string      // fields warned about if not populated within expectScans
+	expectScans  int           // number of scans in which expectFields must be populated
+
+	fetchAttempts   int           // attempts made to fetch a scan from an HTTP source before giving up
+	fetchRetryDelay time.Duration // delay before the first retry of a fetch, doubled for each subsequent retry
+}
+
+// readRetries counts reads of the source retried after a transient error.
+var readRetries = expvar.NewInt("read_retries")
+
+// sourceStatus reports whether the last attempt to read the source
+// succeeded and, if not, the kind of failure encountered.
+var sourceStatus = expvar.NewString("source_status")
+
+// setSourceStatus records the outcome of the latest attempt to read the
+// source at path.
+func setSourceStatus(path, status string) {
+	sourceStatus.Set(status)
+	sourceHealth.record(path, status, time.Now())
+}
+
 // StartMonitor starts a new Go routine monitoring the provided file for
 // changes changes in aircraft position. Any updates are reflected in the
 // provided data Store. Aircraft in the data Store older than maxAge are
 // removed from the store. An error is returned if the file is inaccessible
 // at the point the monitor is started. Cancelling the provided context
 // will terminate the Go routine.
-func startMonitor(ctx context.Context, path string, dur, maxAge time.Duration, store *Store, station string) error {
+func startMonitor(ctx context.Context, path string, dur, maxAge time.Duration, store *Store, station string, opts monitorOptions) error {
 	if store == nil {
 		return errors.New("no data store provided")
 	}
 
-	ticker := time.NewTicker(dur).C
+	iv := opts.interval
+	if iv == nil {
+		iv = newInterval(dur)
+	}
+	ticker := iv.tick(ctx)
+	sourceHealth.add(path)
 
 	go func() {
 		lastModified := time.Now()
+		errLog := errorLimiter{w: os.Stderr}
+
+		// stream receives scans once the source is found to be a named pipe
+		// or socket
+		var stream chan Scan
+
+		// waiting is set until the source first appears, if waiting quietly
+		waiting := opts.waitQuietly
+
+		// dumps counts the scans written to opts.dumpDir
+		dumps := 0
+
+		// client fetches scans from sources served over HTTP
+		client := &http.Client{Timeout: httpSourceTimeout}
+
+		// cache holds the validators of the last scan fetched over HTTP
+		cache := &validators{}
+
+		// Scans are streamed from Unix domain sockets as they arrive.
+		if isSocket(path) {
+			stream = make(chan Scan)
+			go streamSocket(ctx, path, stream)
+		}
+
+		// schema warns if expected fields are missing from the source
+		schema := newSchemaCheck(opts.expectFields, opts.expectScans)
+
+		// changes notifies changes to a local source as they are made. The
+		// ticker is used until the source is first found, and throughout if
+		// the filesystem doesn't support notifications. If the watch is
+		// lost, as when its directory is removed, the ticker is used until
+		// it can be re-established.
+		var changes <-chan struct{}
+		watchable := !isRemote(path) && !isSocket(path)
+		if watchable {
+			c, err := watchFile(ctx, path)
+			if err != nil {
+				log.Printf("polling %s for changes: %v\n", path, err)
+				watchable = false
+			}
+			changes = c
+		}
+
+		// watched is set once the source is found while changes are notified
+		watched := false
+
+		// polled is when the source was last polled while watched
+		polled := time.Now()
+
+		// readFile reads the local source at path if it has changed since
+		// it was last read.
+		readFile := func() {
+			info, err := os.Stat(path)
+			if waiting && errors.Is(err, os.ErrNotExist) {
+				setSourceStatus(path, sourceNotFound)
+				if opts.waitQuietly {
+					log.Printf("waiting for %s to appear\n", path)
+					opts.waitQuietly = false
+				}
+				return
+			}
+			if err != nil {
+				setSourceStatus(path, sourceErrorKind(err))
+				errLog.print(newMonitorError("stat", path, err))
+				return
+			}
+			waiting = false
+			watched = changes != nil
+
+			// Named pipes don't have meaningful modification times so
+			// scans are read from them as a stream instead.
+			if info.Mode()&os.ModeNamedPipe != 0 {
+				stream = make(chan Scan)
+				go streamScans(ctx, path, stream)
+				return
+			}
+
+			if sourceChanged(info.ModTime(), lastModified, time.Now()) {
+				lastModified = info.ModTime()
+
+				scan, err := retryRead(func() (Scan, error) {
+					return readScan(path, opts.maxScanBytes)
+				}, opts.readAttempts, opts.retryDelay)
+				if err != nil {
+					setSourceStatus(path, sourceErrorKind(err))
+					errLog.print(err)
+
+					var pe *parseError
+					if opts.dumpDir != "" && dumps < opts.maxDumps && errors.As(err, &pe) {
+						dumps++
+						name, err := dumpScan(opts.dumpDir, pe.raw, time.Now())
+						if err != nil {
+							errLog.print(err)
+						} else {
+							log.Printf("wrote scan that failed to parse to %s\n", name)
+						}
+					}
+					return
+				}
+
+				setSourceStatus(path, sourceOK)
+				errLog.reset()
+
+				if opts.logCoverage {
+					log.Printf("field coverage for %s: %s\n", path, formatCoverage(fieldCoverage(scan), len(scan.Aircraft)))
+					opts.logCoverage = false
+				}
+
+				scan.source = path
+				schema.warn(path, scan)
+				applyScan(scan, store, station, maxAge)
+			}
+		}
 
 		for {
 			select {
 			case <-ticker:
-				info, err := os.Stat(path)
-				if err != nil {
-					fmt.Fprintf(os.Stderr, "failed to stat file: %v\n", err)
+				if stream != nil {
 					continue
 				}
 
-				if info.ModTime().After(lastModified) {
-					lastModified = info.ModTime()
+				// Watched sources are still polled, less often, in case a
+				// change isn't notified.
+				if watched && time.Since(polled) < watchedPollInterval {
+					continue
+				}
+				polled = time.Now()
 
-					f, err := os.Open(path)
-					if err != nil {
-						fmt.Fprintf(os.Stderr, "failed to open file: %v\n", err)
+				if isRemote(path) {
+					scan, err := retryFetch(func() (Scan, error) {
+						return fetchScan(client, path, opts.maxScanBytes, cache)
+					}, opts.fetchAttempts, opts.fetchRetryDelay)
+					if errors.Is(err, errNotModified) {
+						setSourceStatus(path, sourceOK)
+						errLog.reset()
+						continue
 					}
-
-					dec := json.NewDecoder(f)
-					scan := Scan{}
-					err = dec.Decode(&scan)
 					if err != nil {
-						fmt.Fprintf(os.Stderr, "failed to parse file: %v\n", err)
+						setSourceStatus(path, sourceError)
+						errLog.print(err)
+						continue
 					}
 
-					f.Close()
+					setSourceStatus(path, sourceOK)
+					errLog.reset()
 
-					updateAircraft(scan, store, station)
-					purgeAircraft(scan, store, maxAge)
+					scan.source = path
+					schema.warn(path, scan)
+					applyScan(scan, store, station, maxAge)
+					continue
 				}
 
+				if watchable && changes == nil {
+					if c, err := watchFile(ctx, path); err == nil {
+						changes = c
+					}
+				}
+				readFile()
+
+			case _, ok := <-changes:
+				// Fall back to polling if the watch fails.
+				if !ok {
+					changes, watched = nil, false
+					continue
+				}
+				if stream == nil {
+					readFile()
+				}
+
+			case scan := <-stream:
+				setSourceStatus(path, sourceOK)
+				scan.source = path
+				schema.warn(path, scan)
+				applyScan(scan, store, station, maxAge)
+
 			case <-ctx.Done():
 				return
 			}
@@ -63,3 +307,197 @@ func startMonitor(ctx context.Context, path string, dur, maxAge time.Duration, s
 
 	return nil
 }
+
+// sourceChanged reports whether a source modified at modTime has changed
+// since lastModified. If the clock has stepped backwards lastModified may
+// be in the future, in which case any change to modTime is treated as new
+// so that the source isn't ignored until the clock catches up.
+func sourceChanged(modTime, lastModified, now time.Time) bool {
+	if lastModified.After(now) {
+		return !modTime.Equal(lastModified)
+	}
+	return modTime.After(lastModified)
+}
+
+// streamScans decodes a stream of scans from the named pipe at path and
+// sends them to scans. The pipe is reopened whenever the writer closes it
+// or sends data that can't be decoded. Cancelling the provided context
+// stops the stream once the current read returns.
+func streamScans(ctx context.Context, path string, scans chan<- Scan) {
+	errLog := errorLimiter{w: os.Stderr}
+
+	for ctx.Err() == nil {
+		f, err := os.Open(path)
+		if err != nil {
+			errLog.print(newMonitorError("open", path, err))
+			time.Sleep(time.Second)
+			continue
+		}
+
+		err = decodeScans(ctx, f, scans, &errLog)
+		f.Close()
+		if ctx.Err() != nil {
+			return
+		}
+
+		if err != io.EOF {
+			errLog.print(newMonitorError("parse", path, err))
+		}
+	}
+}
+
+// decodeScans decodes a stream of scans from r and sends them to scans,
+// until the stream ends or can't be decoded, or the context is cancelled.
+// The error that ended the stream is returned, io.EOF if it ended cleanly.
+func decodeScans(ctx context.Context, r io.Reader, scans chan<- Scan, errLog *errorLimiter) error {
+	dec := json.NewDecoder(r)
+	for {
+		scan := Scan{}
+		err := dec.Decode(&scan)
+		if err != nil {
+			return err
+		}
+		normalizeScan(&scan)
+		errLog.reset()
+
+		select {
+		case scans <- scan:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// readScan opens and decodes the Scan held in the file at path. Files
+// compressed with gzip are decompressed, detected by their leading magic
+// bytes. Files larger than maxBytes once decompressed are rejected without
+// being decoded, unless maxBytes is zero. Errors are returned as a
+// *monitorError.
+func readScan(path string, maxBytes int64) (Scan, error) {
+	scan := Scan{}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return scan, newMonitorError("open", path, err)
+	}
+	defer f.Close()
+
+	r, err := decompress(f, "")
+	if err != nil {
+		return scan, newMonitorError("read", path, err)
+	}
+
+	scan, err = decodeScan(r, maxBytes)
+	if err != nil {
+		return scan, newMonitorError("read", path, err)
+	}
+	return scan, nil
+}
+
+// decodeScan decodes a Scan from r, reading at most maxBytes. Larger scans
+// are rejected with errScanTooLarge, unless maxBytes is zero. Scans that
+// can't be parsed are rejected with a *parseError.
+func decodeScan(r io.Reader, maxBytes int64) (Scan, error) {
+	scan := Scan{}
+
+	if maxBytes > 0 {
+		r = io.LimitReader(r, maxBytes+1)
+	}
+
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return scan, fmt.Errorf("failed to read file: %w", err)
+	}
+
+	if maxBytes > 0 && int64(len(b)) > maxBytes {
+		return scan, fmt.Errorf("failed to read file: %w of %d bytes", errScanTooLarge, maxBytes)
+	}
+
+	err = json.Unmarshal(b, &scan)
+	if err != nil {
+		return scan, &parseError{raw: b, err: err}
+	}
+	normalizeScan(&scan)
+
+	return scan, nil
+}
+
+// dumpScan writes a raw scan to a file in dir named for the time now, and
+// returns the name of the file.
+func dumpScan(dir string, raw []byte, now time.Time) (string, error) {
+	name := filepath.Join(dir, "scan-"+now.UTC().Format("20060102T150405.000000000")+".json")
+
+	err := ioutil.WriteFile(name, raw, 0644)
+	if err != nil {
+		return name, fmt.Errorf("failed to write scan: %w", err)
+	}
+	return name, nil
+}
+
+// retryRead calls read until it succeeds, returns a permanent error, or
+// has been attempted the given number of times. The delay between attempts
+// doubles after each retry.
+func retryRead(read func() (Scan, error), attempts int, delay time.Duration) (Scan, error) {
+	scan, err := read()
+	for n := 1; n < attempts && err != nil && isTransient(err); n++ {
+		readRetries.Add(1)
+		time.Sleep(delay)
+		delay *= 2
+		scan, err = read()
+	}
+	return scan, err
+}
+
+// isTransient reports whether a failed read of the source may succeed if
+// retried. Missing files, permission errors and oversized scans won't
+// resolve themselves within a single tick.
+func isTransient(err error) bool {
+	return !errors.Is(err, os.ErrNotExist) &&
+		!errors.Is(err, os.ErrPermission) &&
+		!errors.Is(err, errScanTooLarge)
+}
+
+// sourceErrorKind classifies an error encountered reading the source into
+// one of the values reported by the source_status metric.
+func sourceErrorKind(err error) string {
+	switch {
+	case errors.Is(err, os.ErrNotExist):
+		return sourceNotFound
+	case errors.Is(err, os.ErrPermission):
+		return sourcePermissionDenied
+	default:
+		return sourceError
+	}
+}
+
+// errorLimiter writes errors to w, suppressing consecutive repeats of the
+// same error. The number of suppressed repeats is summarised once the
+// error changes or is cleared with reset.
+type errorLimiter struct {
+	w       io.Writer
+	last    string
+	repeats int
+}
+
+// print writes err to the underlying writer unless it repeats the
+// previously printed error.
+func (l *errorLimiter) print(err error) {
+	msg := err.Error()
+	if msg == l.last {
+		l.repeats++
+		return
+	}
+
+	l.reset()
+	l.last = msg
+	fmt.Fprintf(l.w, "%s\n", msg)
+}
+
+// reset summarises any suppressed repeats and clears the last error.
+func (l *errorLimiter) reset() {
+	if l.repeats > 0 {
+		fmt.Fprintf(l.w, "previous error repeated %d times\n", l.repeats)
+	}
+	l.last = ""
+	l.repeats = 0
+}
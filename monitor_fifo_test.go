@@ -0,0 +1,64 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestStartMonitorPipe(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "aircraft.json")
+	err = syscall.Mkfifo(path, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	err = startMonitor(ctx, path, time.Millisecond*10, time.Second*60, &store, "dummy station", monitorOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Opening the pipe for writing blocks until the monitor opens it for
+	// reading.
+	go func() {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer f.Close()
+		f.WriteString(`{"now":1,"aircraft":[{"hex":"a1","flight":"A","lat":1,"lon":2}]}` + "\n")
+		f.WriteString(`{"now":2,"aircraft":[{"hex":"a1","flight":"A","lat":1,"lon":3}]}` + "\n")
+	}()
+
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		store.lock.Lock()
+		pos, ok := store.aircraft["a1"]
+		store.lock.Unlock()
+
+		if ok && pos.aircraft.Lon == 3 {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Error("expected both scans to be read from the pipe")
+}
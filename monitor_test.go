@@ -1,7 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -15,27 +22,409 @@ func TestStartMonitor(t *testing.T) {
 	dur := time.Second * 1
 	maxAge := time.Second * 60
 
-	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.Mutex)}
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
 
 	t.Run("success", func(t *testing.T) {
-		err := startMonitor(ctx, path, dur, maxAge, &store, "dummy station")
+		err := startMonitor(ctx, path, dur, maxAge, &store, "dummy station", monitorOptions{})
 		if err != nil {
 			t.Error(err)
 		}
 	})
 
 	t.Run("invalid store", func(t *testing.T) {
-		err := startMonitor(ctx, path, dur, maxAge, nil, "dummy station")
+		err := startMonitor(ctx, path, dur, maxAge, nil, "dummy station", monitorOptions{})
 		if err == nil {
 			t.Error("expected an error, got none")
 		}
 	})
 
 	t.Run("invalid file", func(t *testing.T) {
-		err := startMonitor(ctx, "data/invalid.no.file", dur, maxAge, &store, "dummy station")
+		err := startMonitor(ctx, "data/invalid.no.file", dur, maxAge, &store, "dummy station", monitorOptions{})
 		if err != nil {
 			t.Error(err)
 		}
 	})
 
 }
+
+func TestReadScanGzip(t *testing.T) {
+	want, err := readScan("data/aircraft.json", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := readScan("data/aircraft.json.gz", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got.Aircraft) != len(want.Aircraft) {
+		t.Fatalf("%d != %d", len(got.Aircraft), len(want.Aircraft))
+	}
+	for i := range got.Aircraft {
+		if got.Aircraft[i] != want.Aircraft[i] {
+			t.Errorf("%+v != %+v", got.Aircraft[i], want.Aircraft[i])
+		}
+	}
+}
+
+func TestDecodeScanMaxBytes(t *testing.T) {
+	body := `{"now":1,"messages":2,"aircraft":[{"hex":"a1","flight":"A","lat":1,"lon":2}]}`
+
+	t.Run("within limit", func(t *testing.T) {
+		scan, err := decodeScan(strings.NewReader(body), int64(len(body)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(scan.Aircraft), 1; got != want {
+			t.Errorf("%d != %d", got, want)
+		}
+	})
+
+	t.Run("oversized", func(t *testing.T) {
+		_, err := decodeScan(strings.NewReader(body), int64(len(body)-1))
+		if !errors.Is(err, errScanTooLarge) {
+			t.Errorf("expected %v, got %v", errScanTooLarge, err)
+		}
+	})
+
+	t.Run("unlimited", func(t *testing.T) {
+		_, err := decodeScan(strings.NewReader(body), 0)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestRetryRead(t *testing.T) {
+	transient := errors.New("failed to read file: input/output error")
+	permanent := fmt.Errorf("failed to open file: %w", os.ErrPermission)
+
+	testCases := []struct {
+		name      string
+		errs      []error
+		attempts  int
+		wantCalls int
+		wantErr   error
+	}{
+		{name: "success", errs: []error{nil}, attempts: 3, wantCalls: 1},
+		{name: "transient then success", errs: []error{transient, nil}, attempts: 3, wantCalls: 2},
+		{name: "transient exhausted", errs: []error{transient, transient, transient}, attempts: 3, wantCalls: 3, wantErr: transient},
+		{name: "permanent", errs: []error{permanent, nil}, attempts: 3, wantCalls: 1, wantErr: permanent},
+		{name: "no retries", errs: []error{transient, nil}, attempts: 0, wantCalls: 1, wantErr: transient},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			retries := readRetries.Value()
+			calls := 0
+			read := func() (Scan, error) {
+				err := tc.errs[calls]
+				calls++
+				return Scan{}, err
+			}
+
+			_, err := retryRead(read, tc.attempts, time.Millisecond)
+			if err != tc.wantErr {
+				t.Errorf("%v != %v", err, tc.wantErr)
+			}
+
+			if calls != tc.wantCalls {
+				t.Errorf("%d != %d", calls, tc.wantCalls)
+			}
+
+			if got, want := readRetries.Value()-retries, int64(tc.wantCalls-1); got != want {
+				t.Errorf("%d != %d", got, want)
+			}
+		})
+	}
+}
+
+func TestErrorLimiter(t *testing.T) {
+	buf := new(bytes.Buffer)
+	l := errorLimiter{w: buf}
+
+	err := errors.New("failed to open file: permission denied")
+	for i := 0; i < 5; i++ {
+		l.print(err)
+	}
+
+	// We expect the repeated error to be logged only once.
+	if got, want := strings.Count(buf.String(), err.Error()), 1; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+
+	// A different error summarises the suppressed repeats before logging.
+	l.print(errors.New("failed to stat file: no such file"))
+
+	want := "failed to open file: permission denied\n" +
+		"previous error repeated 4 times\n" +
+		"failed to stat file: no such file\n"
+	if got := buf.String(); got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+}
+
+func TestSourceErrorKind(t *testing.T) {
+	testCases := []struct {
+		name string
+		err  error
+		want string
+	}{
+		{name: "not found", err: fmt.Errorf("failed to stat file: %w", os.ErrNotExist), want: sourceNotFound},
+		{name: "permission", err: fmt.Errorf("failed to open file: %w", os.ErrPermission), want: sourcePermissionDenied},
+		{name: "other", err: errors.New("failed to parse file"), want: sourceError},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := sourceErrorKind(tc.err); got != tc.want {
+				t.Errorf("%s != %s", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestReadScanErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	invalid := filepath.Join(dir, "invalid.json")
+	err = ioutil.WriteFile(invalid, []byte("{"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		name   string
+		path   string
+		op     string
+		target error
+	}{
+		{name: "missing", path: filepath.Join(dir, "missing.json"), op: "open", target: os.ErrNotExist},
+		{name: "invalid", path: invalid, op: "read"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := readScan(tc.path, 0)
+
+			// We expect errors to carry the operation and path.
+			var me *monitorError
+			if !errors.As(err, &me) {
+				t.Fatalf("expected a *monitorError, got %T: %v", err, err)
+			}
+			if me.op != tc.op || me.path != tc.path {
+				t.Errorf("unexpected op or path: %v", err)
+			}
+
+			// The path is included in the message exactly once.
+			if got, want := strings.Count(err.Error(), tc.path), 1; got != want {
+				t.Errorf("%d != %d: %v", got, want, err)
+			}
+
+			if tc.target != nil && !errors.Is(err, tc.target) {
+				t.Errorf("expected %v to wrap %v", err, tc.target)
+			}
+		})
+	}
+}
+
+func TestSourceChanged(t *testing.T) {
+	now := time.Now()
+
+	testCases := []struct {
+		name         string
+		modTime      time.Time
+		lastModified time.Time
+		now          time.Time
+		want         bool
+	}{
+		{name: "unchanged", modTime: now.Add(-time.Second), lastModified: now.Add(-time.Second), now: now, want: false},
+		{name: "modified", modTime: now, lastModified: now.Add(-time.Second), now: now, want: true},
+		{name: "older", modTime: now.Add(-time.Minute), lastModified: now.Add(-time.Second), now: now, want: false},
+
+		// The clock has stepped back an hour since the source was last
+		// read, so new writes appear older than the last modification.
+		{name: "clock stepped back", modTime: now, lastModified: now.Add(time.Hour), now: now, want: true},
+		{name: "clock stepped back unchanged", modTime: now.Add(time.Hour), lastModified: now.Add(time.Hour), now: now, want: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := sourceChanged(tc.modTime, tc.lastModified, tc.now); got != tc.want {
+				t.Errorf("%v != %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestDecodeScanGroundSpeed(t *testing.T) {
+	testCases := []struct {
+		name string
+		json string
+		want float64
+	}{
+		{name: "gs", json: `{"aircraft":[{"hex":"a1","gs":412.5}]}`, want: 412.5},
+		{name: "speed", json: `{"aircraft":[{"hex":"a1","speed":412}]}`, want: 412},
+		{name: "both", json: `{"aircraft":[{"hex":"a1","gs":412.5,"speed":400}]}`, want: 412.5},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			scan, err := decodeScan(strings.NewReader(tc.json), 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := scan.Aircraft[0].Gs; got != tc.want {
+				t.Errorf("%v != %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStartMonitorWaitForSource(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "aircraft.json")
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	err = startMonitor(ctx, path, time.Millisecond*10, time.Second*60, &store, "dummy station", monitorOptions{waitQuietly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The source appears some time after the monitor starts.
+	time.Sleep(time.Millisecond * 50)
+	err = ioutil.WriteFile(path, []byte(`{"now":1,"aircraft":[{"hex":"a1","flight":"A","lat":1,"lon":2}]}`), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		store.lock.RLock()
+		_, ok := store.aircraft["a1"]
+		store.lock.RUnlock()
+
+		if ok {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Error("expected the source to be read once it appeared")
+}
+
+func TestDecodeScanRegistration(t *testing.T) {
+	b := `{"now": 1, "aircraft": [
+		{"hex": "4ca7b4", "flight": "RYR1AB", "r": "EI-DWF", "t": "B738", "lat": 1, "lon": 1},
+		{"hex": "a1", "flight": "A", "lat": 1, "lon": 1}
+	]}`
+
+	scan, err := decodeScan(strings.NewReader(b), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := scan.Aircraft[0]
+	if a.Reg != "EI-DWF" || a.AcType != "B738" {
+		t.Errorf("unexpected decode: %+v", a)
+	}
+
+	// We expect the registration and type to be published when known.
+	m := newMessage(AircraftPos{aircraft: a}, time.Now())
+	if m.Reg != a.Reg || m.AcType != a.AcType {
+		t.Errorf("registration and type not carried through: %+v", m)
+	}
+
+	body, err := marshalMessage(newMessage(AircraftPos{aircraft: scan.Aircraft[1]}, time.Now()), keyCaseDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"registration", "aircraft_type"} {
+		if strings.Contains(string(body), k) {
+			t.Errorf("expected %q to be omitted from %s", k, body)
+		}
+	}
+}
+
+func TestStartMonitorBadScanDir(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	dumps := filepath.Join(dir, "dumps")
+	err = os.Mkdir(dumps, 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "aircraft.json")
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	opts := monitorOptions{readAttempts: 1, dumpDir: dumps, maxDumps: 1}
+	err = startMonitor(ctx, path, time.Millisecond*10, time.Second*60, &store, "dummy station", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The scan is moved into place so that it isn't read part written.
+	bad := []byte(`{"now":1,"aircraft":[{"hex":"a1",`)
+	time.Sleep(time.Millisecond * 20)
+	err = ioutil.WriteFile(path+".tmp", bad, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Rename(path+".tmp", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// We expect the offending scan to be written as it was read.
+	var got []byte
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		files, err := ioutil.ReadDir(dumps)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(files) > 0 {
+			got, err = ioutil.ReadFile(filepath.Join(dumps, files[0].Name()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Equal(got, bad) {
+				return
+			}
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Errorf("expected the bad scan to be written, got %q", got)
+}
+
+func TestDecodeScanParseError(t *testing.T) {
+	raw := `{"aircraft": [`
+	_, err := decodeScan(strings.NewReader(raw), 0)
+
+	var pe *parseError
+	if !errors.As(err, &pe) {
+		t.Fatalf("expected a *parseError, got %T: %v", err, err)
+	}
+	if got := string(pe.raw); got != raw {
+		t.Errorf("%q != %q", got, raw)
+	}
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// writePidFile writes the PID of the current process to path. An existing
+// file is replaced if the process it names is no longer running, otherwise
+// an error is returned.
+func writePidFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+		if err == nil && processRunning(pid) {
+			return fmt.Errorf("pid file %s names running process %d", path, pid)
+		}
+	}
+
+	err = ioutil.WriteFile(path, []byte(strconv.Itoa(os.Getpid())+"\n"), 0644)
+	if err != nil {
+		return fmt.Errorf("failed to write pid file: %w", err)
+	}
+	return nil
+}
+
+// removePidFile removes the pid file at path, provided it still names the
+// current process.
+func removePidFile(path string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read pid file: %w", err)
+	}
+
+	pid, _ := strconv.Atoi(strings.TrimSpace(string(b)))
+	if pid != os.Getpid() {
+		return fmt.Errorf("pid file %s names process %d", path, pid)
+	}
+
+	return os.Remove(path)
+}
+
+// processRunning reports whether a process with the given PID is running.
+func processRunning(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return p.Signal(syscall.Signal(0)) == nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestPidFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pidfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "go-adsb-console.pid")
+
+	err = writePidFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := strings.TrimSpace(string(b)), strconv.Itoa(os.Getpid()); got != want {
+		t.Errorf("%s != %s", got, want)
+	}
+
+	// We expect a pid file naming a running process not to be replaced.
+	err = writePidFile(path)
+	if err == nil {
+		t.Error("expected an error, got none")
+	}
+
+	err = removePidFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected pid file to be removed: %v", err)
+	}
+}
+
+func TestPidFileStale(t *testing.T) {
+	dir, err := ioutil.TempDir("", "pidfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// A pid file left behind by a process that is no longer running, or
+	// holding garbage, is replaced.
+	for _, content := range []string{"2147483646\n", "not a pid"} {
+		path := filepath.Join(dir, "go-adsb-console.pid")
+		err = ioutil.WriteFile(path, []byte(content), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = writePidFile(path)
+		if err != nil {
+			t.Fatalf("%q: %v", content, err)
+		}
+
+		err = removePidFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// Ranges used to normalise each input to the quality score.
+const (
+	maxNic        = 11    // NIC ranges from 0 (unknown) to 11 (<7.5m)
+	maxNacP       = 11    // NACp ranges from 0 (unknown) to 11 (<3m)
+	maxSil        = 3     // SIL ranges from 0 (unknown) to 3 (1e-7 per hour)
+	minRssi       = -49.5 // weakest signal reported by dump1090, in dBFS
+	maxSeenPosAge = 60.0  // seconds after which a position contributes nothing
+)
+
+// qualityWeights are the relative weights given to each input of the
+// quality score. They need not sum to one.
+type qualityWeights struct {
+	Nic     float64
+	NacP    float64
+	Sil     float64
+	Rssi    float64
+	SeenPos float64
+}
+
+// defaultQualityWeights favour the accuracy and integrity of the position
+// over the strength of the signal it was received with.
+var defaultQualityWeights = qualityWeights{
+	Nic:     0.2,
+	NacP:    0.3,
+	Sil:     0.2,
+	Rssi:    0.1,
+	SeenPos: 0.2,
+}
+
+// parseQualityWeights overrides the default weights with those read from
+// the configuration file, keyed by the name of the field in aircraft.json.
+func parseQualityWeights(m map[string]float64) (qualityWeights, error) {
+	w := defaultQualityWeights
+	for k, v := range m {
+		if v < 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+			return w, fmt.Errorf("weight for %s must be a positive number: %v", k, v)
+		}
+
+		switch k {
+		case "nic":
+			w.Nic = v
+		case "nac_p":
+			w.NacP = v
+		case "sil":
+			w.Sil = v
+		case "rssi":
+			w.Rssi = v
+		case "seen_pos":
+			w.SeenPos = v
+		default:
+			return w, fmt.Errorf("unknown field %q", k)
+		}
+	}
+
+	if w.Nic+w.NacP+w.Sil+w.Rssi+w.SeenPos == 0 {
+		return w, fmt.Errorf("at least one weight must be greater than zero")
+	}
+	return w, nil
+}
+
+// score returns the quality of the position reported by aircraft a,
+// between 0 for the lowest and 1 for the highest. Each input is normalised
+// to the range 0 to 1, with unknown values scoring 0, and the results are
+// combined as a weighted mean rounded to two decimal places.
+func (w qualityWeights) score(a Aircraft) float64 {
+	total := w.Nic + w.NacP + w.Sil + w.Rssi + w.SeenPos
+	if total == 0 {
+		return 0
+	}
+
+	rssi := 0.0
+	if a.Rssi != 0 {
+		rssi = clamp(1 - a.Rssi/minRssi)
+	}
+
+	seenPos := 0.0
+	if a.hasPosition() {
+		seenPos = clamp(1 - a.SeenPos/maxSeenPosAge)
+	}
+
+	s := w.Nic*clamp(float64(a.Nic)/maxNic) +
+		w.NacP*clamp(float64(a.NacP)/maxNacP) +
+		w.Sil*clamp(float64(a.Sil)/maxSil) +
+		w.Rssi*rssi +
+		w.SeenPos*seenPos
+
+	return math.Round(s/total*100) / 100
+}
+
+// clamp limits v to the range 0 to 1.
+func clamp(v float64) float64 {
+	return math.Max(0, math.Min(1, v))
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestQualityScore(t *testing.T) {
+	tcs := []struct {
+		name     string
+		a        Aircraft
+		min, max float64
+	}{
+		{
+			name: "high quality",
+			a:    Aircraft{Lat: 51.47, Lon: -0.45, Nic: 8, NacP: 10, Sil: 3, Rssi: -3.5, SeenPos: 0.5},
+			min:  0.8, max: 1,
+		},
+		{
+			name: "perfect",
+			a:    Aircraft{Lat: 51.47, Lon: -0.45, Nic: 11, NacP: 11, Sil: 3, Rssi: -0.1},
+			min:  1, max: 1,
+		},
+		{
+			name: "low quality",
+			a:    Aircraft{Lat: 51.47, Lon: -0.45, Nic: 1, NacP: 2, Sil: 0, Rssi: -45, SeenPos: 50},
+			min:  0, max: 0.2,
+		},
+		{
+			name: "unknown",
+			a:    Aircraft{},
+			min:  0, max: 0,
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			got := defaultQualityWeights.score(tc.a)
+			if got < tc.min || got > tc.max {
+				t.Errorf("%v not in range %v to %v", got, tc.min, tc.max)
+			}
+		})
+	}
+}
+
+func TestParseQualityWeights(t *testing.T) {
+	w, err := parseQualityWeights(map[string]float64{"rssi": 1, "nac_p": 0})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Rssi != 1 || w.NacP != 0 || w.Nic != defaultQualityWeights.Nic {
+		t.Errorf("unexpected weights: %+v", w)
+	}
+
+	// With only RSSI weighted, we expect the score to follow the signal.
+	w = qualityWeights{Rssi: 1}
+	if got, want := w.score(Aircraft{Rssi: -24.75, NacP: 11}), 0.5; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+
+	invalid := []map[string]float64{
+		{"unknown": 1},
+		{"nic": -1},
+		{"nic": 0, "nac_p": 0, "sil": 0, "rssi": 0, "seen_pos": 0},
+	}
+	for _, m := range invalid {
+		_, err := parseQualityWeights(m)
+		if err == nil {
+			t.Errorf("expected an error for %v", m)
+		}
+	}
+}
+
+func TestPublishUpdatesQuality(t *testing.T) {
+	for _, enabled := range []bool{false, true} {
+		store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+		store.aircraft["a1"] = AircraftPos{aircraft: Aircraft{Hex: "a1", Flight: "A"}, modified: true}
+
+		pub := &fakePublisher{}
+		u := updater{store: &store, pub: pub}
+		if enabled {
+			u.opts.quality = &defaultQualityWeights
+		}
+		u.publishUpdates(time.Now())
+
+		// We expect a score of zero to be published rather than omitted.
+		if got := strings.Contains(string(pub.bodies[0]), `"quality":0`); got != enabled {
+			t.Errorf("%t != %t: %s", got, enabled, pub.bodies[0])
+		}
+	}
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// rangeState records whether an aircraft is within range of the station.
+type rangeState int
+
+// Range states. Aircraft start in an unknown state until their distance
+// from the station has been checked.
+const (
+	rangeUnknown rangeState = iota
+	rangeIn
+	rangeOut
+)
+
+// rangeEvent reports an aircraft entering or leaving the range of the
+// station. Distance is in nautical miles.
+type rangeEvent struct {
+	Type        string  `json:"type"`
+	Flight      string  `json:"flight"`
+	Hex         string  `json:"hex"`
+	Lat         float64 `json:"lat"`
+	Lon         float64 `json:"lon"`
+	Distance    float64 `json:"distance"`
+	Timestamp   int64   `json:"timestamp"`
+	StationName string  `json:"groundStationName"`
+	StationID   string  `json:"groundStationId"`
+	Seq         uint64  `json:"seq,omitempty"`
+}
+
+// nextRangeState returns the range state of an aircraft at distance d
+// given its previous state. Aircraft enter range once within maxRange and
+// only leave once beyond maxRange plus hysteresis, so that aircraft near
+// the boundary don't flap between states. An event should be published if
+// changed is true.
+func nextRangeState(prev rangeState, d, maxRange, hysteresis float64) (next rangeState, changed bool) {
+	switch {
+	case d <= maxRange:
+		next = rangeIn
+	case d > maxRange+hysteresis:
+		next = rangeOut
+	case prev == rangeUnknown:
+		next = rangeOut
+	default:
+		next = prev
+	}
+
+	// Aircraft first seen out of range have never been in range, so there
+	// is nothing to report.
+	changed = next != prev && !(prev == rangeUnknown && next == rangeOut)
+	return next, changed
+}
+
+// publishRangeEvents publishes an event for each aircraft that has entered
+// or left the range of the station since the last tick, measured from the
+// station the aircraft was received by if it has a location of its own. An
+// aircraft's range
+// state is only updated if its event is published successfully, and the
+// sinks are sent each event once, even while publishing to RabbitMQ fails.
+// The data Store's lock isn't held while the events are published.
+func (u *updater) publishRangeEvents(now time.Time) {
+	if u.opts.maxRange == 0 || u.opts.station == nil && len(u.opts.stations) == 0 {
+		return
+	}
+
+	events, states := u.pendingRangeEvents(now)
+	published, sunk := publishSplit(u.pub, events)
+
+	u.store.lock.Lock()
+	defer u.store.lock.Unlock()
+
+	for _, e := range sunk {
+		v, ok := u.store.aircraft[e.storeKey]
+		if !ok {
+			continue
+		}
+		v.sinkInRange = states[e.storeKey]
+		u.store.aircraft[e.storeKey] = v
+	}
+
+	for _, e := range published {
+		v, ok := u.store.aircraft[e.storeKey]
+		if !ok {
+			continue
+		}
+		v.inRange = states[e.storeKey]
+		u.store.aircraft[e.storeKey] = v
+	}
+}
+
+// pendingRangeEvents returns the events for aircraft whose range state has
+// changed, in order, along with the new state of each. The range state of
+// aircraft without an event is updated at once.
+func (u *updater) pendingRangeEvents(now time.Time) ([]pendingMessage, map[string]rangeState) {
+	u.store.lock.Lock()
+	defer u.store.lock.Unlock()
+
+	events := []pendingMessage{}
+	states := map[string]rangeState{}
+	for _, k := range u.store.sortedKeys(u.opts.station, u.opts.distanceMethod) {
+		v := u.store.aircraft[k]
+		a := v.aircraft
+		station := u.opts.stationLocation(a.StationName)
+		if !a.hasPosition() || station == nil {
+			continue
+		}
+
+		d := u.opts.distanceMethod.distance(*station, location{Lat: a.Lat, Lon: a.Lon})
+
+		next, changed := nextRangeState(v.inRange, d, u.opts.maxRange, u.opts.rangeHysteresis)
+		if changed {
+			name := a.StationName
+			if name == "" {
+				name = u.station
+			}
+
+			e := rangeEvent{
+				Type:        "ENTER",
+				Flight:      a.Flight,
+				Hex:         a.Hex,
+				Lat:         a.Lat,
+				Lon:         a.Lon,
+				Distance:    d,
+				Timestamp:   now.UnixNano() / 1000,
+				StationName: name,
+				StationID:   stationID(name),
+				Seq:         u.sequence(),
+			}
+			if next == rangeOut {
+				e.Type = "EXIT"
+			}
+
+			body, err := marshalMessage(e, u.opts.keyCase)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to marshal range event: %v\n", err)
+				continue
+			}
+
+			// Events the sinks have already been sent, while publishing
+			// them to RabbitMQ has failed, aren't sent to them again.
+			var sinkBody []byte
+			if next != v.sinkInRange {
+				sinkBody = body
+			}
+
+			events = append(events, pendingMessage{storeKey: k, aircraft: a, routingKey: keyRange, body: body, sinkBody: sinkBody})
+			states[k] = next
+			continue
+		}
+
+		v.inRange = next
+		u.store.aircraft[k] = v
+	}
+	return events, states
+}
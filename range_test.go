@@ -0,0 +1,157 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNextRangeState(t *testing.T) {
+	maxRange, hysteresis := 100.0, 5.0
+
+	testCases := []struct {
+		name        string
+		prev        rangeState
+		d           float64
+		wantState   rangeState
+		wantChanged bool
+	}{
+		{name: "first seen in range", prev: rangeUnknown, d: 50, wantState: rangeIn, wantChanged: true},
+		{name: "first seen out of range", prev: rangeUnknown, d: 150, wantState: rangeOut, wantChanged: false},
+		{name: "first seen in hysteresis band", prev: rangeUnknown, d: 102, wantState: rangeOut, wantChanged: false},
+		{name: "enters", prev: rangeOut, d: 99, wantState: rangeIn, wantChanged: true},
+		{name: "in hysteresis band from out", prev: rangeOut, d: 102, wantState: rangeOut, wantChanged: false},
+		{name: "in hysteresis band from in", prev: rangeIn, d: 102, wantState: rangeIn, wantChanged: false},
+		{name: "leaves", prev: rangeIn, d: 106, wantState: rangeOut, wantChanged: true},
+		{name: "stays in", prev: rangeIn, d: 50, wantState: rangeIn, wantChanged: false},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			state, changed := nextRangeState(tc.prev, tc.d, maxRange, hysteresis)
+			if state != tc.wantState {
+				t.Errorf("%v != %v", state, tc.wantState)
+			}
+			if changed != tc.wantChanged {
+				t.Errorf("%v != %v", changed, tc.wantChanged)
+			}
+		})
+	}
+}
+
+func TestPublishRangeEvents(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	pub := &fakePublisher{}
+	station := location{Lat: 51, Lon: 0}
+	opts := publishOptions{station: &station, maxRange: 60, rangeHysteresis: 3}
+	u := updater{store: &store, pub: pub, opts: opts, station: "dummy station"}
+
+	// Each degree of latitude is 60nm.
+	positions := []struct {
+		lat  float64
+		want []string
+	}{
+		{lat: 52.5, want: nil},
+		{lat: 51.9, want: []string{"ENTER"}},
+		{lat: 52.02, want: []string{"ENTER"}},
+		{lat: 51.99, want: []string{"ENTER"}},
+		{lat: 52.1, want: []string{"ENTER", "EXIT"}},
+	}
+
+	for _, p := range positions {
+		store.aircraft["A"] = AircraftPos{aircraft: Aircraft{Flight: "A", Lat: p.lat, Lon: 0}, inRange: store.aircraft["A"].inRange}
+		u.publishRangeEvents(time.Now())
+
+		got := []string{}
+		for i, b := range pub.bodies {
+			e := rangeEvent{}
+			err := json.Unmarshal(b, &e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pub.keys[i] != keyRange {
+				t.Errorf("%q != %q", pub.keys[i], keyRange)
+			}
+			got = append(got, e.Type)
+		}
+
+		if len(got) != len(p.want) {
+			t.Fatalf("lat %v: %v != %v", p.lat, got, p.want)
+		}
+		for i := range got {
+			if got[i] != p.want[i] {
+				t.Errorf("lat %v: %v != %v", p.lat, got, p.want)
+			}
+		}
+	}
+}
+
+func TestPublishRangeEventsSinksOnce(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	station := location{Lat: 51, Lon: 0}
+	pub := &fakePublisher{err: errors.New("publish failed")}
+	sink := &fakePublisher{}
+	opts := publishOptions{station: &station, maxRange: 60, sinks: []Publisher{sink}}
+	u := updater{store: &store, opts: opts, station: "dummy station"}
+	u.pub = u.withSinks(pub)
+
+	store.aircraft["A"] = AircraftPos{aircraft: Aircraft{Flight: "A", Lat: 51.5, Lon: 0}}
+
+	// While publishing to RabbitMQ fails, we expect the sinks to be sent
+	// the event once.
+	for n := 0; n < 3; n++ {
+		u.publishRangeEvents(time.Now())
+	}
+	if got, want := len(sink.bodies), 1; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+
+	// Once RabbitMQ recovers, it is sent the event too.
+	pub.err = nil
+	u.publishRangeEvents(time.Now())
+	if got, want := len(pub.bodies), 1; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+	if got, want := len(sink.bodies), 1; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+}
+
+func TestPublishRangeEventsPerStation(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	pub := &fakePublisher{}
+	station := location{Lat: 51, Lon: 0}
+	opts := publishOptions{
+		station:  &station,
+		stations: map[string]location{"north": {Lat: 55, Lon: 0}},
+		maxRange: 60,
+	}
+	u := updater{store: &store, pub: pub, opts: opts, station: "dummy station"}
+
+	// Each aircraft is near the station that heard it, but out of range of
+	// the other.
+	store.aircraft["a"] = AircraftPos{aircraft: Aircraft{Hex: "a", Flight: "A", Lat: 51.5, Lon: 0}}
+	store.aircraft["b"] = AircraftPos{aircraft: Aircraft{Hex: "b", Flight: "B", Lat: 55.5, Lon: 0, StationName: "north"}}
+	u.publishRangeEvents(time.Now())
+
+	// We expect both aircraft to be reported entering the range of their
+	// own station.
+	got := map[string]rangeEvent{}
+	for _, b := range pub.bodies {
+		e := rangeEvent{}
+		if err := json.Unmarshal(b, &e); err != nil {
+			t.Fatal(err)
+		}
+		got[e.Hex] = e
+	}
+	if got, want := len(got), 2; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+	for hex, name := range map[string]string{"a": "dummy station", "b": "north"} {
+		if e := got[hex]; e.Type != "ENTER" || e.StationName != name {
+			t.Errorf("%s: %+v", hex, e)
+		}
+	}
+}
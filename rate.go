@@ -0,0 +1,71 @@
+package main
+
+import "sync"
+
+// messageRates tracks the rate of Mode S messages processed by the decoder
+// behind each source.
+var messageRates = newRateTracker()
+
+// rateTracker computes the rate of increase of the message counter
+// reported in consecutive scans of each source. It is safe for concurrent
+// use.
+type rateTracker struct {
+	lock    sync.Mutex
+	sources map[string]counterRate
+}
+
+// counterRate is the latest reading of a counter and its rate of increase.
+type counterRate struct {
+	now      float64 // time of the latest reading, in seconds since the Unix epoch
+	messages int     // value of the counter at the latest reading
+	rate     float64 // increase in the counter per second
+	known    bool    // whether enough readings have been taken to know the rate
+}
+
+// newRateTracker returns a rateTracker with no sources.
+func newRateTracker() *rateTracker {
+	return &rateTracker{sources: make(map[string]counterRate)}
+}
+
+// update records a reading of the message counter of source, taken at now.
+// Readings without a time are ignored, as the rate can't be calculated.
+func (t *rateTracker) update(source string, now float64, messages int) {
+	if now == 0 {
+		return
+	}
+
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	prev, ok := t.sources[source]
+	if ok && now <= prev.now {
+		return
+	}
+
+	// A counter that has gone backwards has been reset by a restart of the
+	// decoder. The previous rate is kept until the next reading, as the
+	// number of messages since the restart isn't a measure of the rate.
+	c := counterRate{now: now, messages: messages, rate: prev.rate, known: prev.known}
+	if ok && messages >= prev.messages {
+		c.rate = float64(messages-prev.messages) / (now - prev.now)
+		c.known = true
+	}
+	t.sources[source] = c
+}
+
+// total returns the combined message rate of all sources, in messages per
+// second. False is returned if the rate of no source is known.
+func (t *rateTracker) total() (float64, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var total float64
+	var known bool
+	for _, c := range t.sources {
+		if c.known {
+			total += c.rate
+			known = true
+		}
+	}
+	return total, known
+}
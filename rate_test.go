@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestRateTracker(t *testing.T) {
+	r := newRateTracker()
+
+	steps := []struct {
+		now      float64
+		messages int
+		want     float64
+		known    bool
+	}{
+		{now: 100, messages: 1000, known: false},
+		{now: 110, messages: 2000, want: 100, known: true},
+		{now: 110, messages: 2000, want: 100, known: true}, // the same scan read again
+		{now: 120, messages: 50, want: 100, known: true},   // the decoder has restarted
+		{now: 130, messages: 550, want: 50, known: true},
+		{now: 0, messages: 9999, want: 50, known: true}, // a scan without a time
+	}
+
+	for i, s := range steps {
+		r.update("/run/dump1090-fa/aircraft.json", s.now, s.messages)
+		got, known := r.total()
+		if got != s.want || known != s.known {
+			t.Errorf("step %d: %v (%t) != %v (%t)", i, got, known, s.want, s.known)
+		}
+	}
+
+	// We expect the rates of several sources to be combined.
+	r.update("/run/dump978-fa/aircraft.json", 200, 0)
+	r.update("/run/dump978-fa/aircraft.json", 202, 20)
+	if got, _ := r.total(); got != 60 {
+		t.Errorf("%v != 60", got)
+	}
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+)
+
+// receiver holds the details written to receiver.json by dump1090 and
+// readsb.
+type receiver struct {
+	Version string   `json:"version"` // version of the decoder
+	Refresh int      `json:"refresh"` // how often aircraft.json is updated, in milliseconds
+	History int      `json:"history"` // number of history files kept
+	Lat     *float64 `json:"lat"`     // latitude of the receiver, if configured
+	Lon     *float64 `json:"lon"`     // longitude of the receiver, if configured
+}
+
+// readReceiver reads and decodes the receiver.json file at path.
+func readReceiver(path string) (receiver, error) {
+	r := receiver{}
+
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return r, fmt.Errorf("failed to read receiver file: %w", err)
+	}
+
+	err = json.Unmarshal(b, &r)
+	if err != nil {
+		return r, fmt.Errorf("failed to parse receiver file: %w", err)
+	}
+
+	return r, nil
+}
+
+// location returns the location of the receiver. An error is returned if
+// the decoder hasn't been configured with one.
+func (r receiver) location() (location, error) {
+	if r.Lat == nil || r.Lon == nil {
+		return location{}, errors.New("receiver location not configured")
+	}
+	return location{Lat: *r.Lat, Lon: *r.Lon}, nil
+}
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+)
+
+func TestReadReceiver(t *testing.T) {
+	r, err := readReceiver("data/receiver.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := r.Version, "3.8.0"; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+
+	loc, err := r.location()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := loc, (location{Lat: 51.468, Lon: -0.455}); got != want {
+		t.Errorf("%+v != %+v", got, want)
+	}
+
+	// A receiver without a configured location has none to report.
+	_, err = receiver{Version: "3.8.0"}.location()
+	if err == nil {
+		t.Error("expected an error, got none")
+	}
+
+	// We expect a missing file to be reported as such so callers can fall
+	// back to the configured location.
+	_, err = readReceiver("data/missing.json")
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("expected %v to wrap %v", err, os.ErrNotExist)
+	}
+}
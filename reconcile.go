@@ -0,0 +1,73 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// keyReconcile determines how aircraft whose hex code is briefly missing
+// are reconciled with the entries held against their hex code.
+type keyReconcile string
+
+// Supported key reconciliation policies.
+const (
+	reconcileNone  keyReconcile = "none"  // hold aircraft against whichever key they report
+	reconcileMerge keyReconcile = "merge" // merge entries with a matching callsign
+)
+
+// parseKeyReconcile validates a key reconciliation policy read from the
+// configuration file. An empty value selects no reconciliation.
+func parseKeyReconcile(s string) (keyReconcile, error) {
+	switch r := keyReconcile(s); r {
+	case "":
+		return reconcileNone, nil
+	case reconcileNone, reconcileMerge:
+		return r, nil
+	}
+	return reconcileNone, fmt.Errorf("unknown key reconciliation %q, expected %q or %q", s, reconcileNone, reconcileMerge)
+}
+
+// reconcileKey avoids dropping or duplicating aircraft a when its hex code
+// is briefly missing or corrupt while its callsign stays the same. An
+// aircraft without a well formed hex code is given the hex code of the one
+// aircraft in the data Store with its callsign, so that its state is kept.
+// Callsigns shared by more than one aircraft are never reconciled, and
+// corrupt hex codes without a match are kept.
+func (s *Store) reconcileKey(a *Aircraft) {
+	if s.reconcileKeys != reconcileMerge || a.Flight == "" || validHex(a.Hex) {
+		return
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	match := ""
+	for k, v := range s.aircraft {
+		if v.aircraft.Flight != a.Flight {
+			continue
+		}
+		if match != "" {
+			return
+		}
+		match = k
+	}
+	if match != "" {
+		a.Hex = match
+		keysReconciled.Add(1)
+	}
+}
+
+// validHex reports whether hex is a well formed address of six hex digits,
+// which dump1090 prefixes with a tilde for addresses that aren't ICAO.
+func validHex(hex string) bool {
+	hex = strings.TrimPrefix(hex, "~")
+	if len(hex) != 6 {
+		return false
+	}
+	for _, c := range hex {
+		if !strings.ContainsRune("0123456789abcdefABCDEF", c) {
+			return false
+		}
+	}
+	return true
+}
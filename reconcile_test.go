@@ -0,0 +1,162 @@
+package main
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestParseKeyReconcile(t *testing.T) {
+	tcs := []struct {
+		in      string
+		want    keyReconcile
+		wantErr bool
+	}{
+		{in: "", want: reconcileNone},
+		{in: "none", want: reconcileNone},
+		{in: "merge", want: reconcileMerge},
+		{in: "hex", want: reconcileNone, wantErr: true},
+	}
+
+	for _, tc := range tcs {
+		got, err := parseKeyReconcile(tc.in)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%q: unexpected error: %v", tc.in, err)
+		}
+		if got != tc.want {
+			t.Errorf("%q: %v != %v", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestReconcileKeys(t *testing.T) {
+	station := "dummy station"
+	published := time.Now()
+
+	tcs := []struct {
+		name   string
+		policy keyReconcile
+		scans  [][]Aircraft
+		want   []string
+		hex    string // expected hex code of the aircraft held against it
+	}{
+		{
+			name:   "missing hex held against hex",
+			policy: reconcileMerge,
+			scans: [][]Aircraft{
+				{{Hex: "a1b2c3", Flight: "DUMMY", Lat: 1, Lon: 2}},
+				{{Flight: "DUMMY", Lat: 1.1, Lon: 2}},
+			},
+			want: []string{"a1b2c3"},
+			hex:  "a1b2c3",
+		},
+		{
+			name:   "corrupt hex held against hex",
+			policy: reconcileMerge,
+			scans: [][]Aircraft{
+				{{Hex: "a1b2c3", Flight: "DUMMY", Lat: 1, Lon: 2}},
+				{{Hex: "a1b?c3", Flight: "DUMMY", Lat: 1.1, Lon: 2}},
+			},
+			want: []string{"a1b2c3"},
+			hex:  "a1b2c3",
+		},
+		{
+			name:   "corrupt hex without a match kept",
+			policy: reconcileMerge,
+			scans: [][]Aircraft{
+				{{Hex: "a1b2c3", Flight: "DUMMY", Lat: 1, Lon: 2}},
+				{{Hex: "a1b2", Flight: "OTHER", Lat: 1.1, Lon: 2}},
+			},
+			want: []string{"a1b2", "a1b2c3"},
+		},
+		{
+			name:   "non-ICAO hex not reconciled",
+			policy: reconcileMerge,
+			scans: [][]Aircraft{
+				{{Hex: "a1b2c3", Flight: "DUMMY", Lat: 1, Lon: 2}},
+				{{Hex: "~a2b3c4", Flight: "DUMMY", Lat: 3, Lon: 4}},
+			},
+			want: []string{"a1b2c3", "~a2b3c4"},
+		},
+		{
+			name:   "shared callsign not merged",
+			policy: reconcileMerge,
+			scans: [][]Aircraft{
+				{{Hex: "a1b2c3", Flight: "DUMMY", Lat: 1, Lon: 2}, {Hex: "a2b3c4", Flight: "DUMMY", Lat: 3, Lon: 4}},
+				{{Flight: "DUMMY", Lat: 1.1, Lon: 2}},
+			},
+			want: []string{"a1b2c3", "a2b3c4"},
+		},
+		{
+			name: "no reconciliation",
+			scans: [][]Aircraft{
+				{{Hex: "a1b2c3", Flight: "DUMMY", Lat: 1, Lon: 2}},
+				{{Flight: "DUMMY", Lat: 1.1, Lon: 2}},
+			},
+			want: []string{"a1b2c3"},
+		},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex), reconcileKeys: tc.policy}
+			// Aircraft in the first scan are published.
+			for i, s := range tc.scans {
+				updateAircraft(Scan{Aircraft: s}, &store, station)
+				if i > 0 {
+					continue
+				}
+				for k, v := range store.aircraft {
+					v.modified = false
+					v.published = published
+					store.aircraft[k] = v
+				}
+			}
+
+			got := []string{}
+			for k := range store.aircraft {
+				got = append(got, k)
+			}
+			sort.Strings(got)
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("%v != %v", got, tc.want)
+			}
+
+			if tc.hex == "" {
+				return
+			}
+			v := store.aircraft[tc.hex]
+			if v.aircraft.Hex != tc.hex {
+				t.Errorf("%q != %q", v.aircraft.Hex, tc.hex)
+			}
+
+			// We expect the state of the merged entry to be kept.
+			if !v.published.Equal(published) {
+				t.Errorf("%v != %v", v.published, published)
+			}
+		})
+	}
+}
+
+func TestValidHex(t *testing.T) {
+	tcs := []struct {
+		in   string
+		want bool
+	}{
+		{in: "a1b2c3", want: true},
+		{in: "A1B2C3", want: true},
+		{in: "~a1b2c3", want: true},
+		{in: "", want: false},
+		{in: "a1b2", want: false},
+		{in: "a1b2c3d", want: false},
+		{in: "a1b?c3", want: false},
+	}
+
+	for _, tc := range tcs {
+		if got := validHex(tc.in); got != tc.want {
+			t.Errorf("%q: %v != %v", tc.in, got, tc.want)
+		}
+	}
+}
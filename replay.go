@@ -0,0 +1,104 @@
+package main
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// StartReplay starts a new Go routine replaying the aircraft recorded in
+// the newline delimited JSON log at path into the provided data Store.
+// Records are replayed in timestamp order, with the original gaps between
+// them divided by speed. A speed of zero replays as fast as possible. Logs
+// with a .gz extension are decompressed. An error is returned if the log
+// can't be read. Cancelling the provided context will terminate the Go
+// routine.
+func startReplay(ctx context.Context, path string, speed float64, store *Store, station string) error {
+	if store == nil {
+		return errors.New("no data store provided")
+	}
+
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("failed to open log: %w", err)
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return fmt.Errorf("failed to decompress log: %w", err)
+		}
+		defer gz.Close()
+		r = gz
+	}
+
+	records, err := readLog(r, os.Stderr)
+	if err != nil {
+		return fmt.Errorf("failed to read log: %w", err)
+	}
+
+	go func() {
+		for i, a := range records {
+			if i > 0 && speed > 0 {
+				gap := time.Duration(a.Timestamp-records[i-1].Timestamp) * time.Microsecond
+				select {
+				case <-time.After(time.Duration(float64(gap) / speed)):
+				case <-ctx.Done():
+					return
+				}
+			}
+
+			if ctx.Err() != nil {
+				return
+			}
+
+			updateAircraft(Scan{Aircraft: []Aircraft{a}}, store, station)
+		}
+	}()
+
+	return nil
+}
+
+// readLog reads newline delimited aircraft records from r and returns them
+// sorted by timestamp. Lines that can't be decoded are reported to w and
+// skipped.
+func readLog(r io.Reader, w io.Writer) ([]Aircraft, error) {
+	records := []Aircraft{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+
+		a := Aircraft{}
+		err := json.Unmarshal(line, &a)
+		if err != nil {
+			fmt.Fprintf(w, "skipping line %d: %v\n", n, err)
+			continue
+		}
+		records = append(records, a)
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].Timestamp < records[j].Timestamp
+	})
+
+	return records, nil
+}
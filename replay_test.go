@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadLog(t *testing.T) {
+	f, err := os.Open("data/history.jsonl.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	gz, err := gzip.NewReader(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	warnings := new(bytes.Buffer)
+	records, err := readLog(gz, warnings)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// We expect the malformed line to be skipped with a warning.
+	if got, want := len(records), 3; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+	if !strings.Contains(warnings.String(), "skipping line 3") {
+		t.Errorf("expected a warning for line 3, got %q", warnings.String())
+	}
+
+	// We expect records to be sorted by timestamp.
+	for i := 1; i < len(records); i++ {
+		if records[i].Timestamp < records[i-1].Timestamp {
+			t.Errorf("records out of order: %d < %d", records[i].Timestamp, records[i-1].Timestamp)
+		}
+	}
+}
+
+func TestStartReplay(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+
+	err := startReplay(ctx, "data/history.jsonl.gz", 0, &store, "dummy station")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		store.lock.RLock()
+		pos, ok := store.aircraft["a4cf26"]
+		n := len(store.aircraft)
+		store.lock.RUnlock()
+
+		// The latest position of each aircraft should end up in the store.
+		if n == 2 && ok && pos.aircraft.Lat == 51.140002 {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Error("expected the log to be replayed into the store")
+}
+
+func TestStartReplayMissing(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+
+	err := startReplay(context.Background(), "data/invalid.no.file", 0, &store, "dummy station")
+	if err == nil {
+		t.Error("expected an error, got none")
+	}
+}
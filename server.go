@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"time"
+)
+
+// serverInfo describes the running process and its configuration. It must
+// never include secrets such as the AMQP URL.
+type serverInfo struct {
+	GitRevision string    `json:"gitRevision"`
+	GoVersion   string    `json:"goVersion"`
+	StartTime   time.Time `json:"startTime"`
+	Uptime      string    `json:"uptime"`
+	Source      string    `json:"source"`
+	SourceType  string    `json:"sourceType"`
+	Sinks       []string  `json:"sinks"`
+	StationName string    `json:"stationName"`
+}
+
+// serverOptions control how the HTTP endpoints are served.
+type serverOptions struct {
+	certFile string // TLS certificate, the endpoints are served over HTTPS if set with keyFile
+	keyFile  string // TLS private key
+	authUser string // user required by basic authentication, if set
+	authPass string // password required by basic authentication
+
+	staleAfter time.Duration // sources without a scan for this long are reported as unhealthy
+
+	// Intervals that may be changed through the intervals endpoint, which
+	// is only served if authentication is required.
+	monitorInterval *interval
+	updateInterval  *interval
+
+	logs *logRing // recent log lines, served if authentication is required
+}
+
+// StartServer starts a new Go routine serving the HTTP endpoints on the
+// provided address. An error is returned if the address can't be listened
+// on. Cancelling the provided context will shut the server down.
+func startServer(ctx context.Context, addr string, info serverInfo, opts serverOptions) error {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	var handler http.Handler = newServeMux(info, opts)
+	if opts.authUser != "" {
+		handler = basicAuth(handler, opts.authUser, opts.authPass)
+	}
+	srv := &http.Server{Handler: handler}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Second*5)
+		defer cancel()
+		srv.Shutdown(shutdownCtx)
+	}()
+
+	go func() {
+		var err error
+		if opts.certFile != "" && opts.keyFile != "" {
+			err = srv.ServeTLS(ln, opts.certFile, opts.keyFile)
+		} else {
+			err = srv.Serve(ln)
+		}
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Fprintf(os.Stderr, "failed to serve HTTP: %v\n", err)
+		}
+	}()
+
+	return nil
+}
+
+// newServeMux returns a ServeMux with all HTTP endpoints registered.
+func newServeMux(info serverInfo, opts serverOptions) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", expvar.Handler())
+	mux.HandleFunc("/info", infoHandler(info))
+	mux.HandleFunc("/health", healthHandler(sourceHealth, opts.staleAfter))
+	if opts.authUser != "" && opts.monitorInterval != nil && opts.updateInterval != nil {
+		mux.HandleFunc("/intervals", intervalsHandler(opts.monitorInterval, opts.updateInterval))
+	}
+	if opts.authUser != "" && opts.logs != nil {
+		mux.HandleFunc("/logs", logsHandler(opts.logs))
+	}
+	return mux
+}
+
+// basicAuth wraps h, requiring requests to authenticate with the given
+// user and password using HTTP basic authentication.
+func basicAuth(h http.Handler, user, pass string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u, p, ok := r.BasicAuth()
+		userOK := subtle.ConstantTimeCompare([]byte(u), []byte(user)) == 1
+		passOK := subtle.ConstantTimeCompare([]byte(p), []byte(pass)) == 1
+		if !ok || !userOK || !passOK {
+			w.Header().Set("WWW-Authenticate", `Basic realm="go-adsb-console"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// infoHandler serves the provided serverInfo with the current uptime.
+func infoHandler(info serverInfo) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		info.Uptime = time.Since(info.StartTime).Round(time.Second).String()
+
+		w.Header().Set("Content-Type", "application/json")
+		err := json.NewEncoder(w).Encode(info)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to encode info: %v\n", err)
+		}
+	}
+}
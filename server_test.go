@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	newServeMux(serverInfo{}, serverOptions{}).ServeHTTP(rec, req)
+
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+
+	vars := map[string]json.RawMessage{}
+	err := json.NewDecoder(rec.Body).Decode(&vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := vars["dropped_aircraft"]; !ok {
+		t.Error("expected dropped_aircraft in metrics")
+	}
+}
+
+func TestInfoEndpoint(t *testing.T) {
+	info := serverInfo{
+		GitRevision: "abc123",
+		GoVersion:   "go1.13",
+		StartTime:   time.Now().Add(-time.Minute),
+		Source:      "/run/dump1090-fa/aircraft.json",
+		SourceType:  "file",
+		Sinks:       []string{"amqp"},
+		StationName: "dummy station",
+	}
+
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/info", nil)
+	newServeMux(info, serverOptions{}).ServeHTTP(rec, req)
+
+	if got, want := rec.Code, http.StatusOK; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+
+	fields := map[string]interface{}{}
+	err := json.Unmarshal(rec.Body.Bytes(), &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"gitRevision", "goVersion", "startTime", "uptime", "source", "sourceType", "sinks", "stationName"} {
+		if _, ok := fields[k]; !ok {
+			t.Errorf("expected %s in info", k)
+		}
+	}
+
+	if got, want := fields["uptime"], "1m0s"; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+
+	// We expect no broker configuration to be exposed.
+	if strings.Contains(strings.ToLower(rec.Body.String()), "amqp://") {
+		t.Errorf("info exposes broker configuration: %s", rec.Body.String())
+	}
+}
+
+func TestBasicAuth(t *testing.T) {
+	h := basicAuth(newServeMux(serverInfo{}, serverOptions{}), "user", "secret")
+
+	tcs := []struct {
+		name       string
+		user, pass string
+		setAuth    bool
+		want       int
+	}{
+		{name: "no credentials", want: http.StatusUnauthorized},
+		{name: "wrong password", user: "user", pass: "wrong", setAuth: true, want: http.StatusUnauthorized},
+		{name: "wrong user", user: "other", pass: "secret", setAuth: true, want: http.StatusUnauthorized},
+		{name: "valid credentials", user: "user", pass: "secret", setAuth: true, want: http.StatusOK},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+			if tc.setAuth {
+				req.SetBasicAuth(tc.user, tc.pass)
+			}
+			h.ServeHTTP(rec, req)
+
+			if got, want := rec.Code, tc.want; got != want {
+				t.Errorf("%d != %d", got, want)
+			}
+			if rec.Code == http.StatusUnauthorized && rec.Header().Get("WWW-Authenticate") == "" {
+				t.Error("expected WWW-Authenticate header")
+			}
+		})
+	}
+}
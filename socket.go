@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// socketPrefix identifies sources read from a Unix domain socket.
+const socketPrefix = "unix://"
+
+// socketRetryDelay is the time waited before reconnecting to a socket.
+var socketRetryDelay = time.Second
+
+// isSocket reports whether the source at path is a Unix domain socket,
+// such as unix:///run/decoder/aircraft.sock.
+func isSocket(path string) bool {
+	return strings.HasPrefix(path, socketPrefix)
+}
+
+// streamSocket connects to the Unix domain socket named by source and
+// sends each scan it receives to scans, reconnecting whenever the peer
+// closes the connection or sends data that can't be decoded. Cancelling
+// the provided context closes the connection and stops the stream.
+func streamSocket(ctx context.Context, source string, scans chan<- Scan) {
+	path := strings.TrimPrefix(source, socketPrefix)
+	errLog := errorLimiter{w: os.Stderr}
+	dialer := net.Dialer{}
+
+	for ctx.Err() == nil {
+		conn, err := dialer.DialContext(ctx, "unix", path)
+		if err != nil {
+			setSourceStatus(source, sourceErrorKind(err))
+			errLog.print(newMonitorError("dial", source, err))
+		} else {
+			// Close the connection on cancellation to unblock the read.
+			stop := make(chan struct{})
+			go func() {
+				select {
+				case <-ctx.Done():
+					conn.Close()
+				case <-stop:
+				}
+			}()
+
+			err = decodeScans(ctx, conn, scans, &errLog)
+			close(stop)
+			conn.Close()
+			if ctx.Err() != nil {
+				return
+			}
+			if err != io.EOF {
+				errLog.print(newMonitorError("parse", source, err))
+			}
+		}
+
+		// Wait before reconnecting so that a peer that is restarting isn't
+		// flooded with connections.
+		select {
+		case <-time.After(socketRetryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
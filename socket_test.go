@@ -0,0 +1,80 @@
+//go:build linux || darwin
+// +build linux darwin
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestStartMonitorSocket(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "aircraft.sock")
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	// The decoder sends a scan on each connection and closes it, as if it
+	// had restarted, so we expect the monitor to reconnect.
+	go func() {
+		for _, scan := range []string{
+			`{"now":1,"aircraft":[{"hex":"a1","flight":"A","lat":1,"lon":2}]}`,
+			`{"now":2,"aircraft":[{"hex":"a1","flight":"A","lat":1,"lon":3}]}`,
+		} {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Write([]byte(scan + "\n"))
+			conn.Close()
+		}
+	}()
+
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	err = startMonitor(ctx, "unix://"+path, time.Millisecond*10, time.Second*60, &store, "dummy station", monitorOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(time.Second * 5)
+	for time.Now().Before(deadline) {
+		store.lock.Lock()
+		pos, ok := store.aircraft["a1"]
+		store.lock.Unlock()
+
+		if ok && pos.aircraft.Lon == 3 {
+			return
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+	t.Error("expected scans to be read from both connections to the socket")
+}
+
+func TestIsSocket(t *testing.T) {
+	for path, want := range map[string]bool{
+		"unix:///run/decoder/aircraft.sock": true,
+		"/run/dump1090-fa/aircraft.json":    false,
+		"http://receiver.local/data.json":   false,
+	} {
+		if got := isSocket(path); got != want {
+			t.Errorf("%s: %t != %t", path, got, want)
+		}
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"strings"
+	"unicode"
+)
+
+// stationIDs maps station names to the machine readable IDs configured for
+// them. It is populated from the configuration file before any aircraft
+// are published.
+var stationIDs = map[string]string{}
+
+// stationID returns the ID of the named station: the ID configured for it,
+// or a slug of its name if none has been.
+func stationID(name string) string {
+	if id, ok := stationIDs[name]; ok {
+		return id
+	}
+	return slugify(name)
+}
+
+// slugify converts s to lower case, replacing each run of characters other
+// than letters and digits with a single hyphen. For example "Heathrow (East)"
+// becomes "heathrow-east".
+func slugify(s string) string {
+	b := strings.Builder{}
+	hyphen := false
+
+	for _, r := range strings.ToLower(s) {
+		if unicode.IsLetter(r) || unicode.IsDigit(r) {
+			if hyphen && b.Len() > 0 {
+				b.WriteRune('-')
+			}
+			b.WriteRune(r)
+			hyphen = false
+			continue
+		}
+		hyphen = true
+	}
+
+	return b.String()
+}
@@ -0,0 +1,37 @@
+package main
+
+import "testing"
+
+func TestSlugify(t *testing.T) {
+	testCases := []struct {
+		name string
+		want string
+	}{
+		{name: "unnamed-station", want: "unnamed-station"},
+		{name: "Heathrow (East)", want: "heathrow-east"},
+		{name: "  Bill's   Loft  ", want: "bill-s-loft"},
+		{name: "Zürich 2", want: "zürich-2"},
+		{name: "---", want: ""},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := slugify(tc.name); got != tc.want {
+				t.Errorf("%q != %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStationID(t *testing.T) {
+	defer func() { stationIDs = map[string]string{} }()
+	stationIDs = map[string]string{"Heathrow (East)": "lhr-1"}
+
+	// We expect a configured ID to be used, otherwise a slug of the name.
+	if got, want := stationID("Heathrow (East)"), "lhr-1"; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+	if got, want := stationID("Heathrow (West)"), "heathrow-west"; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"fmt"
+	"math"
+)
+
+// rangeBands are the upper bounds, in nautical miles, of the bands used to
+// count aircraft by their distance from the station.
+var rangeBands = []float64{50, 100, 150, 200}
+
+// statsMessage summarises the signal received from currently tracked
+// aircraft. RSSI values are in dbFS and only include aircraft that report
+// a signal level. Range bands are only counted when the station location
+// is known. The message rate is the number of Mode S messages processed
+// per second by the decoders, once known.
+type statsMessage struct {
+	Type        string         `json:"type"`
+	Count       int            `json:"count"`
+	MinRssi     float64        `json:"min_rssi,omitempty"`
+	MaxRssi     float64        `json:"max_rssi,omitempty"`
+	MeanRssi    float64        `json:"mean_rssi,omitempty"`
+	RangeBands  map[string]int `json:"range_bands,omitempty"`
+	MessageRate *float64       `json:"message_rate,omitempty"`
+	Timestamp   int64          `json:"timestamp"`
+	StationName string         `json:"groundStationName"`
+	StationID   string         `json:"groundStationId"`
+	Seq         uint64         `json:"seq,omitempty"`
+}
+
+// computeStats calculates signal statistics over the aircraft in the data
+// Store. If station is not nil aircraft are also counted by range band,
+// with distances measured using method.
+func computeStats(store *Store, station *location, method distanceMethod) statsMessage {
+	stats := statsMessage{Type: "STATS"}
+	if station != nil {
+		stats.RangeBands = map[string]int{}
+	}
+
+	var total float64
+	var withRssi int
+	stats.MinRssi = math.Inf(1)
+	stats.MaxRssi = math.Inf(-1)
+
+	store.Range(func(key string, pos AircraftPos) bool {
+		stats.Count++
+
+		if pos.aircraft.Rssi != 0 {
+			withRssi++
+			total += pos.aircraft.Rssi
+			stats.MinRssi = math.Min(stats.MinRssi, pos.aircraft.Rssi)
+			stats.MaxRssi = math.Max(stats.MaxRssi, pos.aircraft.Rssi)
+		}
+
+		if station != nil && pos.aircraft.hasPosition() {
+			d := method.distance(*station, location{Lat: pos.aircraft.Lat, Lon: pos.aircraft.Lon})
+			stats.RangeBands[rangeBand(d)]++
+		}
+		return true
+	})
+
+	if withRssi == 0 {
+		stats.MinRssi, stats.MaxRssi = 0, 0
+		return stats
+	}
+
+	stats.MeanRssi = total / float64(withRssi)
+	return stats
+}
+
+// rangeBand returns the name of the range band containing distance d.
+func rangeBand(d float64) string {
+	lower := 0.0
+	for _, upper := range rangeBands {
+		if d < upper {
+			return fmt.Sprintf("%.0f-%.0f", lower, upper)
+		}
+		lower = upper
+	}
+	return fmt.Sprintf("%.0f+", lower)
+}
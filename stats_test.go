@@ -0,0 +1,50 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestComputeStats(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	store.aircraft["A"] = AircraftPos{aircraft: Aircraft{Flight: "A", Lat: 51.5, Lon: 0, Rssi: -10}}
+	store.aircraft["B"] = AircraftPos{aircraft: Aircraft{Flight: "B", Lat: 52.5, Lon: 0, Rssi: -20}}
+	store.aircraft["C"] = AircraftPos{aircraft: Aircraft{Flight: "C", Lat: 55.0, Lon: 0, Rssi: -30}}
+	store.aircraft["D"] = AircraftPos{aircraft: Aircraft{Flight: "D", Lat: 51.6, Lon: 0}}
+
+	station := location{Lat: 51.5, Lon: 0}
+	stats := computeStats(&store, &station, greatCircle)
+
+	if got, want := stats.Count, 4; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+
+	// We expect aircraft without an RSSI to be excluded from signal stats.
+	if got, want := stats.MinRssi, -30.0; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+	if got, want := stats.MaxRssi, -10.0; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+	if got, want := stats.MeanRssi, -20.0; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+
+	// A and D are within 50nm, B is 60nm away and C is 210nm away.
+	want := map[string]int{"0-50": 2, "50-100": 1, "200+": 1}
+	for k, v := range want {
+		if got := stats.RangeBands[k]; got != v {
+			t.Errorf("%s: %d != %d", k, got, v)
+		}
+	}
+}
+
+func TestComputeStatsEmpty(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+
+	stats := computeStats(&store, nil, greatCircle)
+
+	if stats.Count != 0 || stats.MinRssi != 0 || stats.MaxRssi != 0 || stats.RangeBands != nil {
+		t.Errorf("unexpected stats for empty store: %+v", stats)
+	}
+}
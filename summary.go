@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// summaryMessage gives an overview of the aircraft currently tracked,
+// published on every tick for consumers that don't need each aircraft.
+// Messages is the total number of Mode S messages received from the
+// tracked aircraft.
+type summaryMessage struct {
+	Type         string `json:"type"`
+	Count        int    `json:"count"`
+	WithPosition int    `json:"with_position"`
+	Emergencies  int    `json:"emergencies"`
+	Messages     int    `json:"messages"`
+	Timestamp    int64  `json:"timestamp"`
+	StationName  string `json:"groundStationName"`
+	StationID    string `json:"groundStationId"`
+	Seq          uint64 `json:"seq,omitempty"`
+}
+
+// computeSummary counts the aircraft in the data Store.
+func computeSummary(store *Store) summaryMessage {
+	s := summaryMessage{Type: "SUMMARY"}
+
+	store.Range(func(key string, pos AircraftPos) bool {
+		s.Count++
+		if pos.aircraft.hasPosition() {
+			s.WithPosition++
+		}
+		if parseEmergency(pos.aircraft.Emergency).Active() {
+			s.Emergencies++
+		}
+		s.Messages += pos.aircraft.Messages
+		return true
+	})
+
+	return s
+}
+
+// publishSummary publishes a summary of the aircraft in the data Store to
+// the summary routing key, if enabled.
+func (u *updater) publishSummary(now time.Time) {
+	if !u.opts.summary {
+		return
+	}
+
+	s := computeSummary(u.store)
+	s.Timestamp = now.UnixNano() / 1000
+	s.StationName = u.station
+	s.StationID = stationID(u.station)
+	s.Seq = u.sequence()
+
+	body, err := marshalMessage(s, u.opts.keyCase)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to marshal summary: %v\n", err)
+		return
+	}
+
+	err = u.pub.Publish(keySummary, body)
+	if err != nil {
+		logPublishError(err)
+	}
+}
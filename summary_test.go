@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestComputeSummary(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	store.aircraft["a1"] = AircraftPos{aircraft: Aircraft{Hex: "a1", Lat: 51.5, Lon: 0, Messages: 100, Emergency: "none"}}
+	store.aircraft["a2"] = AircraftPos{aircraft: Aircraft{Hex: "a2", Lat: 52.5, Lon: 0, Messages: 20, Emergency: "general"}}
+	store.aircraft["a3"] = AircraftPos{aircraft: Aircraft{Hex: "a3", Messages: 5}}
+
+	got := computeSummary(&store)
+	want := summaryMessage{Type: "SUMMARY", Count: 3, WithPosition: 2, Emergencies: 1, Messages: 125}
+	if got != want {
+		t.Errorf("%+v != %+v", got, want)
+	}
+}
+
+func TestPublishSummary(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	store.aircraft["a1"] = AircraftPos{aircraft: Aircraft{Hex: "a1", Lat: 51.5, Lon: 0, Messages: 100}}
+
+	pub := &fakePublisher{}
+	u := updater{store: &store, pub: pub, station: "dummy station"}
+
+	// We expect no summary unless enabled.
+	u.publishSummary(time.Now())
+	if got, want := len(pub.bodies), 0; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+
+	u.opts.summary = true
+	u.publishSummary(time.Now())
+	if got, want := len(pub.bodies), 1; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+	if got, want := pub.keys[0], keySummary; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+
+	m := summaryMessage{}
+	err := json.Unmarshal(pub.bodies[0], &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Count != 1 || m.WithPosition != 1 || m.Messages != 100 || m.StationID != "dummy-station" {
+		t.Errorf("unexpected summary: %+v", m)
+	}
+}
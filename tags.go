@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+)
+
+// tagLookup holds custom tags for aircraft, such as their owner, read from
+// a CSV file. It is safe for concurrent use and may be reloaded while in
+// use.
+type tagLookup struct {
+	path   string
+	fields []string // columns included as tags, all columns if empty
+
+	lock sync.RWMutex
+	tags map[string]map[string]string // tags keyed by hex code
+}
+
+// loadTags reads the tags held in the CSV file at path. Only the columns
+// named in fields are included, or all of them if fields is empty.
+func loadTags(path string, fields []string) (*tagLookup, error) {
+	l := &tagLookup{path: path, fields: fields}
+	return l, l.reload()
+}
+
+// reload reads the tags from the CSV file again. The existing tags are
+// kept if the file can't be read.
+func (l *tagLookup) reload() error {
+	f, err := os.Open(l.path)
+	if err != nil {
+		return fmt.Errorf("failed to open tags: %w", err)
+	}
+	defer f.Close()
+
+	tags, err := readTags(f, l.fields)
+	if err != nil {
+		return fmt.Errorf("failed to read tags from %s: %w", l.path, err)
+	}
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.tags = tags
+	return nil
+}
+
+// lookup returns the tags for the aircraft with the given hex code, or nil
+// if it has none.
+func (l *tagLookup) lookup(hex string) map[string]string {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.tags[strings.ToLower(strings.TrimSpace(hex))]
+}
+
+// readTags reads tags from CSV with a header row naming each column. One
+// column must be named hex; the others are tags. Only the columns named in
+// fields are included, or all of them if fields is empty. Empty values
+// are omitted.
+func readTags(r io.Reader, fields []string) (map[string]map[string]string, error) {
+	cr := csv.NewReader(r)
+	cr.TrimLeadingSpace = true
+
+	header, err := cr.Read()
+	if err == io.EOF {
+		return nil, errors.New("missing header")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	hexCol := -1
+	cols := map[string]int{}
+	for i, name := range header {
+		name = strings.TrimSpace(name)
+		if strings.EqualFold(name, "hex") {
+			hexCol = i
+			continue
+		}
+		cols[name] = i
+	}
+	if hexCol < 0 {
+		return nil, errors.New("missing hex column")
+	}
+
+	if len(fields) > 0 {
+		selected := make(map[string]int, len(fields))
+		for _, name := range fields {
+			i, ok := cols[name]
+			if !ok {
+				return nil, fmt.Errorf("missing %s column", name)
+			}
+			selected[name] = i
+		}
+		cols = selected
+	}
+
+	tags := map[string]map[string]string{}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return tags, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		hex := strings.ToLower(strings.TrimSpace(record[hexCol]))
+		if hex == "" {
+			continue
+		}
+
+		t := map[string]string{}
+		for name, i := range cols {
+			if v := strings.TrimSpace(record[i]); v != "" {
+				t[name] = v
+			}
+		}
+		if len(t) > 0 {
+			tags[hex] = t
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testTags = `hex,owner,notes
+4CA7B5,Dummy Flying Club,Club aircraft
+a1b2c3,Another Owner,
+`
+
+func TestReadTags(t *testing.T) {
+	tags, err := readTags(strings.NewReader(testTags), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]map[string]string{
+		"4ca7b5": {"owner": "Dummy Flying Club", "notes": "Club aircraft"},
+		"a1b2c3": {"owner": "Another Owner"},
+	}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("%v != %v", tags, want)
+	}
+
+	// We expect only the configured fields to be included.
+	tags, err = readTags(strings.NewReader(testTags), []string{"notes"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want = map[string]map[string]string{
+		"4ca7b5": {"notes": "Club aircraft"},
+	}
+	if !reflect.DeepEqual(tags, want) {
+		t.Errorf("%v != %v", tags, want)
+	}
+
+	invalid := []string{"", "owner,notes\n", "hex,owner\na1,b,c\n"}
+	for _, s := range invalid {
+		_, err := readTags(strings.NewReader(s), nil)
+		if err == nil {
+			t.Errorf("expected an error for %q", s)
+		}
+	}
+
+	_, err = readTags(strings.NewReader(testTags), []string{"operator"})
+	if err == nil {
+		t.Error("expected an error for a missing field")
+	}
+}
+
+func TestTagLookup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "tags")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "tags.csv")
+	err = ioutil.WriteFile(path, []byte(testTags), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := loadTags(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := l.lookup("4ca7b5")["owner"], "Dummy Flying Club"; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+	if got := l.lookup("ffffff"); got != nil {
+		t.Errorf("unexpected tags for an aircraft not in the file: %v", got)
+	}
+
+	// We expect a reload to pick up changes, and a failed reload to keep
+	// the existing tags.
+	err = ioutil.WriteFile(path, []byte("hex,owner\nffffff,New Owner\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = l.reload()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := l.lookup("ffffff")["owner"], "New Owner"; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+
+	os.Remove(path)
+	err = l.reload()
+	if err == nil {
+		t.Error("expected an error")
+	}
+	if got, want := l.lookup("ffffff")["owner"], "New Owner"; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+}
+
+func TestPublishUpdatesTags(t *testing.T) {
+	tags, err := readTags(strings.NewReader(testTags), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	store.aircraft["4ca7b5"] = AircraftPos{aircraft: Aircraft{Hex: "4ca7b5", Flight: "A"}, modified: true}
+	store.aircraft["ffffff"] = AircraftPos{aircraft: Aircraft{Hex: "ffffff", Flight: "B"}, modified: true}
+
+	pub := &fakePublisher{}
+	u := updater{store: &store, pub: pub, opts: publishOptions{tags: &tagLookup{tags: tags}}}
+	u.publishUpdates(time.Now())
+
+	if got, want := len(pub.bodies), 2; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+	if !strings.Contains(string(pub.bodies[0]), `"tags":{"notes":"Club aircraft","owner":"Dummy Flying Club"}`) {
+		t.Errorf("expected tags in %s", pub.bodies[0])
+	}
+	if strings.Contains(string(pub.bodies[1]), `"tags"`) {
+		t.Errorf("unexpected tags in %s", pub.bodies[1])
+	}
+}
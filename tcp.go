@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// tcpClientBuffer is the number of messages queued for a TCP client before
+// it is considered too slow and disconnected.
+const tcpClientBuffer = 1024
+
+// tcpSink streams published messages as newline delimited JSON to every
+// connected TCP client. Clients receive a snapshot of the data Store when
+// they connect.
+type tcpSink struct {
+	ln      net.Listener
+	store   *Store
+	keyCase keyCase
+	lock    sync.Mutex
+	clients map[net.Conn]chan []byte
+}
+
+// StartTCPSink starts a new Go routine accepting TCP connections on the
+// provided address. An error is returned if the address can't be listened
+// on. Cancelling the provided context closes the listener and disconnects
+// all clients.
+func startTCPSink(ctx context.Context, addr string, store *Store, keyCase keyCase) (*tcpSink, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	s := &tcpSink{ln: ln, store: store, keyCase: keyCase, clients: make(map[net.Conn]chan []byte)}
+
+	go func() {
+		<-ctx.Done()
+		ln.Close()
+
+		s.lock.Lock()
+		for conn := range s.clients {
+			s.drop(conn)
+		}
+		s.lock.Unlock()
+	}()
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				if ctx.Err() == nil {
+					fmt.Fprintf(os.Stderr, "failed to accept TCP connection: %v\n", err)
+				}
+				return
+			}
+			s.add(conn)
+		}
+	}()
+
+	return s, nil
+}
+
+// Publish queues body for every connected client. Clients whose queue is
+// full are disconnected rather than allowed to block publishing.
+func (s *tcpSink) Publish(routingKey string, body []byte) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for conn, queue := range s.clients {
+		select {
+		case queue <- body:
+		default:
+			fmt.Fprintf(os.Stderr, "dropping slow TCP client %s\n", conn.RemoteAddr())
+			s.drop(conn)
+		}
+	}
+
+	return nil
+}
+
+// add queues a snapshot of the data Store for a new client and starts
+// writing to it. The Store is locked while the client is registered so
+// that no update is missed between the snapshot and the first publish.
+func (s *tcpSink) add(conn net.Conn) {
+	queue := make(chan []byte, tcpClientBuffer)
+
+	s.store.lock.RLock()
+	defer s.store.lock.RUnlock()
+
+	now := time.Now()
+	for _, k := range s.store.sortedKeys(nil, "") {
+		v := s.store.aircraft[k]
+		body, err := marshalMessage(newMessage(v, now), s.keyCase)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to marshal Aircraft: %v\n", err)
+			continue
+		}
+
+		select {
+		case queue <- body:
+		default:
+		}
+	}
+
+	s.lock.Lock()
+	s.clients[conn] = queue
+	s.lock.Unlock()
+
+	go func() {
+		// Bodies are shared by every client, so each line is built in the
+		// client's own buffer rather than appended to the body.
+		line := []byte{}
+		for body := range queue {
+			line = append(append(line[:0], body...), '\n')
+			conn.SetWriteDeadline(time.Now().Add(time.Second * 10))
+			_, err := conn.Write(line)
+			if err != nil {
+				s.lock.Lock()
+				s.drop(conn)
+				s.lock.Unlock()
+				return
+			}
+		}
+	}()
+}
+
+// drop disconnects a client. The caller must hold the lock.
+func (s *tcpSink) drop(conn net.Conn) {
+	queue, ok := s.clients[conn]
+	if !ok {
+		return
+	}
+	delete(s.clients, conn)
+	close(queue)
+	conn.Close()
+}
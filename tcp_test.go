@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTCPSink(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	store.aircraft["A"] = AircraftPos{aircraft: Aircraft{Flight: "A"}}
+
+	sink, err := startTCPSink(ctx, "127.0.0.1:0", &store, keyCaseDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", sink.ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	r := bufio.NewReader(conn)
+
+	// We expect a new client to receive a snapshot of the store.
+	if got, want := readFlight(t, r), "A"; got != want {
+		t.Errorf("%s != %s", got, want)
+	}
+
+	// Wait for the client to be registered before publishing.
+	for {
+		sink.lock.Lock()
+		n := len(sink.clients)
+		sink.lock.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	body, _ := json.Marshal(newMessage(AircraftPos{aircraft: Aircraft{Flight: "B"}}, time.Now()))
+	err = sink.Publish(keyAircraft, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// We expect published messages to follow as separate lines.
+	if got, want := readFlight(t, r), "B"; got != want {
+		t.Errorf("%s != %s", got, want)
+	}
+}
+
+func TestTCPSinkSharedBody(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	sink, err := startTCPSink(ctx, "127.0.0.1:0", &store, keyCaseDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readers := []*bufio.Reader{}
+	for i := 0; i < 2; i++ {
+		conn, err := net.Dial("tcp", sink.ln.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+		readers = append(readers, bufio.NewReader(conn))
+	}
+
+	for {
+		sink.lock.Lock()
+		n := len(sink.clients)
+		sink.lock.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// The body has spare capacity, as bodies built with append may.
+	msg, _ := json.Marshal(newMessage(AircraftPos{aircraft: Aircraft{Flight: "B"}}, time.Now()))
+	body := append(make([]byte, 0, len(msg)+8), msg...)
+	spare := body[:len(body)+1]
+	spare[len(body)] = 'x'
+
+	err = sink.Publish(keyAircraft, body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, r := range readers {
+		if got, want := readFlight(t, r), "B"; got != want {
+			t.Errorf("%s != %s", got, want)
+		}
+	}
+
+	// We expect the body shared by the clients to be left unchanged.
+	if got, want := spare[len(body)], byte('x'); got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+}
+
+// readFlight reads a line of JSON from r and returns the flight it holds.
+func readFlight(t *testing.T, r *bufio.Reader) string {
+	t.Helper()
+
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := aircraft{}
+	err = json.Unmarshal(line, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return m.Flight
+}
@@ -0,0 +1,5 @@
+package main
+
+// dump978Path is where dump978-fa writes aircraft heard on the 978MHz
+// Universal Access Transceiver (UAT) band.
+const dump978Path = "/run/dump978-fa/aircraft.json"
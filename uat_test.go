@@ -0,0 +1,77 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestReadScanUAT(t *testing.T) {
+	scan, err := readScan("data/uat_aircraft.json", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := len(scan.Aircraft), 3; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+
+	a := scan.Aircraft[0]
+	if a.Hex != "a8b5c2" || a.AltGeom != 6625 || a.Gs != 112 || a.NacP != 9 {
+		t.Errorf("unexpected decode of UAT aircraft: %+v", a)
+	}
+
+	// We expect dump978 field names to be mapped onto their dump1090
+	// equivalents.
+	if got, want := a.NavAltitudeMcp, 6000; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+	if got, want := a.Version, 2; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+}
+
+func TestMergeUAT(t *testing.T) {
+	maxAge := time.Second * 60
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+
+	es, err := readScan("data/aircraft.json", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	es.source = "data/aircraft.json"
+
+	uat, err := readScan("data/uat_aircraft.json", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uat.source = "data/uat_aircraft.json"
+
+	updateAircraft(es, &store, "dummy station")
+	purgeAircraft(es, &store, maxAge)
+	n := len(store.aircraft)
+
+	updateAircraft(uat, &store, "dummy station")
+	purgeAircraft(uat, &store, maxAge)
+
+	// We expect the UAT aircraft with a position to be merged alongside the
+	// 1090MHz aircraft, whether or not they have a callsign.
+	if got, want := len(store.aircraft), n+2; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+
+	pos, ok := store.aircraft["a8b5c2"]
+	if !ok {
+		t.Fatal("expected UAT aircraft to be stored")
+	}
+	if got, want := pos.aircraft.StationName, "dummy station"; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+
+	// A further 1090MHz scan doesn't purge the UAT aircraft.
+	updateAircraft(es, &store, "dummy station")
+	purgeAircraft(es, &store, maxAge)
+	if _, ok := store.aircraft["a8b5c2"]; !ok {
+		t.Error("expected UAT aircraft to survive a 1090MHz purge")
+	}
+}
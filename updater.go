@@ -1,141 +1,995 @@
 package main
 
 import (
+	"bytes"
+	"compress/gzip"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash/fnv"
+	"math"
+	"math/rand"
 	"os"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/streadway/amqp"
 )
 
-func startUpdater(ctx context.Context, conStr, exchange string, dur time.Duration, station string, store *Store) error {
+// Publisher sends a message body to the configured exchange. The routing
+// key is ignored by fanout exchanges.
+type Publisher interface {
+	Publish(routingKey string, body []byte) error
+}
 
-	conn, err := amqp.Dial(conStr)
-	if err != nil {
-		return fmt.Errorf("failed to connect to RabbitMQ: %w", err)
+// batchPublisher is implemented by Publishers that can publish several
+// messages together, returning the error for each in order. RabbitMQ
+// publishes a batch before waiting for the broker to confirm it, rather
+// than waiting after each message.
+type batchPublisher interface {
+	publishBatch(msgs []pendingMessage) []error
+}
+
+// publishBatch publishes msgs to p, as a batch if p supports them and
+// otherwise one at a time, returning the error for each in order.
+func publishBatch(p Publisher, msgs []pendingMessage) []error {
+	if b, ok := p.(batchPublisher); ok {
+		return b.publishBatch(msgs)
+	}
+
+	errs := make([]error, len(msgs))
+	for i, m := range msgs {
+		errs[i] = p.Publish(m.routingKey, m.body)
+	}
+	return errs
+}
+
+// Routing keys used for published messages.
+const (
+	keyAircraft = ""        // aircraft positions, counts and statistics
+	keyRange    = "range"   // aircraft entering or leaving range
+	keyNormal   = "normal"  // aircraft not declaring an emergency, when routing by emergency
+	keySummary  = "summary" // summaries of the aircraft tracked
+)
+
+// Supported exchange kinds.
+const (
+	exchangeFanout = "fanout"
+	exchangeDirect = "direct"
+	exchangeTopic  = "topic"
+)
+
+// parseExchangeKind validates an exchange kind read from the configuration
+// file. An empty value selects the default of a fanout exchange. Routing by
+// emergency requires an exchange that routes on the routing key.
+func parseExchangeKind(s string, routeByEmergency bool) (string, error) {
+	switch s {
+	case "":
+		s = exchangeFanout
+	case exchangeFanout, exchangeDirect, exchangeTopic:
+	default:
+		return exchangeFanout, fmt.Errorf("unknown exchange kind %q, expected %q, %q or %q", s, exchangeFanout, exchangeDirect, exchangeTopic)
+	}
+
+	if routeByEmergency && s == exchangeFanout {
+		return s, fmt.Errorf("routing by emergency requires a %q or %q exchange", exchangeDirect, exchangeTopic)
+	}
+	return s, nil
+}
+
+// validateExchangeName checks that the exchange named in the configuration
+// file can be declared. An empty name refers to the broker's default
+// exchange, which routes messages to the queue named by their routing key
+// and so would silently drop them, and names starting with "amq." are
+// reserved by the broker.
+func validateExchangeName(name string) error {
+	switch {
+	case strings.TrimSpace(name) == "":
+		return errors.New("exchange name is empty, messages would be sent to the default exchange and dropped")
+	case strings.HasPrefix(name, "amq."):
+		return fmt.Errorf("exchange name %q is reserved by the broker", name)
+	}
+	return nil
+}
+
+// exchangeError reports a failure to declare the exchange.
+type exchangeError struct {
+	exchange string
+	kind     string
+	err      error
+}
+
+func (e *exchangeError) Error() string {
+	if e.permanent() {
+		return fmt.Sprintf("failed to declare %s exchange %s, check it doesn't already exist with a different kind or settings and that the user may configure it: %v", e.kind, e.exchange, e.err)
+	}
+	return fmt.Sprintf("failed to declare %s exchange %s: %v", e.kind, e.exchange, e.err)
+}
+
+func (e *exchangeError) Unwrap() error {
+	return e.err
+}
+
+// permanent reports whether the failure is caused by the configuration,
+// such as an existing exchange of a different kind or a user without
+// permission to declare it, and so isn't worth retrying.
+func (e *exchangeError) permanent() bool {
+	var ae *amqp.Error
+	if !errors.As(e.err, &ae) {
+		return false
+	}
+	return ae.Code == amqp.PreconditionFailed || ae.Code == amqp.AccessRefused || ae.Code == amqp.NotAllowed
+}
+
+// maxPublishWorkers bounds the number of channels opened for publishing so
+// that a misconfiguration can't exhaust the broker.
+const maxPublishWorkers = 16
+
+// publishMode determines which tracked aircraft are published on each tick.
+type publishMode string
+
+// Supported publish modes.
+const (
+	publishOnChange publishMode = "on-change" // publish aircraft that have moved
+	publishAlways   publishMode = "always"    // publish every aircraft on every tick
+)
+
+// parsePublishMode validates a publish mode read from the configuration
+// file. An empty value selects the default of publishing on change.
+func parsePublishMode(s string) (publishMode, error) {
+	switch m := publishMode(s); m {
+	case "":
+		return publishOnChange, nil
+	case publishOnChange, publishAlways:
+		return m, nil
 	}
+	return publishOnChange, fmt.Errorf("unknown publish mode %q, expected %q or %q", s, publishOnChange, publishAlways)
+}
+
+// publishOptions control which aircraft are published on each tick.
+type publishOptions struct {
+	mode             publishMode    // which aircraft are published on each tick
+	refreshEvery     time.Duration  // republish unchanged aircraft at least this often
+	flushOnEmpty     time.Duration  // publish a zero count once the store has been empty this long
+	sinks            []Publisher    // additional publishers that receive every message
+	keyCase          keyCase        // casing applied to keys in published messages
+	statsEvery       time.Duration  // publish signal statistics this often
+	sampleRate       float64        // fraction of aircraft to publish, zero publishes all
+	station          *location      // location of the station, if known
+	distanceMethod   distanceMethod // how distances from the station are measured
+	maxRange         float64        // range of the station in nautical miles, zero disables range events
+	rangeHysteresis  float64        // distance beyond maxRange an aircraft must travel to leave range
+	updateJitter     time.Duration  // maximum random variation in the update interval
+	sequence         bool           // number published messages in sequence
+	compressAbove    int            // compress messages larger than this many bytes, zero disables compression
+	includeSource    bool           // include the path of the source each aircraft was read from
+	publishWorkers   int            // number of channels aircraft are published on concurrently
+	breaker          *breaker       // circuit breaker around the publisher, if any
+	exchangeKind     string         // kind of exchange declared, defaults to fanout
+	durable          bool           // declare the exchange as durable, so that it survives a broker restart
+	persistent       bool           // publish messages as persistent, so that queued messages survive a broker restart
+	routeByEmergency bool           // publish aircraft with their emergency status as the routing key
+
+	quality  *qualityWeights // weights used to score the quality of each aircraft, if enabled
+	interval *interval       // interval between updates, overriding dur if set
+	tags     *tagLookup      // custom tags added to aircraft, if any
+
+	stations map[string]location // location of additional stations by name, overriding station
+
+	idleAfter  time.Duration // stop publishing aircraft that haven't moved for this long, zero disables
+	idleJitter float64       // movement in nautical miles ignored when deciding if an aircraft is idle
+
+	deltaFields bool // publish only the fields of aircraft that have changed since they were last published
+	summary     bool // publish a summary of the aircraft tracked on every tick
 
-	rmqCh, err := conn.Channel()
+	audit    *auditLog     // log of messages accepted by the broker, if any
+	airlines airlineLookup // airlines added to aircraft by callsign, if enabled
+
+	maxMessageBytes int           // messages larger than this are dropped, zero disables the limit
+	debounce        time.Duration // publish changes this long after they are made, rather than waiting for the next update, zero disables
+
+	confirmTimeout time.Duration // wait this long for the broker to confirm each message, zero disables confirms
+}
+
+// idle reports whether the aircraft at pos has stayed within idleJitter of
+// where it last moved for at least idleAfter, as parked aircraft with
+// jittering positions do. Where and when the aircraft last moved are
+// updated in pos. Aircraft without a position are never idle.
+func (o publishOptions) idle(pos *AircraftPos, now time.Time) bool {
+	if o.idleAfter <= 0 || !pos.aircraft.hasPosition() {
+		return false
+	}
+
+	here := location{Lat: pos.aircraft.Lat, Lon: pos.aircraft.Lon}
+	if pos.movedAt.IsZero() || o.distanceMethod.distance(pos.anchor, here) > o.idleJitter {
+		pos.anchor = here
+		pos.movedAt = now
+		return false
+	}
+	return now.Sub(pos.movedAt) >= o.idleAfter
+}
+
+// stationLocation returns the location of the named station, falling back
+// to the location of the station if it has none of its own.
+func (o publishOptions) stationLocation(name string) *location {
+	if loc, ok := o.stations[name]; ok {
+		return &loc
+	}
+	return o.station
+}
+
+// updater publishes changes in the data Store to a Publisher.
+type updater struct {
+	store   *Store
+	pub     Publisher
+	workers []Publisher // publishers used concurrently to publish aircraft, if more than one
+	opts    publishOptions
+	station string
+
+	emptySince time.Time // when the data Store was first seen empty
+	emptySent  bool      // whether the empty state has been published
+	statsSent  time.Time // when signal statistics were last published
+	seq        uint64    // sequence number of the last message published
+}
+
+func startUpdater(ctx context.Context, conStr, exchange string, dur time.Duration, station string, store *Store, opts publishOptions) error {
+	if store == nil {
+		return errors.New("no data store provided")
+	}
+
+	kind := opts.exchangeKind
+	if kind == "" {
+		kind = exchangeFanout
+	}
+
+	// Channels aren't safe for concurrent use so each additional publish
+	// worker is given its own.
+	conn, err := newBrokerConnection(conStr, exchange, kind, opts.durable, opts.publishWorkers, opts.confirmTimeout)
 	if err != nil {
-		return fmt.Errorf("failed to open a channel: %w", err)
+		return err
 	}
 
-	closures := conn.NotifyClose(make(chan *amqp.Error))
-	go func() {
-		for {
-			select {
-			case <-ctx.Done():
-				return
-			case <-closures:
-				var err error
-				rmqCh, err = conn.Channel()
+	iv := opts.interval
+	if iv == nil {
+		iv = newInterval(dur)
+	}
+	u := updater{store: store, opts: opts, station: station}
+
+	// connect publishes to the current channels, which are reopened if the
+	// connection is lost. While disconnected, publishing to RabbitMQ fails
+	// with errChannelUnavailable but the sinks are still sent messages.
+	connect := func() bool {
+		chs := conn.current()
+		if chs == nil {
+			u.pub = u.withSinks(&amqpPublisher{})
+			u.workers = nil
+			return false
+		}
+
+		u.pub = u.withSinks(&amqpPublisher{ch: chs[0].Channel, confirms: chs[0].confirms, exchange: exchange, stationID: stationID(station), compressAbove: opts.compressAbove, maxBytes: opts.maxMessageBytes, persistent: opts.persistent})
+		u.workers = nil
+		if len(chs) > 1 {
+			u.workers = []Publisher{u.pub}
+			for _, ch := range chs[1:] {
+				u.workers = append(u.workers, u.withSinks(&amqpPublisher{ch: ch.Channel, confirms: ch.confirms, exchange: exchange, stationID: stationID(station), compressAbove: opts.compressAbove, maxBytes: opts.maxMessageBytes, persistent: opts.persistent}))
+			}
+		}
+		return true
+	}
+
+	go conn.maintain(ctx)
+	go u.run(ctx, iv, connect)
+
+	return nil
+}
+
+// run publishes updates on every tick of iv until the context is cancelled,
+// calling connect to set the publishers before each round of publishing.
+// While connect reports that there is no connection, rounds are still
+// published to the sinks, which are sent each change once, and aircraft
+// that fail to publish remain modified to be published to RabbitMQ once
+// it is re-established.
+// If debouncing is configured, changes to the data Store are also
+// published promptly, once debounce has passed since the first change, so
+// that any number of changes in that time are published together.
+func (u *updater) run(ctx context.Context, iv *interval, connect func() bool) {
+	dur, changed := iv.get()
+	timer := time.NewTimer(jitter(dur, u.opts.updateJitter))
+	defer timer.Stop()
+
+	var changes <-chan struct{}
+	if u.opts.debounce > 0 {
+		changes = u.store.changes
+	}
+
+	// debounce is set while changes are waiting to be published
+	var debounce <-chan time.Time
+
+	// unavailable is set while there is no channel to publish to
+	unavailable := false
+	ready := func() {
+		ok := connect()
+		if !ok && !unavailable {
+			fmt.Fprintln(os.Stderr, "channel unavailable, publishing to sinks only")
+		}
+		unavailable = !ok
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+
+		case <-changed:
+			if !timer.Stop() {
+				<-timer.C
+			}
+			dur, changed = iv.get()
+			timer.Reset(jitter(dur, u.opts.updateJitter))
+
+		case <-changes:
+			if debounce == nil {
+				debounce = time.After(u.opts.debounce)
+			}
+
+		case now := <-debounce:
+			debounce = nil
+			ready()
+			u.publishUpdates(now)
+			u.publishRangeEvents(now)
+
+		case now := <-timer.C:
+			timer.Reset(jitter(dur, u.opts.updateJitter))
+			ready()
+			u.publishUpdates(now)
+			u.publishRangeEvents(now)
+			u.publishEmpty(now)
+			u.publishStats(now)
+			u.publishSummary(now)
+		}
+	}
+}
+
+// withSinks returns a Publisher that sends messages to p and each of the
+// additional sinks. Only p is guarded by the circuit breaker, if one is
+// configured, so that the sinks are still sent messages while the broker
+// is failing. Messages accepted by p are recorded in the audit log, if
+// there is one.
+func (u *updater) withSinks(p Publisher) Publisher {
+	if u.opts.breaker != nil {
+		p = u.opts.breaker.wrap(p)
+	}
+	if u.opts.audit != nil {
+		p = u.opts.audit.wrap(p)
+	}
+	return append(multiPublisher{p}, u.opts.sinks...)
+}
+
+// sequence returns the next sequence number for a published message, or
+// zero if messages aren't numbered. Numbers are consumed even if the
+// message fails to publish, so a gap indicates a message was lost.
+func (u *updater) sequence() uint64 {
+	if !u.opts.sequence {
+		return 0
+	}
+	u.seq++
+	return u.seq
+}
+
+// jitter returns dur adjusted by a random amount between -j and +j, so
+// that the average of many intervals is dur. The result is never less than
+// a millisecond.
+func jitter(dur, j time.Duration) time.Duration {
+	if j <= 0 {
+		return dur
+	}
+
+	d := dur + time.Duration(rand.Int63n(int64(2*j)+1)) - j
+	if d < time.Millisecond {
+		d = time.Millisecond
+	}
+	return d
+}
+
+// publishUpdates publishes every aircraft in the data Store that has been
+// modified since it was last published, or that has not been published
+// within the refresh interval. In the always publish mode every aircraft is
+// published. Aircraft are only marked as published if the publish succeeds.
+// Aircraft left modified by a failure are only sent to the sinks again once
+// they change.
+func (u *updater) publishUpdates(now time.Time) {
+	pending, snapshots := u.pendingUpdates(now)
+	published, sunk := u.publishAll(pending)
+
+	u.store.lock.Lock()
+	defer u.store.lock.Unlock()
+
+	for _, m := range sunk {
+		v, ok := u.store.aircraft[m.storeKey]
+		if !ok {
+			continue
+		}
+		if v.aircraft == m.aircraft {
+			v.sinkSent = true
+		}
+		if u.opts.deltaFields {
+			v.sinkLastSent = snapshots[m.storeKey]
+		}
+		u.store.aircraft[m.storeKey] = v
+	}
+
+	for _, m := range published {
+		// Aircraft purged while being published aren't restored, and
+		// those updated are left modified so that the update is
+		// published too.
+		v, ok := u.store.aircraft[m.storeKey]
+		if !ok {
+			continue
+		}
+		if v.aircraft == m.aircraft {
+			v.modified = false
+		}
+		v.published = now
+		if u.opts.deltaFields {
+			v.lastSent = snapshots[m.storeKey]
+		}
+		u.store.aircraft[m.storeKey] = v
+	}
+}
+
+// pendingUpdates returns the messages for the aircraft due to be
+// published, in order, along with the fields of each message if delta
+// fields are enabled. The data Store's lock is held only while they are
+// chosen, so that publishing doesn't hold up updates to the data Store.
+func (u *updater) pendingUpdates(now time.Time) ([]pendingMessage, map[string]map[string]json.RawMessage) {
+	u.store.lock.Lock()
+	defer u.store.lock.Unlock()
+
+	pending := []pendingMessage{}
+	snapshots := map[string]map[string]json.RawMessage{}
+	for _, k := range u.store.sortedKeys(u.opts.station, u.opts.distanceMethod) {
+		v := u.store.aircraft[k]
+		refresh := u.opts.refreshEvery > 0 && now.Sub(v.published) >= u.opts.refreshEvery
+		if v.modified == false && refresh == false && u.opts.mode != publishAlways {
+			continue
+		}
+
+		// Idle aircraft are left modified so that they are published as
+		// soon as they move again.
+		idle := u.opts.idle(&v, now)
+		u.store.aircraft[k] = v
+		if idle {
+			continue
+		}
+
+		if !sampled(v.aircraft, u.opts.sampleRate) {
+			continue
+		}
+
+		m := newMessage(v, now)
+		m.Seq = u.sequence()
+		if u.opts.quality != nil {
+			q := u.opts.quality.score(v.aircraft)
+			m.Quality = &q
+		}
+		if loc := u.opts.stationLocation(v.aircraft.StationName); loc != nil && v.aircraft.hasPosition() {
+			d := u.opts.distanceMethod.distance(*loc, location{Lat: v.aircraft.Lat, Lon: v.aircraft.Lon})
+			m.Distance = &d
+		}
+		if u.opts.includeSource {
+			m.Source = v.source
+		}
+		if u.opts.tags != nil {
+			m.Tags = u.opts.tags.lookup(v.aircraft.Hex)
+		}
+		if u.opts.airlines != nil {
+			m.Airline = u.opts.airlines.lookup(v.aircraft.Flight)
+		}
+
+		// Aircraft the sinks have already been sent, while publishing
+		// them to RabbitMQ has failed, aren't sent to them again.
+		toSinks := !v.modified || !v.sinkSent
+
+		var msg, sinkMsg interface{} = m, m
+		if u.opts.deltaFields {
+			fields, err := messageFields(m)
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "failed to marshal Aircraft: %v\n", err)
+				continue
+			}
+			snapshots[k] = fields
+
+			// Aircraft not yet published are published in full.
+			if v.lastSent != nil {
+				msg = delta(v.lastSent, fields)
+			}
+			if v.sinkLastSent != nil {
+				sinkMsg = delta(v.sinkLastSent, fields)
+			}
+		}
+
+		body, err := marshalMessage(msg, u.opts.keyCase)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "failed to marshal Aircraft: %v\n", err)
+			continue
+		}
+
+		var sinkBody []byte
+		if toSinks {
+			sinkBody = body
+			if u.opts.deltaFields {
+				sinkBody, err = marshalMessage(sinkMsg, u.opts.keyCase)
 				if err != nil {
-					fmt.Fprintf(os.Stderr, "failed to open a channel: %s", err)
+					fmt.Fprintf(os.Stderr, "failed to marshal Aircraft: %v\n", err)
+					continue
 				}
 			}
 		}
-	}()
 
-	rmqCh.ExchangeDeclare(
-		exchange, // name
-		"fanout", // kind
-		false,    // durable
-		false,    // delete when unused
-		false,    // exclusive
-		false,    // no-wait
-		nil,      // arguments
-	)
+		key := keyAircraft
+		if u.opts.routeByEmergency {
+			key = emergencyKey(v.aircraft)
+		}
+
+		pending = append(pending, pendingMessage{storeKey: k, routingKey: key, body: body, sinkBody: sinkBody, aircraft: v.aircraft})
+	}
+	return pending, snapshots
+}
+
+// pendingMessage is a message waiting to be published for an aircraft.
+type pendingMessage struct {
+	storeKey   string   // key of the aircraft in the data Store
+	aircraft   Aircraft // the aircraft as it was when the message was made
+	routingKey string
+	body       []byte
+	sinkBody   []byte // body sent to the sinks, nil if they aren't to be sent it
+}
+
+// publishAll publishes each message, returning those published
+// successfully, along with those delivered to every sink. Messages are
+// published as a batch, or split into a batch for each worker if there is
+// more than one.
+func (u *updater) publishAll(msgs []pendingMessage) (published, sunk []pendingMessage) {
+	if len(u.workers) <= 1 {
+		return publishSplit(u.pub, msgs)
+	}
+
+	// Messages are dealt to the workers in turn.
+	batches := make([][]pendingMessage, len(u.workers))
+	for i, m := range msgs {
+		n := i % len(u.workers)
+		batches[n] = append(batches[n], m)
+	}
+
+	results := make([][]pendingMessage, len(u.workers))
+	sinkResults := make([][]pendingMessage, len(u.workers))
+	wg := sync.WaitGroup{}
+	for n, p := range u.workers {
+		wg.Add(1)
+		go func(n int, p Publisher) {
+			defer wg.Done()
+			results[n], sinkResults[n] = publishSplit(p, batches[n])
+		}(n, p)
+	}
+	wg.Wait()
+
+	for n := range results {
+		published = append(published, results[n]...)
+		sunk = append(sunk, sinkResults[n]...)
+	}
+	return published, sunk
+}
+
+// publishSplit publishes msgs with p, returning those published
+// successfully. If p also sends messages to sinks, as withSinks does, the
+// sinks are only sent the messages with a sinkBody, and those delivered to
+// every sink are returned separately, so that RabbitMQ failing doesn't
+// cause messages to be sent to the sinks again.
+func publishSplit(p Publisher, msgs []pendingMessage) (published, sunk []pendingMessage) {
+	m, ok := p.(multiPublisher)
+	if !ok || len(m) < 2 {
+		return succeeded(msgs, publishBatch(p, msgs)), nil
+	}
+
+	published = succeeded(msgs, publishBatch(m[0], msgs))
+
+	toSinks := []pendingMessage{}
+	for _, msg := range msgs {
+		if msg.sinkBody != nil {
+			msg.body = msg.sinkBody
+			toSinks = append(toSinks, msg)
+		}
+	}
+	return published, succeeded(toSinks, publishBatch(m[1:], toSinks))
+}
+
+// succeeded returns the messages that were published without error,
+// logging the errors of those that weren't.
+func succeeded(msgs []pendingMessage, errs []error) []pendingMessage {
+	published := []pendingMessage{}
+	for i, err := range errs {
+		if err != nil {
+			logPublishError(err)
+			continue
+		}
+		published = append(published, msgs[i])
+	}
+	return published
+}
+
+// publishEmpty publishes a zero aircraft count once the data Store has
+// remained empty for the flushOnEmpty interval. The count is published
+// once for each transition to empty.
+func (u *updater) publishEmpty(now time.Time) {
+	if u.opts.flushOnEmpty == 0 {
+		return
+	}
 
-	ticker := time.NewTicker(dur)
+	u.store.lock.Lock()
+	empty := len(u.store.aircraft) == 0
+	u.store.lock.Unlock()
+
+	if empty == false {
+		u.emptySince = time.Time{}
+		u.emptySent = false
+		return
+	}
+
+	if u.emptySince.IsZero() {
+		u.emptySince = now
+	}
+
+	if u.emptySent || now.Sub(u.emptySince) < u.opts.flushOnEmpty {
+		return
+	}
+
+	body, err := marshalMessage(countMessage{
+		Type:        "COUNT",
+		Count:       0,
+		Timestamp:   now.UnixNano() / 1000,
+		StationName: u.station,
+		StationID:   stationID(u.station),
+		Seq:         u.sequence(),
+	}, u.opts.keyCase)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to marshal count: %v\n", err)
+		return
+	}
+
+	err = u.pub.Publish(keyAircraft, body)
+	if err != nil {
+		logPublishError(err)
+		return
+	}
+
+	u.emptySent = true
+}
+
+// publishStats publishes signal statistics for the aircraft in the data
+// Store once every statsEvery interval.
+func (u *updater) publishStats(now time.Time) {
+	if u.opts.statsEvery == 0 || now.Sub(u.statsSent) < u.opts.statsEvery {
+		return
+	}
+
+	stats := computeStats(u.store, u.opts.station, u.opts.distanceMethod)
+	stats.Timestamp = now.UnixNano() / 1000
+	stats.StationName = u.station
+	stats.StationID = stationID(u.station)
+	stats.Seq = u.sequence()
+	if rate, ok := messageRates.total(); ok {
+		stats.MessageRate = &rate
+	}
+
+	body, err := marshalMessage(stats, u.opts.keyCase)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to marshal stats: %v\n", err)
+		return
+	}
+
+	err = u.pub.Publish(keyAircraft, body)
+	if err != nil {
+		logPublishError(err)
+		return
+	}
+
+	u.statsSent = now
+}
+
+// sampled reports whether an aircraft is included in a sample of the given
+// rate. Aircraft are selected by a hash of their hex code so the same
+// aircraft is consistently included or excluded. Aircraft declaring an
+// emergency are always included, as are all aircraft when rate is zero.
+func sampled(a Aircraft, rate float64) bool {
+	if rate <= 0 || rate >= 1 || parseEmergency(a.Emergency).Active() {
+		return true
+	}
+
+	key := a.Hex
+	if key == "" {
+		key = a.Flight
+	}
 
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return float64(h.Sum32()) < rate*float64(math.MaxUint32)
+}
+
+// emergencyKey returns the routing key for an aircraft when routing by
+// emergency: the emergency it has declared, or "normal" if none.
+func emergencyKey(a Aircraft) string {
+	e := parseEmergency(a.Emergency)
+	if !e.Active() {
+		return keyNormal
+	}
+	return string(e)
+}
+
+// logPublishError logs a failure to publish a message. Messages skipped
+// while the circuit breaker is open, or while there is no channel, aren't
+// logged, as each is reported once when it begins.
+func logPublishError(err error) {
+	if errors.Is(err, errBreakerOpen) || errors.Is(err, errChannelUnavailable) {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "failed to publish to exchange: %v\n", err)
+}
+
+// multiPublisher publishes messages to every Publisher it holds.
+type multiPublisher []Publisher
+
+// Publish sends body to each Publisher in turn, returning the first error
+// encountered once all have been attempted.
+func (m multiPublisher) Publish(routingKey string, body []byte) error {
+	var firstErr error
+	for _, p := range m {
+		err := p.Publish(routingKey, body)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// publishBatch sends msgs to each Publisher in turn, returning the first
+// error encountered for each message once all have been attempted.
+func (m multiPublisher) publishBatch(msgs []pendingMessage) []error {
+	errs := make([]error, len(msgs))
+	for _, p := range m {
+		for i, err := range publishBatch(p, msgs) {
+			if err != nil && errs[i] == nil {
+				errs[i] = err
+			}
+		}
+	}
+	return errs
+}
+
+// amqpChannel is the part of a RabbitMQ channel used to publish messages.
+type amqpChannel interface {
+	Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error
+}
+
+// amqpPublisher publishes messages to a RabbitMQ exchange.
+type amqpPublisher struct {
+	ch            amqpChannel
+	exchange      string
+	stationID     string // sent in the station_id header of every message
+	compressAbove int    // bodies larger than this many bytes are compressed, zero disables compression
+	maxBytes      int    // bodies larger than this many bytes, once compressed, are dropped, zero disables the limit
+
+	confirms   *confirmer // waits for the broker to confirm each message, if enabled
+	persistent bool       // publish messages as persistent rather than transient
+}
+
+// errChannelUnavailable is returned when publishing without an open channel.
+var errChannelUnavailable = errors.New("channel unavailable")
+
+// Publish sends body to the exchange as a JSON message, transient unless
+// the publisher is persistent. The time of each successful publish is
+// recorded in lastPublished. Messages larger than maxBytes are dropped and
+// counted, rather than failing, so that they aren't retried. Publishing
+// without a channel fails with errChannelUnavailable. With publisher
+// confirms enabled, messages the broker rejects or doesn't confirm in time
+// fail.
+func (p *amqpPublisher) Publish(routingKey string, body []byte) error {
+	return p.publishBatch([]pendingMessage{{routingKey: routingKey, body: body}})[0]
+}
+
+// publishBatch publishes msgs as Publish does, returning the error for
+// each. With publisher confirms enabled, the confirmations are collected
+// while the batch is published, rather than waited for after each
+// message, and the whole batch must be confirmed within the timeout.
+// Messages still unconfirmed once it has passed fail.
+func (p *amqpPublisher) publishBatch(msgs []pendingMessage) []error {
+	errs := make([]error, len(msgs))
+	if p.ch == nil {
+		for i := range errs {
+			errs[i] = errChannelUnavailable
+		}
+		return errs
+	}
+
+	// The collector waits for the confirmation of each message as it is
+	// published, recording the errors of those that fail.
+	var deadline time.Time
+	if p.confirms != nil {
+		deadline = time.Now().Add(p.confirms.timeout)
+	}
+
+	published := make(chan int, len(msgs))
+	collected := make(chan struct{})
 	go func() {
-		defer conn.Close()
-		defer rmqCh.Close()
-		defer ticker.Stop()
-
-		for {
-			select {
-			case <-ctx.Done():
-				return
-
-			case <-ticker.C:
-
-				for _, v := range store.aircraft {
-					if v.modified == false {
-						continue
-					}
-
-					// use the old aircraft definition here
-					a := aircraft{
-						Flight:      v.aircraft.Flight,
-						Lon:         v.aircraft.Lon,
-						Lat:         v.aircraft.Lat,
-						Track:       v.aircraft.Track,
-						Speed:       v.aircraft.Tas, // use True Air Speed
-						Hex:         v.aircraft.Hex,
-						Squawk:      v.aircraft.Squawk,
-						Seen:        v.aircraft.Seen,
-						SeenPos:     v.aircraft.SeenPos,
-						Messages:    v.aircraft.Messages,
-						Category:    v.aircraft.Category,
-						Timestamp:   v.aircraft.Timestamp,
-						Altitude:    v.aircraft.AltGeom, // use the Geometric Altitude
-						VertRate:    v.aircraft.GeomRate,
-						Rssi:        v.aircraft.Rssi,
-						Type:        v.aircraft.Type,
-						StationName: v.aircraft.StationName,
-					}
-
-					body, err := json.Marshal(a)
-					if err != nil {
-						fmt.Fprintf(os.Stderr, "failed to marshal Aircraft: %v\n", err)
-					}
-
-					msg := amqp.Publishing{
-						DeliveryMode: amqp.Transient,
-						Timestamp:    time.Now(),
-						ContentType:  "application/json",
-						Body:         body,
-					}
-
-					store.lock.Lock()
-					err = rmqCh.Publish(exchange, "", false, false, msg)
-					if err != nil {
-						fmt.Fprintf(os.Stderr, "failed to publish to exchange: %v\n", err)
-					}
-					v.modified = false
-					store.lock.Unlock()
-				}
+		defer close(collected)
+		for i := range published {
+			if p.confirms != nil {
+				errs[i] = p.confirms.waitUntil(deadline)
 			}
 		}
 	}()
 
-	return nil
+	timestamps := make([]time.Time, len(msgs))
+	for i, m := range msgs {
+		msg, err := p.publishing(m.body)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if p.maxBytes > 0 && len(msg.Body) > p.maxBytes {
+			dropTooLarge(len(msg.Body))
+			continue
+		}
+
+		err = p.ch.Publish(p.exchange, m.routingKey, false, false, msg)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		timestamps[i] = msg.Timestamp
+		published <- i
+	}
+	close(published)
+	<-collected
+
+	for i, ts := range timestamps {
+		if errs[i] == nil && !ts.IsZero() {
+			lastPublished.set(ts)
+		}
+	}
+	return errs
+}
+
+// publishing returns the message published for body, with the station
+// header set and marked persistent if the publisher is.
+func (p *amqpPublisher) publishing(body []byte) (amqp.Publishing, error) {
+	msg, err := newPublishing(body, p.compressAbove)
+	if err != nil {
+		return msg, err
+	}
+
+	msg.Headers = amqp.Table{"station_id": p.stationID}
+	if p.persistent {
+		msg.DeliveryMode = amqp.Persistent
+	}
+	return msg, nil
+}
+
+// newPublishing returns a transient JSON message holding body. Bodies
+// larger than compressAbove bytes are gzip compressed, with the content
+// encoding set to match, unless compressAbove is zero.
+func newPublishing(body []byte, compressAbove int) (amqp.Publishing, error) {
+	msg := amqp.Publishing{
+		DeliveryMode: amqp.Transient,
+		Timestamp:    time.Now(),
+		ContentType:  "application/json",
+		Body:         body,
+	}
+
+	if compressAbove <= 0 || len(body) <= compressAbove {
+		return msg, nil
+	}
+
+	buf := &bytes.Buffer{}
+	zw := gzip.NewWriter(buf)
+	_, err := zw.Write(body)
+	if err != nil {
+		return msg, fmt.Errorf("failed to compress message: %w", err)
+	}
+	err = zw.Close()
+	if err != nil {
+		return msg, fmt.Errorf("failed to compress message: %w", err)
+	}
+
+	msg.ContentEncoding = "gzip"
+	msg.Body = buf.Bytes()
+	return msg, nil
+}
+
+// newMessage converts a stored aircraft into the message format published
+// to the exchange at time now.
+func newMessage(pos AircraftPos, now time.Time) aircraft {
+	a := pos.aircraft
+
+	// use the old aircraft definition here
+	return aircraft{
+		Flight:      a.Flight,
+		Lon:         a.Lon,
+		Lat:         a.Lat,
+		Track:       a.Track,
+		Speed:       a.Tas, // use True Air Speed
+		Hex:         a.Hex,
+		Squawk:      a.Squawk,
+		Emergency:   parseEmergency(a.Emergency),
+		Seen:        a.Seen,
+		SeenPos:     a.SeenPos,
+		Messages:    a.Messages,
+		Category:    a.Category,
+		Timestamp:   a.Timestamp,
+		Altitude:    a.AltGeom, // use the Geometric Altitude
+		VertRate:    a.GeomRate,
+		Rssi:        a.Rssi,
+		Type:        a.Type,
+		StationName: a.StationName,
+		StationID:   stationID(a.StationName),
+		Reg:         a.Reg,
+		AcType:      a.AcType,
+		Nic:         a.Nic,
+		NacP:        a.NacP,
+		Sil:         a.Sil,
+		AgeSeconds:  pos.age(now),
+	}
 }
 
 // Aircraft is an internal representation of the aircraft schema. It is used to preserve the
 // structure of aircraft messages while clients switch to the FlightAware version of the JSON.
 // A long term goal should look at creating an internal structure specificly for the information
-// we use.
+// we use. The kinematic fields (altitude, speed, track and vert_rate) are always present, as
+// consumers treat a missing field as unknown rather than zero.
 type aircraft struct {
-	Flight      string  `json:"flight"`
-	Lon         float64 `json:"lon"`
-	Lat         float64 `json:"lat"`
-	Track       float64 `json:"track"`
-	Speed       int     `json:"speed,omitempty"`
-	Hex         string  `json:"hex"`
-	Squawk      string  `json:"squawk,omitempty"`
-	Seen        float64 `json:"seen,omitempty"`
-	SeenPos     float64 `json:"seen_pos,omitempty"`
-	Messages    int     `json:"messages,omitempty"`
-	Category    string  `json:"category,omitempty"`
-	NUCP        int     `json:"nucp,omitempty"`
-	Timestamp   int64   `json:"timestamp,omitempty"`
-	Altitude    int     `json:"altitude"`
-	VertRate    int     `json:"vert_rate,omitempty"`
-	Rssi        float64 `json:"rssi,omitempty"`
-	Type        string  `json:"type"`
-	StationName string  `json:"groundStationName"`
+	Flight      string    `json:"flight"`
+	Lon         float64   `json:"lon,omitempty"`
+	Lat         float64   `json:"lat,omitempty"`
+	Track       float64   `json:"track"`
+	Speed       int       `json:"speed"`
+	Hex         string    `json:"hex"`
+	Squawk      string    `json:"squawk,omitempty"`
+	Emergency   Emergency `json:"emergency,omitempty"`
+	Seen        float64   `json:"seen,omitempty"`
+	SeenPos     float64   `json:"seen_pos,omitempty"`
+	Messages    int       `json:"messages,omitempty"`
+	Category    string    `json:"category,omitempty"`
+	NUCP        int       `json:"nucp,omitempty"`
+	Nic         int       `json:"nic,omitempty"`
+	NacP        int       `json:"nac_p,omitempty"`
+	Sil         int       `json:"sil,omitempty"`
+	Timestamp   int64     `json:"timestamp,omitempty"`
+	Altitude    int       `json:"altitude"`
+	VertRate    int       `json:"vert_rate"`
+	Rssi        float64   `json:"rssi,omitempty"`
+	Quality     *float64  `json:"quality,omitempty"`
+	Distance    *float64  `json:"distance,omitempty"`
+	Type        string    `json:"type"`
+	StationName string    `json:"groundStationName"`
+	StationID   string    `json:"groundStationId"`
+	Reg         string    `json:"registration,omitempty"`
+	Airline     string    `json:"airline,omitempty"`
+	AcType      string    `json:"aircraft_type,omitempty"`
+	AgeSeconds  float64   `json:"age_seconds"`
+	Seq         uint64    `json:"seq,omitempty"`
+	Source      string    `json:"source,omitempty"`
+
+	Tags map[string]string `json:"tags,omitempty"` // custom tags, such as the owner
+}
+
+// countMessage reports the number of aircraft currently tracked by a
+// ground station.
+type countMessage struct {
+	Type        string `json:"type"`
+	Count       int    `json:"count"`
+	Timestamp   int64  `json:"timestamp"`
+	StationName string `json:"groundStationName"`
+	StationID   string `json:"groundStationId"`
+	Seq         uint64 `json:"seq,omitempty"`
 }
@@ -1 +1,1140 @@
 package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/streadway/amqp"
+)
+
+// fakePublisher records the messages published to it.
+type fakePublisher struct {
+	keys   []string
+	bodies [][]byte
+	err    error
+}
+
+func (p *fakePublisher) Publish(routingKey string, body []byte) error {
+	if p.err != nil {
+		return p.err
+	}
+	p.keys = append(p.keys, routingKey)
+	p.bodies = append(p.bodies, body)
+	return nil
+}
+
+func TestStartUpdater(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	t.Run("invalid store", func(t *testing.T) {
+		err := startUpdater(ctx, "amqp://localhost", "dummy exchange", time.Second, "dummy station", nil, publishOptions{})
+		if err == nil {
+			t.Fatal("expected an error, got none")
+		}
+
+		if got, want := err.Error(), "no data store provided"; got != want {
+			t.Errorf("%s != %s", got, want)
+		}
+	})
+}
+
+func TestExchangeError(t *testing.T) {
+	tcs := []struct {
+		name      string
+		err       error
+		permanent bool
+	}{
+		{name: "mismatch", err: &amqp.Error{Code: amqp.PreconditionFailed, Reason: "PRECONDITION_FAILED - inequivalent arg 'type'"}, permanent: true},
+		{name: "access refused", err: &amqp.Error{Code: amqp.AccessRefused, Reason: "ACCESS_REFUSED"}, permanent: true},
+		{name: "closed", err: amqp.ErrClosed, permanent: false},
+		{name: "network", err: errors.New("connection reset by peer"), permanent: false},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			err := &exchangeError{exchange: "dummy exchange", kind: exchangeFanout, err: tc.err}
+			if got := err.permanent(); got != tc.permanent {
+				t.Errorf("%t != %t", got, tc.permanent)
+			}
+			if !errors.Is(err, tc.err) {
+				t.Errorf("expected %v to wrap %v", err, tc.err)
+			}
+		})
+	}
+}
+
+func TestJitter(t *testing.T) {
+	dur, j := time.Second*5, time.Second
+	n := 10000
+	var total time.Duration
+
+	for i := 0; i < n; i++ {
+		d := jitter(dur, j)
+		if d < dur-j || d > dur+j {
+			t.Fatalf("%v outside of %v +/- %v", d, dur, j)
+		}
+		total += d
+	}
+
+	// We expect the average interval to remain close to the configured one.
+	if avg := total / time.Duration(n); avg < dur-time.Millisecond*50 || avg > dur+time.Millisecond*50 {
+		t.Errorf("average interval %v, expected about %v", avg, dur)
+	}
+
+	if got := jitter(dur, 0); got != dur {
+		t.Errorf("%v != %v", got, dur)
+	}
+}
+
+func TestNewMessage(t *testing.T) {
+	a := Aircraft{Flight: "A", Hex: "abc123", Tas: 250, AltGeom: 3000, Nic: 8, NacP: 9, Sil: 3, Emergency: "General"}
+
+	m := newMessage(AircraftPos{aircraft: a}, time.Now())
+
+	if m.Speed != a.Tas {
+		t.Errorf("%d != %d", m.Speed, a.Tas)
+	}
+
+	if m.Altitude != a.AltGeom {
+		t.Errorf("%d != %d", m.Altitude, a.AltGeom)
+	}
+
+	// We expect the position quality fields to be carried through.
+	if m.Nic != a.Nic || m.NacP != a.NacP || m.Sil != a.Sil {
+		t.Errorf("quality fields not carried through: %+v", m)
+	}
+
+	// We expect the emergency status to be normalised.
+	if m.Emergency != EmergencyGeneral {
+		t.Errorf("%q != %q", m.Emergency, EmergencyGeneral)
+	}
+}
+
+func TestNewMessageStationary(t *testing.T) {
+	a := Aircraft{Flight: "A", Hex: "abc123", Lat: 51.47, Lon: -0.45}
+
+	body, err := marshalMessage(newMessage(AircraftPos{aircraft: a}, time.Now()), keyCaseDefault)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := map[string]json.RawMessage{}
+	err = json.Unmarshal(body, &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// We expect the kinematic fields of a stationary aircraft to be
+	// published as zero rather than omitted.
+	for _, k := range []string{"altitude", "speed", "track", "vert_rate"} {
+		if got, want := string(fields[k]), "0"; got != want {
+			t.Errorf("%s: %q != %q", k, got, want)
+		}
+	}
+}
+
+func TestPublishUpdatesRefresh(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	opts := publishOptions{refreshEvery: time.Minute}
+	start := time.Now()
+
+	store.aircraft["A"] = AircraftPos{aircraft: Aircraft{Flight: "A"}, modified: true}
+
+	// The first pass publishes the modified aircraft.
+	u := updater{store: &store, opts: opts}
+
+	pub := &fakePublisher{}
+	u.pub = pub
+	u.publishUpdates(start)
+	if got, want := len(pub.bodies), 1; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+
+	// Before the refresh interval has elapsed nothing is published.
+	pub = &fakePublisher{}
+	u.pub = pub
+	u.publishUpdates(start.Add(time.Second * 30))
+	if got, want := len(pub.bodies), 0; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+
+	// Once the refresh interval has elapsed the unchanged aircraft is
+	// published again.
+	pub = &fakePublisher{}
+	u.pub = pub
+	u.publishUpdates(start.Add(time.Minute))
+	if got, want := len(pub.bodies), 1; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+	if got, want := store.aircraft["A"].published, start.Add(time.Minute); !got.Equal(want) {
+		t.Errorf("%v != %v", got, want)
+	}
+}
+
+func TestPublishUpdatesModifiedReset(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	scan := Scan{Now: 100, Aircraft: []Aircraft{{Hex: "a", Flight: "A", Lat: 1, Lon: 2}}}
+	updateAircraft(scan, &store, "dummy station")
+
+	pub := &fakePublisher{}
+	u := updater{store: &store, pub: pub}
+	u.publishUpdates(time.Now())
+	if got, want := len(pub.bodies), 1; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+
+	// We expect the published aircraft to no longer be marked modified.
+	if store.aircraft["a"].modified {
+		t.Error("expected aircraft not to be modified once published")
+	}
+
+	// Without a new scan a second pass publishes nothing.
+	pub = &fakePublisher{}
+	u.pub = pub
+	u.publishUpdates(time.Now())
+	if got, want := len(pub.bodies), 0; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+}
+
+func TestPublishUpdatesRefreshMoved(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	u := updater{store: &store, opts: publishOptions{refreshEvery: time.Minute}}
+	start := time.Now()
+
+	a := Aircraft{Hex: "a", Flight: "A", Lat: 1, Lon: 2}
+	updateAircraft(Scan{Now: 100, Aircraft: []Aircraft{a}}, &store, "dummy station")
+
+	// The stationary aircraft is republished once the interval elapses.
+	for _, now := range []time.Time{start, start.Add(time.Minute)} {
+		pub := &fakePublisher{}
+		u.pub = pub
+		u.publishUpdates(now)
+		if got, want := len(pub.bodies), 1; got != want {
+			t.Fatalf("%d != %d", got, want)
+		}
+	}
+
+	// We expect movement to be published straight away, regardless of when
+	// the aircraft was last republished.
+	a.Lat = 1.1
+	updateAircraft(Scan{Now: 101, Aircraft: []Aircraft{a}}, &store, "dummy station")
+
+	pub := &fakePublisher{}
+	u.pub = pub
+	u.publishUpdates(start.Add(time.Minute + time.Second))
+	if got, want := len(pub.bodies), 1; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+}
+
+func TestPublishUpdatesMode(t *testing.T) {
+	testCases := []struct {
+		mode publishMode
+		want int
+	}{
+		{mode: publishOnChange, want: 1},
+		{mode: publishAlways, want: 2},
+	}
+
+	for _, tc := range testCases {
+		t.Run(string(tc.mode), func(t *testing.T) {
+			store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+			store.aircraft["A"] = AircraftPos{aircraft: Aircraft{Flight: "A"}, modified: true}
+			store.aircraft["B"] = AircraftPos{aircraft: Aircraft{Flight: "B"}, published: time.Now()}
+
+			pub := &fakePublisher{}
+			u := updater{store: &store, pub: pub, opts: publishOptions{mode: tc.mode}}
+			u.publishUpdates(time.Now())
+
+			if got := len(pub.bodies); got != tc.want {
+				t.Errorf("%d != %d", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestParsePublishMode(t *testing.T) {
+	if m, err := parsePublishMode(""); err != nil || m != publishOnChange {
+		t.Errorf("expected default of %q, got %q (%v)", publishOnChange, m, err)
+	}
+
+	if _, err := parsePublishMode("sometimes"); err == nil {
+		t.Error("expected an error, got none")
+	}
+}
+
+func TestSampled(t *testing.T) {
+	rate := 0.25
+	included := 0
+	total := 10000
+
+	for i := 0; i < total; i++ {
+		a := Aircraft{Hex: fmt.Sprintf("%06x", i)}
+		got := sampled(a, rate)
+
+		// We expect the same aircraft to always be treated the same way.
+		if again := sampled(a, rate); again != got {
+			t.Fatalf("sampling of %s is not deterministic", a.Hex)
+		}
+
+		if got {
+			included++
+		}
+	}
+
+	if got := float64(included) / float64(total); math.Abs(got-rate) > 0.02 {
+		t.Errorf("sampled %.3f of aircraft, expected about %.3f", got, rate)
+	}
+
+	// We expect aircraft declaring an emergency to bypass sampling.
+	for i := 0; i < 100; i++ {
+		a := Aircraft{Hex: fmt.Sprintf("%06x", i), Emergency: "general"}
+		if !sampled(a, 0.01) {
+			t.Fatalf("expected emergency aircraft %s to be sampled", a.Hex)
+		}
+	}
+
+	// We expect a zero rate to disable sampling.
+	if !sampled(Aircraft{Hex: "abc123"}, 0) {
+		t.Error("expected a zero rate to include every aircraft")
+	}
+}
+
+func TestPublishUpdatesFailure(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	store.aircraft["A"] = AircraftPos{aircraft: Aircraft{Flight: "A"}, modified: true}
+
+	u := updater{store: &store, pub: &fakePublisher{err: errors.New("publish failed")}}
+	u.publishUpdates(time.Now())
+
+	// We expect an aircraft that failed to publish to remain modified.
+	if store.aircraft["A"].modified == false {
+		t.Error("expected aircraft to remain modified")
+	}
+}
+
+func TestPublishEmpty(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	pub := &fakePublisher{}
+	u := updater{store: &store, pub: pub, opts: publishOptions{flushOnEmpty: time.Second * 10}, station: "dummy station"}
+	start := time.Now()
+
+	// Nothing is published while the store holds aircraft.
+	store.aircraft["A"] = AircraftPos{aircraft: Aircraft{Flight: "A"}}
+	u.publishEmpty(start)
+	if got, want := len(pub.bodies), 0; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+
+	// Once the store empties, nothing is published until the debounce
+	// interval has elapsed.
+	delete(store.aircraft, "A")
+	u.publishEmpty(start.Add(time.Second))
+	u.publishEmpty(start.Add(time.Second * 5))
+	if got, want := len(pub.bodies), 0; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+
+	// After the debounce interval a single count is published.
+	u.publishEmpty(start.Add(time.Second * 11))
+	u.publishEmpty(start.Add(time.Second * 20))
+	if got, want := len(pub.bodies), 1; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+
+	m := countMessage{}
+	err := json.Unmarshal(pub.bodies[0], &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != "COUNT" || m.Count != 0 || m.StationName != "dummy station" {
+		t.Errorf("unexpected count message: %+v", m)
+	}
+
+	// An aircraft briefly reappearing resets the debounce.
+	store.aircraft["A"] = AircraftPos{aircraft: Aircraft{Flight: "A"}}
+	u.publishEmpty(start.Add(time.Second * 21))
+	delete(store.aircraft, "A")
+	u.publishEmpty(start.Add(time.Second * 22))
+	if got, want := len(pub.bodies), 1; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+}
+
+func TestPublishStats(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	store.aircraft["A"] = AircraftPos{aircraft: Aircraft{Flight: "A", Rssi: -12}}
+	pub := &fakePublisher{}
+	u := updater{store: &store, pub: pub, opts: publishOptions{statsEvery: time.Minute}, station: "dummy station"}
+	start := time.Now()
+
+	u.publishStats(start)
+	u.publishStats(start.Add(time.Second * 30))
+	u.publishStats(start.Add(time.Minute))
+
+	// We expect stats to be published once per interval.
+	if got, want := len(pub.bodies), 2; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+
+	m := statsMessage{}
+	err := json.Unmarshal(pub.bodies[0], &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.Type != "STATS" || m.Count != 1 || m.MeanRssi != -12 || m.StationName != "dummy station" {
+		t.Errorf("unexpected stats message: %+v", m)
+	}
+}
+
+func TestParseExchangeKind(t *testing.T) {
+	testCases := []struct {
+		name             string
+		kind             string
+		routeByEmergency bool
+		want             string
+		wantErr          bool
+	}{
+		{name: "default", kind: "", want: exchangeFanout},
+		{name: "direct", kind: "direct", want: exchangeDirect},
+		{name: "unknown", kind: "headers", wantErr: true},
+		{name: "route by emergency direct", kind: "direct", routeByEmergency: true, want: exchangeDirect},
+		{name: "route by emergency topic", kind: "topic", routeByEmergency: true, want: exchangeTopic},
+		{name: "route by emergency fanout", kind: "fanout", routeByEmergency: true, wantErr: true},
+		{name: "route by emergency default", kind: "", routeByEmergency: true, wantErr: true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := parseExchangeKind(tc.kind, tc.routeByEmergency)
+			if (err != nil) != tc.wantErr {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if err == nil && got != tc.want {
+				t.Errorf("%q != %q", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestValidateExchangeName(t *testing.T) {
+	tcs := []struct {
+		name    string
+		wantErr bool
+	}{
+		{name: "adsb"},
+		{name: "", wantErr: true},
+		{name: "  ", wantErr: true},
+		{name: "amq.fanout", wantErr: true},
+	}
+
+	for _, tc := range tcs {
+		err := validateExchangeName(tc.name)
+		if (err != nil) != tc.wantErr {
+			t.Errorf("%q: unexpected error: %v", tc.name, err)
+		}
+	}
+}
+
+func TestPublishUpdatesRouteByEmergency(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	store.aircraft["A"] = AircraftPos{aircraft: Aircraft{Flight: "A"}, modified: true}
+	store.aircraft["B"] = AircraftPos{aircraft: Aircraft{Flight: "B", Emergency: "none"}, modified: true}
+	store.aircraft["C"] = AircraftPos{aircraft: Aircraft{Flight: "C", Emergency: "General"}, modified: true}
+
+	pub := &fakePublisher{}
+	u := updater{store: &store, pub: pub, opts: publishOptions{routeByEmergency: true}}
+	u.publishUpdates(time.Now())
+
+	got := map[string]string{}
+	for i, b := range pub.bodies {
+		m := aircraft{}
+		err := json.Unmarshal(b, &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got[m.Flight] = pub.keys[i]
+	}
+
+	want := map[string]string{"A": keyNormal, "B": keyNormal, "C": "general"}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s: %q != %q", k, got[k], v)
+		}
+	}
+}
+
+func TestSequenceNumbers(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	now := time.Now()
+
+	pub := &fakePublisher{}
+	u := updater{store: &store, pub: pub, opts: publishOptions{sequence: true, mode: publishAlways, flushOnEmpty: time.Second}}
+
+	// Publish an empty count followed by several rounds of aircraft.
+	u.publishEmpty(now)
+	u.publishEmpty(now.Add(time.Second))
+	store.aircraft["A"] = AircraftPos{aircraft: Aircraft{Flight: "A"}}
+	store.aircraft["B"] = AircraftPos{aircraft: Aircraft{Flight: "B"}}
+	for i := 0; i < 3; i++ {
+		u.publishUpdates(now.Add(time.Second * time.Duration(i+2)))
+	}
+
+	if got, want := len(pub.bodies), 7; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+
+	// We expect sequence numbers to start at one and increase by one with
+	// each message, whatever its type.
+	for i, b := range pub.bodies {
+		m := struct {
+			Seq uint64 `json:"seq"`
+		}{}
+		err := json.Unmarshal(b, &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := m.Seq, uint64(i+1); got != want {
+			t.Errorf("%d != %d", got, want)
+		}
+	}
+
+	// Without sequence numbers the field is omitted.
+	u = updater{store: &store, pub: &fakePublisher{}}
+	if got := u.sequence(); got != 0 {
+		t.Errorf("%d != 0", got)
+	}
+}
+
+func TestPublishUpdatesStationDistance(t *testing.T) {
+	a := Aircraft{Hex: "a1", Flight: "DUMMY", Lat: 52.0, Lon: -0.45}
+	opts := publishOptions{
+		station: &location{Lat: 51.47, Lon: -0.45},
+		stations: map[string]location{
+			"north": {Lat: 53.0, Lon: -0.45},
+		},
+	}
+
+	distances := map[string]float64{}
+	for _, station := range []string{"south", "north"} {
+		store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+		a.StationName = station
+		store.aircraft["a1"] = AircraftPos{aircraft: a, modified: true}
+
+		pub := &fakePublisher{}
+		u := updater{store: &store, pub: pub, opts: opts}
+		u.publishUpdates(time.Now())
+
+		if got, want := len(pub.bodies), 1; got != want {
+			t.Fatalf("%d != %d", got, want)
+		}
+		m := struct {
+			Distance *float64 `json:"distance"`
+		}{}
+		err := json.Unmarshal(pub.bodies[0], &m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if m.Distance == nil {
+			t.Fatalf("expected distance from %s", station)
+		}
+		distances[station] = *m.Distance
+	}
+
+	// We expect the same aircraft to be 60nm from the north station and
+	// roughly 32nm from the station, which is used for the south source.
+	if got, want := math.Round(distances["north"]), 60.0; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+	if got, want := math.Round(distances["south"]), 32.0; got != want {
+		t.Errorf("%v != %v", got, want)
+	}
+}
+
+func TestPublishUpdatesIdle(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	pub := &fakePublisher{}
+	u := updater{store: &store, pub: pub, opts: publishOptions{idleAfter: time.Minute, idleJitter: 0.05}}
+
+	start := time.Now()
+	tcs := []struct {
+		name    string
+		elapsed time.Duration
+		lat     float64
+		want    bool
+	}{
+		{name: "first seen", lat: 51.47, want: true},
+		{name: "jitter", elapsed: 30 * time.Second, lat: 51.4701, want: true},
+		{name: "jitter back", elapsed: 50 * time.Second, lat: 51.47, want: true},
+		{name: "idle", elapsed: 60 * time.Second, lat: 51.4702, want: false},
+		{name: "still idle", elapsed: 90 * time.Second, lat: 51.47, want: false},
+		{name: "moved", elapsed: 120 * time.Second, lat: 51.5, want: true},
+	}
+
+	for _, tc := range tcs {
+		// A jittering aircraft is modified on every scan.
+		v := store.aircraft["a1"]
+		v.aircraft = Aircraft{Hex: "a1", Flight: "DUMMY", Lat: tc.lat, Lon: -0.45}
+		v.modified = true
+		store.aircraft["a1"] = v
+
+		before := len(pub.bodies)
+		u.publishUpdates(start.Add(tc.elapsed))
+		if got := len(pub.bodies) > before; got != tc.want {
+			t.Errorf("%s: %t != %t", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestUpdaterRunDebounce(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex), changes: make(chan struct{}, 1)}
+	pub := &fakePublisher{}
+	u := updater{store: &store, opts: publishOptions{debounce: 50 * time.Millisecond}}
+
+	// Each round of publishing connects first.
+	rounds := make(chan int, 10)
+	go u.run(ctx, newInterval(time.Hour), func() bool {
+		u.pub = pub
+		rounds <- len(pub.bodies)
+		return true
+	})
+
+	change := func(hex string) {
+		store.lock.Lock()
+		store.aircraft[hex] = AircraftPos{aircraft: Aircraft{Hex: hex, Flight: "DUMMY", Lat: 1, Lon: 2}, modified: true}
+		store.lock.Unlock()
+		store.notify()
+	}
+
+	// We expect a change to be published well before the next update.
+	change("a1")
+	select {
+	case <-rounds:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for the change to be published")
+	}
+
+	// Wait for the round to finish publishing.
+	for published := false; !published; {
+		store.lock.RLock()
+		published = !store.aircraft["a1"].modified
+		store.lock.RUnlock()
+		time.Sleep(time.Millisecond)
+	}
+
+	// We expect changes made within the debounce to be published together.
+	change("a2")
+	change("a3")
+	change("a4")
+	select {
+	case n := <-rounds:
+		if n != 1 {
+			t.Errorf("%d != %d", n, 1)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for the changes to be published")
+	}
+
+	select {
+	case <-rounds:
+		t.Error("expected the changes to be published in a single round")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	cancel()
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	for k, v := range store.aircraft {
+		if v.modified {
+			t.Errorf("expected %s to be published", k)
+		}
+	}
+}
+
+func TestUpdaterRunDisconnected(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	store.aircraft["a1"] = AircraftPos{aircraft: Aircraft{Hex: "a1", Flight: "DUMMY", Lat: 1, Lon: 2}, modified: true}
+	pub := &fakePublisher{}
+	sink := &fakePublisher{}
+	u := updater{store: &store, opts: publishOptions{sinks: []Publisher{sink}}}
+
+	// The connection is lost for the first few rounds.
+	rounds := make(chan bool)
+	go u.run(ctx, newInterval(time.Millisecond*10), func() bool {
+		connected := <-rounds
+		pub.err = nil
+		if !connected {
+			pub.err = errChannelUnavailable
+		}
+		u.pub = u.withSinks(pub)
+		return connected
+	})
+
+	for _, connected := range []bool{false, false, true} {
+		select {
+		case rounds <- connected:
+		case <-time.After(time.Second * 5):
+			t.Fatal("timed out waiting for a round of publishing")
+		}
+	}
+
+	// Wait for the connected round to finish.
+	select {
+	case rounds <- false:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for a round of publishing")
+	}
+
+	// We expect the aircraft modified while disconnected to be published
+	// once, when the connection is re-established.
+	if got, want := len(pub.bodies), 1; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+
+	// We expect the sinks to be sent the aircraft once, while
+	// disconnected.
+	if got, want := len(sink.bodies), 1; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+}
+
+func TestPublishUpdatesSinksOnce(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	a1 := Aircraft{Hex: "a1", Flight: "A", Lat: 1, Lon: 2}
+	updateAircraft(Scan{Now: 1, Aircraft: []Aircraft{a1}}, &store, "dummy station")
+
+	pub := &fakePublisher{err: errors.New("publish failed")}
+	sink := &fakePublisher{}
+	u := updater{store: &store, opts: publishOptions{sinks: []Publisher{sink}, deltaFields: true}}
+	u.pub = u.withSinks(pub)
+
+	// While publishing to RabbitMQ fails, we expect the sinks to be sent
+	// the aircraft once, however many rounds it remains modified for.
+	now := time.Now()
+	for n := 0; n < 3; n++ {
+		u.publishUpdates(now)
+	}
+	if got, want := len(sink.bodies), 1; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+	if !store.aircraft["a1"].modified {
+		t.Error("expected a1 to remain modified")
+	}
+
+	// A change is sent to the sinks as a delta from what they were sent.
+	a1.Lat = 2
+	updateAircraft(Scan{Now: 2, Aircraft: []Aircraft{a1}}, &store, "dummy station")
+	for n := 0; n < 3; n++ {
+		u.publishUpdates(now)
+	}
+	if got, want := len(sink.bodies), 2; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+	m := map[string]interface{}{}
+	if err := json.Unmarshal(sink.bodies[1], &m); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := m["flight"]; ok {
+		t.Errorf("expected a delta, got %s", sink.bodies[1])
+	}
+
+	// Once RabbitMQ recovers, the aircraft is published to it in full,
+	// without being sent to the sinks again.
+	pub.err = nil
+	u.publishUpdates(now)
+	if got, want := len(pub.bodies), 1; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+	if got, want := len(sink.bodies), 2; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+	if store.aircraft["a1"].modified {
+		t.Error("expected a1 to be published")
+	}
+}
+
+func TestPublishUpdatesOrder(t *testing.T) {
+	station := &location{Lat: 51.47, Lon: -0.45}
+	positions := map[string]Aircraft{
+		"a1": {Hex: "a1", Flight: "FAR", Lat: 53.0, Lon: -0.45},
+		"a2": {Hex: "a2", Flight: "NEAR", Lat: 51.5, Lon: -0.45},
+		"a3": {Hex: "a3", Flight: "NOPOS"},
+		"a4": {Hex: "a4", Flight: "MID", Lat: 52.0, Lon: -0.45},
+	}
+
+	tcs := []struct {
+		name    string
+		station *location
+		want    []string
+	}{
+		{name: "by hex", want: []string{"FAR", "NEAR", "NOPOS", "MID"}},
+		{name: "by distance", station: station, want: []string{"NEAR", "MID", "FAR", "NOPOS"}},
+	}
+
+	for _, tc := range tcs {
+		t.Run(tc.name, func(t *testing.T) {
+			// We expect two identical stores to publish in the same order.
+			for i := 0; i < 2; i++ {
+				store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+				for k, a := range positions {
+					store.aircraft[k] = AircraftPos{aircraft: a, modified: true}
+				}
+
+				pub := &fakePublisher{}
+				u := updater{store: &store, pub: pub, opts: publishOptions{station: tc.station}}
+				u.publishUpdates(time.Now())
+
+				got := []string{}
+				for _, b := range pub.bodies {
+					m := struct {
+						Flight string `json:"flight"`
+					}{}
+					err := json.Unmarshal(b, &m)
+					if err != nil {
+						t.Fatal(err)
+					}
+					got = append(got, m.Flight)
+				}
+
+				if !reflect.DeepEqual(got, tc.want) {
+					t.Errorf("%v != %v", got, tc.want)
+				}
+			}
+		})
+	}
+}
+
+// fakeChannel records the messages published to it.
+type fakeChannel struct {
+	msgs []amqp.Publishing
+}
+
+func (c *fakeChannel) Publish(exchange, key string, mandatory, immediate bool, msg amqp.Publishing) error {
+	c.msgs = append(c.msgs, msg)
+	return nil
+}
+
+func TestAmqpPublisherConfirmDeadline(t *testing.T) {
+	timeout := time.Millisecond * 100
+	ch := &fakeChannel{}
+	confirms := make(chan amqp.Confirmation)
+	p := &amqpPublisher{ch: ch, exchange: "dummy", confirms: &confirmer{confirms: confirms, timeout: timeout}}
+
+	msgs := []pendingMessage{}
+	for i := 0; i < 20; i++ {
+		msgs = append(msgs, pendingMessage{body: []byte(`{}`)})
+	}
+
+	// The broker never confirms the messages, so we expect each to fail
+	// once the batch's deadline has passed, rather than each waiting for
+	// the full timeout in turn.
+	start := time.Now()
+	errs := p.publishBatch(msgs)
+	if elapsed := time.Since(start); elapsed > timeout*3 {
+		t.Errorf("batch took %v, expected about %v", elapsed, timeout)
+	}
+	if got, want := len(ch.msgs), len(msgs); got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+	for i, err := range errs {
+		if !errors.Is(err, errConfirmTimeout) {
+			t.Errorf("%d: %v != %v", i, err, errConfirmTimeout)
+		}
+	}
+}
+
+func TestAmqpPublisherNoChannel(t *testing.T) {
+	p := &amqpPublisher{exchange: "dummy"}
+
+	// We expect publishing without a channel to fail rather than panic.
+	err := p.Publish(keyAircraft, []byte(`{}`))
+	if !errors.Is(err, errChannelUnavailable) {
+		t.Errorf("%v != %v", err, errChannelUnavailable)
+	}
+}
+
+func TestAmqpPublisherPersistent(t *testing.T) {
+	tcs := []struct {
+		persistent bool
+		want       uint8
+	}{
+		{persistent: false, want: amqp.Transient},
+		{persistent: true, want: amqp.Persistent},
+	}
+
+	for _, tc := range tcs {
+		p := &amqpPublisher{stationID: "dummy", persistent: tc.persistent}
+		msg, err := p.publishing([]byte(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.DeliveryMode != tc.want {
+			t.Errorf("%t: %v != %v", tc.persistent, msg.DeliveryMode, tc.want)
+		}
+		if got, want := msg.Headers["station_id"], "dummy"; got != want {
+			t.Errorf("%v != %v", got, want)
+		}
+	}
+}
+
+func TestNewPublishing(t *testing.T) {
+	small := []byte(`{"flight":"A"}`)
+	large := []byte(`[` + strings.Repeat(`{"flight":"A"},`, 100) + `{"flight":"A"}]`)
+
+	testCases := []struct {
+		name          string
+		body          []byte
+		compressAbove int
+		wantEncoding  string
+	}{
+		{name: "disabled", body: large, compressAbove: 0, wantEncoding: ""},
+		{name: "small", body: small, compressAbove: 256, wantEncoding: ""},
+		{name: "large", body: large, compressAbove: 256, wantEncoding: "gzip"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			msg, err := newPublishing(tc.body, tc.compressAbove)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if msg.ContentEncoding != tc.wantEncoding {
+				t.Fatalf("%q != %q", msg.ContentEncoding, tc.wantEncoding)
+			}
+
+			body := msg.Body
+			if msg.ContentEncoding == "gzip" {
+				if len(body) >= len(tc.body) {
+					t.Errorf("expected compressed body to be smaller: %d >= %d", len(body), len(tc.body))
+				}
+
+				zr, err := gzip.NewReader(bytes.NewReader(body))
+				if err != nil {
+					t.Fatal(err)
+				}
+				body, err = ioutil.ReadAll(zr)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			if !bytes.Equal(body, tc.body) {
+				t.Errorf("%s != %s", body, tc.body)
+			}
+		})
+	}
+}
+
+func TestPublishUpdatesIncludeSource(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+
+	updateAircraft(Scan{source: "/run/dump1090-fa/aircraft.json", Aircraft: []Aircraft{{Hex: "a1", Flight: "A", Lat: 1, Lon: 1}}}, &store, "dummy station")
+	updateAircraft(Scan{source: "/run/dump978-fa/aircraft.json", Aircraft: []Aircraft{{Hex: "b2", Flight: "B", Lat: 2, Lon: 2}}}, &store, "dummy station")
+
+	for _, include := range []bool{false, true} {
+		for k, v := range store.aircraft {
+			v.modified = true
+			store.aircraft[k] = v
+		}
+
+		pub := &fakePublisher{}
+		u := updater{store: &store, pub: pub, opts: publishOptions{includeSource: include}}
+		u.publishUpdates(time.Now())
+
+		got := map[string]string{}
+		for _, b := range pub.bodies {
+			m := map[string]interface{}{}
+			err := json.Unmarshal(b, &m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if s, ok := m["source"]; ok {
+				got[m["hex"].(string)] = s.(string)
+			}
+		}
+
+		// We expect the source to be included only when enabled.
+		want := map[string]string{}
+		if include {
+			want = map[string]string{"a1": "/run/dump1090-fa/aircraft.json", "b2": "/run/dump978-fa/aircraft.json"}
+		}
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("include %v: %v != %v", include, got, want)
+		}
+	}
+}
+
+// lockedPublisher records the messages published to it and is safe for
+// concurrent use.
+type lockedPublisher struct {
+	lock  sync.Mutex
+	delay time.Duration
+	fakePublisher
+}
+
+func (p *lockedPublisher) Publish(routingKey string, body []byte) error {
+	time.Sleep(p.delay)
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.fakePublisher.Publish(routingKey, body)
+}
+
+func TestPublishUpdatesWorkers(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	for i := 0; i < 100; i++ {
+		hex := fmt.Sprintf("%06x", i)
+		store.aircraft[hex] = AircraftPos{aircraft: Aircraft{Hex: hex, Flight: hex}, modified: true}
+	}
+
+	workers := []*lockedPublisher{{}, {}, {}, {}}
+	u := updater{store: &store}
+	for _, w := range workers {
+		u.workers = append(u.workers, w)
+	}
+	u.publishUpdates(time.Now())
+
+	// We expect every aircraft to be published exactly once, across the
+	// workers.
+	counts := map[string]int{}
+	for _, w := range workers {
+		for _, b := range w.bodies {
+			m := aircraft{}
+			err := json.Unmarshal(b, &m)
+			if err != nil {
+				t.Fatal(err)
+			}
+			counts[m.Hex]++
+		}
+	}
+	if got, want := len(counts), len(store.aircraft); got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+	for hex, n := range counts {
+		if n != 1 {
+			t.Errorf("%s published %d times", hex, n)
+		}
+	}
+
+	for k, v := range store.aircraft {
+		if v.modified {
+			t.Errorf("expected %s to be marked as published", k)
+		}
+	}
+
+	// Aircraft that fail to publish remain modified.
+	for k, v := range store.aircraft {
+		v.modified = true
+		store.aircraft[k] = v
+	}
+	for _, w := range workers {
+		w.err = errors.New("publish failed")
+	}
+	u.publishUpdates(time.Now())
+
+	for k, v := range store.aircraft {
+		if !v.modified {
+			t.Errorf("expected %s to remain modified", k)
+		}
+	}
+}
+
+func BenchmarkPublishUpdates(b *testing.B) {
+	for _, n := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", n), func(b *testing.B) {
+			store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+			for i := 0; i < 200; i++ {
+				hex := fmt.Sprintf("%06x", i)
+				store.aircraft[hex] = AircraftPos{aircraft: Aircraft{Hex: hex, Flight: hex}}
+			}
+
+			// Each publish simulates a round trip to the broker.
+			u := updater{store: &store, opts: publishOptions{mode: publishAlways}}
+			u.pub = &lockedPublisher{delay: time.Microsecond * 50}
+			for i := 0; i < n; i++ {
+				u.workers = append(u.workers, &lockedPublisher{delay: time.Microsecond * 50})
+			}
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				u.publishUpdates(time.Now())
+			}
+		})
+	}
+}
+
+// blockingPublisher blocks each publish until it is released.
+type blockingPublisher struct {
+	started chan struct{}
+	release chan struct{}
+	fakePublisher
+}
+
+func (p *blockingPublisher) Publish(routingKey string, body []byte) error {
+	p.started <- struct{}{}
+	<-p.release
+	return p.fakePublisher.Publish(routingKey, body)
+}
+
+func TestPublishUpdatesBlocked(t *testing.T) {
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	a1 := Aircraft{Hex: "a1", Flight: "A", Lat: 1, Lon: 2, Seen: 1}
+	store.aircraft["a1"] = AircraftPos{aircraft: a1, modified: true}
+
+	pub := &blockingPublisher{started: make(chan struct{}), release: make(chan struct{})}
+	u := updater{store: &store, pub: pub}
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		u.publishUpdates(time.Now())
+	}()
+	<-pub.started
+
+	// We expect the data Store to be updated while the publisher is
+	// blocked.
+	updated := make(chan struct{})
+	go func() {
+		defer close(updated)
+		a1.Lat = 2
+		updateAircraft(Scan{Now: 1, Aircraft: []Aircraft{a1}}, &store, "dummy station")
+		purgeAircraft(Scan{Now: 1, Aircraft: []Aircraft{a1}}, &store, time.Minute)
+	}()
+	select {
+	case <-updated:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for the data Store to be updated")
+	}
+
+	close(pub.release)
+	<-done
+
+	// The aircraft was updated after its message was made, so we expect it
+	// to remain modified for the update to be published.
+	if got, want := len(pub.bodies), 1; got != want {
+		t.Fatalf("%d != %d", got, want)
+	}
+	v := store.aircraft["a1"]
+	if !v.modified || v.published.IsZero() {
+		t.Errorf("expected a1 to be published and remain modified: %+v", v)
+	}
+}
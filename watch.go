@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// watchFile notifies changes to the file at path on the returned channel
+// as they are made. The directory containing the file is watched, rather
+// than the file itself, so that files replaced atomically by writing a
+// temporary file and renaming it over the original, as dump1090 does, are
+// still followed: the rename is reported as the file being created.
+// Several changes made before the last is received are notified once. The
+// channel is closed if the watch fails, if the directory is removed or
+// renamed, as the watch is silently dropped, or if the context is
+// cancelled. An error is returned if the filesystem doesn't support
+// notifications.
+func watchFile(ctx context.Context, path string) (<-chan struct{}, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		return nil, err
+	}
+
+	dir := filepath.Clean(filepath.Dir(path))
+	name := filepath.Clean(path)
+	changes := make(chan struct{}, 1)
+
+	go func() {
+		defer close(changes)
+		defer w.Close()
+
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) == dir && ev.Op&(fsnotify.Remove|fsnotify.Rename) != 0 {
+					fmt.Fprintf(os.Stderr, "stopped watching %s: directory removed\n", path)
+					return
+				}
+				if filepath.Clean(ev.Name) != name || ev.Op&(fsnotify.Write|fsnotify.Create) == 0 {
+					continue
+				}
+
+				select {
+				case changes <- struct{}{}:
+				default:
+				}
+
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				fmt.Fprintf(os.Stderr, "failed to watch %s: %v\n", path, err)
+				return
+
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	return changes, nil
+}
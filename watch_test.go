@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWatchFile(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "aircraft.json")
+	changes, err := watchFile(ctx, path)
+	if err != nil {
+		t.Skipf("notifications not supported: %v", err)
+	}
+
+	expect := func(want bool) {
+		t.Helper()
+		select {
+		case <-changes:
+			if !want {
+				t.Error("unexpected change")
+			}
+		case <-time.After(time.Millisecond * 200):
+			if want {
+				t.Error("expected a change")
+			}
+		}
+	}
+
+	// Writing the file is notified.
+	if err := ioutil.WriteFile(path, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expect(true)
+
+	// Writing a file may be notified as both its creation and a write.
+	time.Sleep(time.Millisecond * 50)
+	for len(changes) > 0 {
+		<-changes
+	}
+
+	// Other files in the directory are ignored.
+	tmp := filepath.Join(dir, "aircraft.json.tmp")
+	if err := ioutil.WriteFile(tmp, []byte(`{}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	expect(false)
+
+	// Replacing the file with a rename is notified.
+	if err := os.Rename(tmp, path); err != nil {
+		t.Fatal(err)
+	}
+	expect(true)
+
+	// The channel is closed once the context is cancelled.
+	cancel()
+	deadline := time.After(time.Second)
+	for {
+		select {
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatal("expected the channel to be closed")
+		}
+	}
+}
+
+func TestStartMonitorWatch(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	dir, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "aircraft.json")
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+
+	// The interval is long enough that scans are only read when notified.
+	err = startMonitor(ctx, path, time.Hour, time.Second*60, &store, "dummy station", monitorOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := func(hex string) bool {
+		deadline := time.Now().Add(time.Second * 5)
+		for time.Now().Before(deadline) {
+			store.lock.RLock()
+			_, ok := store.aircraft[hex]
+			store.lock.RUnlock()
+
+			if ok {
+				return true
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		return false
+	}
+
+	// dump1090 replaces the file by renaming a temporary file over it.
+	replace := func(body string) {
+		tmp := path + ".tmp"
+		if err := ioutil.WriteFile(tmp, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Rename(tmp, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	replace(`{"now":1,"aircraft":[{"hex":"a1","flight":"A","lat":1,"lon":2}]}`)
+	if !stored("a1") {
+		t.Fatal("expected the source to be read once created")
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	replace(`{"now":2,"aircraft":[{"hex":"a2","flight":"B","lat":1,"lon":2}]}`)
+	if !stored("a2") {
+		t.Error("expected the source to be read once replaced")
+	}
+}
+
+func TestWatchFileDirectoryRemoved(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	parent, err := ioutil.TempDir("", "watch")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+
+	dir := filepath.Join(parent, "dump1090-fa")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	changes, err := watchFile(ctx, filepath.Join(dir, "aircraft.json"))
+	if err != nil {
+		t.Skipf("notifications not supported: %v", err)
+	}
+
+	// We expect the channel to be closed once the directory is removed, as
+	// the watch is lost along with it.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.After(time.Second * 5)
+	for {
+		select {
+		case _, ok := <-changes:
+			if !ok {
+				return
+			}
+		case <-deadline:
+			t.Fatal("expected the channel to be closed")
+		}
+	}
+}
+
+func TestStartMonitorWatchDirectoryRecreated(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	parent, err := ioutil.TempDir("", "monitor")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(parent)
+
+	dir := filepath.Join(parent, "dump1090-fa")
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	path := filepath.Join(dir, "aircraft.json")
+	store := Store{aircraft: make(map[string]AircraftPos), lock: new(sync.RWMutex)}
+	err = startMonitor(ctx, path, time.Millisecond*20, time.Second*60, &store, "dummy station", monitorOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stored := func(hex string) bool {
+		deadline := time.Now().Add(time.Second * 5)
+		for time.Now().Before(deadline) {
+			store.lock.RLock()
+			_, ok := store.aircraft[hex]
+			store.lock.RUnlock()
+
+			if ok {
+				return true
+			}
+			time.Sleep(time.Millisecond * 10)
+		}
+		return false
+	}
+
+	write := func(body string) {
+		if err := ioutil.WriteFile(path, []byte(body), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	time.Sleep(time.Millisecond * 50)
+	write(`{"now":1,"aircraft":[{"hex":"a1","flight":"A","lat":1,"lon":2}]}`)
+	if !stored("a1") {
+		t.Fatal("expected the source to be read once created")
+	}
+
+	// dump1090-fa removes and recreates its directory when it restarts.
+	if err := os.RemoveAll(dir); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(time.Millisecond * 100)
+	write(`{"now":2,"aircraft":[{"hex":"a2","flight":"B","lat":1,"lon":2}]}`)
+	if !stored("a2") {
+		t.Fatal("expected the source to be read once its directory was recreated")
+	}
+
+	// Once watched again, changes are still read.
+	time.Sleep(time.Millisecond * 100)
+	write(`{"now":3,"aircraft":[{"hex":"a3","flight":"C","lat":1,"lon":2}]}`)
+	if !stored("a3") {
+		t.Error("expected the source to be read once watched again")
+	}
+}
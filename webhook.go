@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"expvar"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"time"
+)
+
+// Defaults used when posting messages to a webhook.
+const (
+	defaultContentType = "application/json"
+	webhookQueueSize   = 1024
+	webhookBatchWait   = time.Millisecond * 100
+	webhookMaxBuffered = 16384
+)
+
+// webhookDropped counts messages dropped because the webhook wasn't keeping
+// up or failed to accept them.
+var webhookDropped = expvar.NewInt("webhook_dropped")
+
+// webhookOptions control how messages are posted to a webhook.
+type webhookOptions struct {
+	contentType string            // content type of each request, defaults to application/json
+	headers     map[string]string // static headers sent with each request, such as an API key
+	timeout     time.Duration     // time allowed for each request
+	batchSize   int               // post up to this many messages as a JSON array, 1 or less posts each on its own
+	attempts    int               // number of attempts to post a batch that fails with a network or 5xx error
+	retryDelay  time.Duration     // delay before the first retry, doubled for each subsequent retry
+	flushEvery  time.Duration     // buffer messages and post them this often, zero posts them as they arrive
+	maxBytes    int               // batches larger than this many bytes are split, zero disables the limit
+}
+
+// webhookSink posts published messages to an HTTP endpoint. Messages are
+// queued and posted by a separate Go routine so that a slow endpoint
+// doesn't hold up publishing to other sinks.
+type webhookSink struct {
+	url     string
+	opts    webhookOptions
+	headers http.Header
+	client  *http.Client
+	queue   chan []byte
+}
+
+// StartWebhookSink starts a new Go routine posting published messages to
+// url. Cancelling the provided context stops posting; queued messages are
+// discarded.
+func startWebhookSink(ctx context.Context, url string, opts webhookOptions) *webhookSink {
+	s := newWebhookSink(url, opts)
+	go s.run(ctx)
+	return s
+}
+
+// NewWebhookSink returns a sink posting messages to url. Messages aren't
+// posted until run is called.
+func newWebhookSink(url string, opts webhookOptions) *webhookSink {
+	if opts.contentType == "" {
+		opts.contentType = defaultContentType
+	}
+	if opts.attempts < 1 {
+		opts.attempts = 1
+	}
+
+	h := make(http.Header, len(opts.headers))
+	for k, v := range opts.headers {
+		h.Set(k, v)
+	}
+
+	return &webhookSink{
+		url:     url,
+		opts:    opts,
+		headers: h,
+		client:  &http.Client{Timeout: opts.timeout},
+		queue:   make(chan []byte, webhookQueueSize),
+	}
+}
+
+// Publish queues body for the webhook, dropping it if the queue is full.
+func (s *webhookSink) Publish(routingKey string, body []byte) error {
+	select {
+	case s.queue <- body:
+	default:
+		webhookDropped.Add(1)
+	}
+	return nil
+}
+
+// run posts queued messages, in batches if configured, until the context
+// is cancelled.
+func (s *webhookSink) run(ctx context.Context) {
+	if s.opts.flushEvery > 0 {
+		s.runBuffered(ctx)
+		return
+	}
+
+	for {
+		batch, ok := s.next(ctx)
+		if !ok {
+			return
+		}
+		s.send(ctx, batch)
+	}
+}
+
+// runBuffered buffers queued messages and posts them every flushEvery, in
+// batches if configured, until the context is cancelled.
+func (s *webhookSink) runBuffered(ctx context.Context) {
+	ticker := time.NewTicker(s.opts.flushEvery)
+	defer ticker.Stop()
+
+	var buf [][]byte
+	for {
+		select {
+		case body := <-s.queue:
+			if len(buf) >= webhookMaxBuffered {
+				webhookDropped.Add(1)
+				continue
+			}
+			buf = append(buf, body)
+
+		case <-ticker.C:
+			size := s.opts.batchSize
+			if size < 1 {
+				size = 1
+			}
+			for len(buf) > 0 && ctx.Err() == nil {
+				n := size
+				if n > len(buf) {
+					n = len(buf)
+				}
+				s.send(ctx, buf[:n])
+				buf = buf[n:]
+			}
+			buf = nil
+
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// send posts a batch of messages, counting and logging them as dropped
+// if they can't be posted. Batches larger than maxBytes are split in half
+// until they fit; messages that don't fit on their own are dropped.
+func (s *webhookSink) send(ctx context.Context, batch [][]byte) {
+	body := s.encode(batch)
+	if s.opts.maxBytes > 0 && len(body) > s.opts.maxBytes {
+		if len(batch) == 1 {
+			dropTooLarge(len(body))
+			return
+		}
+		half := len(batch) / 2
+		s.send(ctx, batch[:half])
+		s.send(ctx, batch[half:])
+		return
+	}
+
+	err := s.post(ctx, body)
+	if err != nil && ctx.Err() == nil {
+		webhookDropped.Add(int64(len(batch)))
+		fmt.Fprintf(os.Stderr, "failed to post %d messages to webhook: %v\n", len(batch), err)
+	}
+}
+
+// next waits for a queued message and then gathers up to batchSize
+// messages, waiting briefly for the rest of a batch to be published. It
+// returns false if the context is cancelled.
+func (s *webhookSink) next(ctx context.Context) ([][]byte, bool) {
+	var batch [][]byte
+	select {
+	case body := <-s.queue:
+		batch = append(batch, body)
+	case <-ctx.Done():
+		return nil, false
+	}
+
+	wait := time.NewTimer(webhookBatchWait)
+	defer wait.Stop()
+	for len(batch) < s.opts.batchSize {
+		select {
+		case body := <-s.queue:
+			batch = append(batch, body)
+		case <-wait.C:
+			return batch, true
+		case <-ctx.Done():
+			return nil, false
+		}
+	}
+	return batch, true
+}
+
+// encode returns the request body for a batch of messages. Messages are
+// posted as a JSON array if batching is enabled.
+func (s *webhookSink) encode(batch [][]byte) []byte {
+	if s.opts.batchSize <= 1 {
+		return batch[0]
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('[')
+	buf.Write(bytes.Join(batch, []byte{','}))
+	buf.WriteByte(']')
+	return buf.Bytes()
+}
+
+// post sends body to the webhook, retrying network errors and 5xx
+// responses with an increasing delay. Other responses outside the 2xx
+// range are not retried.
+func (s *webhookSink) post(ctx context.Context, body []byte) error {
+	delay := s.opts.retryDelay
+	var err error
+	for n := 1; n <= s.opts.attempts; n++ {
+		var retry bool
+		retry, err = s.postOnce(ctx, body)
+		if err == nil || !retry || n == s.opts.attempts {
+			break
+		}
+
+		select {
+		case <-time.After(delay):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		delay *= 2
+	}
+	return err
+}
+
+// postOnce sends body to the webhook once, reporting whether a failure is
+// worth retrying.
+func (s *webhookSink) postOnce(ctx context.Context, body []byte) (bool, error) {
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return false, fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req = req.WithContext(ctx)
+	for k, v := range s.headers {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", s.opts.contentType)
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("failed to post to webhook: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return resp.StatusCode >= 500, fmt.Errorf("webhook responded with status %s", resp.Status)
+	}
+	return false, nil
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWebhookSinkHeaders(t *testing.T) {
+	type request struct {
+		header http.Header
+		body   string
+	}
+	reqs := make(chan request, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		reqs <- request{header: r.Header, body: string(b)}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sink := startWebhookSink(ctx, srv.URL, webhookOptions{
+		contentType: "application/vnd.adsb+json",
+		headers:     map[string]string{"x-api-key": "secret", "X-Station": "dummy"},
+		timeout:     time.Second,
+	})
+	sink.Publish(keyAircraft, []byte(`{"flight":"A"}`))
+
+	var req request
+	select {
+	case req = <-reqs:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for request")
+	}
+
+	if got, want := req.body, `{"flight":"A"}`; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+	if got, want := req.header.Get("Content-Type"), "application/vnd.adsb+json"; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+	if got, want := req.header.Get("X-Api-Key"), "secret"; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+	if got, want := req.header.Get("X-Station"), "dummy"; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+}
+
+func TestWebhookSinkDefaultContentType(t *testing.T) {
+	contentTypes := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		contentTypes <- r.Header.Get("Content-Type")
+	}))
+	defer srv.Close()
+
+	sink := newWebhookSink(srv.URL, webhookOptions{timeout: time.Second})
+	err := sink.post(context.Background(), []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got, want := <-contentTypes, defaultContentType; got != want {
+		t.Errorf("%q != %q", got, want)
+	}
+}
+
+func TestWebhookSinkBatch(t *testing.T) {
+	bodies := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		bodies <- string(b)
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sink := newWebhookSink(srv.URL, webhookOptions{timeout: time.Second, batchSize: 3})
+	sink.Publish(keyAircraft, []byte(`{"flight":"A"}`))
+	sink.Publish(keyAircraft, []byte(`{"flight":"B"}`))
+	sink.Publish(keyAircraft, []byte(`{"flight":"C"}`))
+	go sink.run(ctx)
+
+	select {
+	case body := <-bodies:
+		if want := `[{"flight":"A"},{"flight":"B"},{"flight":"C"}]`; body != want {
+			t.Errorf("%q != %q", body, want)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for request")
+	}
+}
+
+func TestWebhookSinkMaxBytes(t *testing.T) {
+	var lock sync.Mutex
+	bodies := []string{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		lock.Lock()
+		defer lock.Unlock()
+		bodies = append(bodies, string(b))
+	}))
+	defer srv.Close()
+
+	sink := newWebhookSink(srv.URL, webhookOptions{timeout: time.Second, batchSize: 4, maxBytes: 40})
+	huge := []byte(`{"flight":"` + strings.Repeat("X", 100) + `"}`)
+	batch := [][]byte{[]byte(`{"flight":"A"}`), []byte(`{"flight":"B"}`), huge, []byte(`{"flight":"C"}`)}
+
+	before := messagesTooLarge.Value()
+	sink.send(context.Background(), batch)
+
+	// We expect the batch to be split until it fits and the message that
+	// doesn't fit on its own to be dropped.
+	lock.Lock()
+	defer lock.Unlock()
+	want := []string{`[{"flight":"A"},{"flight":"B"}]`, `[{"flight":"C"}]`}
+	if !reflect.DeepEqual(bodies, want) {
+		t.Errorf("%q != %q", bodies, want)
+	}
+	if got, want := messagesTooLarge.Value()-before, int64(1); got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+}
+
+func TestWebhookSinkRetry(t *testing.T) {
+	var lock sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+		if requests == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+
+	sink := newWebhookSink(srv.URL, webhookOptions{timeout: time.Second, attempts: 3, retryDelay: time.Millisecond})
+	err := sink.post(context.Background(), []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if got, want := requests, 2; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+}
+
+func TestWebhookSinkNoRetry(t *testing.T) {
+	var lock sync.Mutex
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		requests++
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer srv.Close()
+
+	sink := newWebhookSink(srv.URL, webhookOptions{timeout: time.Second, attempts: 3, retryDelay: time.Millisecond})
+	err := sink.post(context.Background(), []byte(`{}`))
+	if err == nil {
+		t.Error("expected an error")
+	}
+
+	lock.Lock()
+	defer lock.Unlock()
+	if got, want := requests, 1; got != want {
+		t.Errorf("%d != %d", got, want)
+	}
+}
+
+func TestWebhookSinkFlushEvery(t *testing.T) {
+	type request struct {
+		at   time.Time
+		body string
+	}
+	reqs := make(chan request, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		reqs <- request{at: time.Now(), body: string(b)}
+	}))
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	flushEvery := time.Millisecond * 300
+	start := time.Now()
+	sink := startWebhookSink(ctx, srv.URL, webhookOptions{timeout: time.Second, batchSize: 10, flushEvery: flushEvery})
+
+	// Messages published on several updates, more often than the flush
+	// interval, are buffered and posted together.
+	for i, flight := range []string{"A", "B", "C"} {
+		if i > 0 {
+			time.Sleep(time.Millisecond * 50)
+		}
+		sink.Publish(keyAircraft, []byte(`{"flight":"`+flight+`"}`))
+	}
+
+	select {
+	case req := <-reqs:
+		if want := `[{"flight":"A"},{"flight":"B"},{"flight":"C"}]`; req.body != want {
+			t.Errorf("%q != %q", req.body, want)
+		}
+		if elapsed := req.at.Sub(start); elapsed < flushEvery {
+			t.Errorf("flushed after %s, before the flush interval of %s", elapsed, flushEvery)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for request")
+	}
+
+	select {
+	case req := <-reqs:
+		t.Errorf("unexpected request: %q", req.body)
+	case <-time.After(flushEvery * 2):
+	}
+}